@@ -0,0 +1,387 @@
+// Copyright 2023 Wayback Archiver. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package proxier // import "github.com/wabarc/proxier"
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/proxy"
+)
+
+// An AuthChallenge is a challenge of a Proxy-Authenticate header.
+type AuthChallenge struct {
+	// Scheme is the authentication scheme, such as "Digest".
+	Scheme string
+	// Params holds the auth-params of the challenge, keyed by their names
+	// in lower case, or its token68 under the empty key.
+	Params map[string]string
+}
+
+// A ProxyAuthenticator answers the authentication challenges of HTTP proxies
+// for one scheme. It must be safe for concurrent use.
+type ProxyAuthenticator interface {
+	// Scheme returns the scheme of the challenges it answers, matched
+	// without regard to case.
+	Scheme() string
+	// Authorize returns the Proxy-Authorization header value answering c
+	// for req, a CONNECT request or a request sent to the proxy.
+	Authorize(c *AuthChallenge, req *http.Request) (string, error)
+}
+
+type basicAuth struct {
+	user, password string
+}
+
+// BasicAuth returns a ProxyAuthenticator for the Basic scheme.
+func BasicAuth(user, password string) ProxyAuthenticator {
+	return &basicAuth{user: user, password: password}
+}
+
+func (*basicAuth) Scheme() string { return "Basic" }
+
+func (a *basicAuth) Authorize(*AuthChallenge, *http.Request) (string, error) {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(a.user+":"+a.password)), nil
+}
+
+type bearerAuth struct {
+	token string
+}
+
+// BearerAuth returns a ProxyAuthenticator for the Bearer scheme, sending
+// token.
+func BearerAuth(token string) ProxyAuthenticator {
+	return &bearerAuth{token: token}
+}
+
+func (*bearerAuth) Scheme() string { return "Bearer" }
+
+func (a *bearerAuth) Authorize(*AuthChallenge, *http.Request) (string, error) {
+	return "Bearer " + a.token, nil
+}
+
+type digestAuth struct {
+	user, password string
+
+	mu sync.Mutex
+	// The nonce last used, and the number of requests made with it.
+	nonce string
+	count int
+}
+
+// DigestAuth returns a ProxyAuthenticator for the Digest scheme, as specified
+// by RFC 7616, with the MD5 and SHA-256 algorithms and their session
+// variants, and with or without the auth quality of protection.
+func DigestAuth(user, password string) ProxyAuthenticator {
+	return &digestAuth{user: user, password: password}
+}
+
+func (*digestAuth) Scheme() string { return "Digest" }
+
+func (a *digestAuth) Authorize(c *AuthChallenge, req *http.Request) (string, error) {
+	algorithm := c.Params["algorithm"]
+	if algorithm == "" {
+		algorithm = "MD5"
+	}
+	var newHash func() hash.Hash
+	switch base := strings.TrimSuffix(strings.ToUpper(algorithm), "-SESS"); base {
+	case "MD5":
+		newHash = md5.New
+	case "SHA-256":
+		newHash = sha256.New
+	default:
+		return "", fmt.Errorf("unsupported digest algorithm %q", algorithm)
+	}
+	h := func(s ...string) string {
+		d := newHash()
+		io.WriteString(d, strings.Join(s, ":"))
+		return hex.EncodeToString(d.Sum(nil))
+	}
+
+	var qop string
+	if qops, ok := c.Params["qop"]; ok {
+		for _, q := range strings.Split(qops, ",") {
+			if strings.TrimSpace(q) == "auth" {
+				qop = "auth"
+			}
+		}
+		if qop == "" {
+			return "", fmt.Errorf("unsupported digest qop %q", qops)
+		}
+	}
+
+	realm, nonce := c.Params["realm"], c.Params["nonce"]
+	// The request-target, as http.Request.Write sends it to a proxy.
+	uri := req.URL.RequestURI()
+	switch {
+	case req.Method == http.MethodConnect:
+		uri = req.Host
+	case req.URL.Scheme != "" && req.URL.Opaque == "":
+		host := req.Host
+		if host == "" {
+			host = req.URL.Host
+		}
+		uri = req.URL.Scheme + "://" + host + uri
+	}
+
+	a.mu.Lock()
+	if nonce != a.nonce {
+		a.nonce, a.count = nonce, 0
+	}
+	a.count++
+	nc := fmt.Sprintf("%08x", a.count)
+	a.mu.Unlock()
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	cnonce := hex.EncodeToString(b[:])
+
+	ha1 := h(a.user, realm, a.password)
+	if strings.HasSuffix(strings.ToUpper(algorithm), "-SESS") {
+		ha1 = h(ha1, nonce, cnonce)
+	}
+	ha2 := h(req.Method, uri)
+	response := h(ha1, nonce, ha2)
+	if qop != "" {
+		response = h(ha1, nonce, nc, cnonce, qop, ha2)
+	}
+
+	var s strings.Builder
+	fmt.Fprintf(&s, `Digest username=%s, realm=%s, nonce=%s, uri=%s, algorithm=%s, response=%s`,
+		quote(a.user), quote(realm), quote(nonce), quote(uri), algorithm, quote(response))
+	if opaque, ok := c.Params["opaque"]; ok {
+		fmt.Fprintf(&s, ", opaque=%s", quote(opaque))
+	}
+	if qop != "" {
+		fmt.Fprintf(&s, ", qop=%s, nc=%s, cnonce=%s", qop, nc, quote(cnonce))
+	}
+
+	return s.String(), nil
+}
+
+// quote returns s as a quoted-string.
+func quote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// Requests answering a challenge are given up after this many tries, which
+// allows for a stale nonce.
+const maxAuthAttempts = 3
+
+// proxyAuth answers the authentication challenges of an HTTP proxy.
+type proxyAuth struct {
+	// Credentials sent before any challenge, if set.
+	basic *proxy.Auth
+
+	authenticators []ProxyAuthenticator
+
+	mu sync.Mutex
+	// The last challenge answered, and its authenticator, used to
+	// authorize later requests before they are challenged.
+	last          ProxyAuthenticator
+	lastChallenge *AuthChallenge
+}
+
+// newProxyAuth returns a proxyAuth with authenticators, or if there are none,
+// one that sends the Basic credentials of auth before any challenge, and
+// answers Digest and Basic challenges with them.
+func newProxyAuth(auth *proxy.Auth, authenticators []ProxyAuthenticator) *proxyAuth {
+	if len(authenticators) > 0 {
+		return &proxyAuth{authenticators: authenticators}
+	}
+	if auth == nil {
+		return &proxyAuth{}
+	}
+
+	return &proxyAuth{
+		basic: auth,
+		authenticators: []ProxyAuthenticator{
+			DigestAuth(auth.User, auth.Password),
+			BasicAuth(auth.User, auth.Password),
+		},
+	}
+}
+
+// preempt sets the Proxy-Authorization header of req before it is sent, if
+// the proxy is known to want one.
+func (a *proxyAuth) preempt(req *http.Request) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	last, c := a.last, a.lastChallenge
+	a.mu.Unlock()
+
+	if last != nil {
+		if authz, err := last.Authorize(c, req); err == nil {
+			req.Header.Set("Proxy-Authorization", authz)
+			return
+		}
+	}
+	if a.basic != nil {
+		req.Header.Set("Proxy-Authorization", "basic "+
+			base64.StdEncoding.EncodeToString([]byte(a.basic.User+":"+a.basic.Password)))
+	}
+}
+
+// errNoAuthenticator is returned when no authenticator answers a challenge.
+var errNoAuthenticator = errors.New("no authenticator for the proxy's challenges")
+
+// answer sets the Proxy-Authorization header of req to answer the challenges
+// of resp, a 407 response, with the first authenticator that can.
+func (a *proxyAuth) answer(resp *http.Response, req *http.Request) error {
+	if a == nil {
+		return errNoAuthenticator
+	}
+	challenges := parseChallenges(resp.Header.Values("Proxy-Authenticate"))
+
+	err := errNoAuthenticator
+	for _, auth := range a.authenticators {
+		for i := range challenges {
+			c := &challenges[i]
+			if !strings.EqualFold(c.Scheme, auth.Scheme()) {
+				continue
+			}
+			var authz string
+			if authz, err = auth.Authorize(c, req); err != nil {
+				continue
+			}
+			req.Header.Set("Proxy-Authorization", authz)
+			a.mu.Lock()
+			a.last, a.lastChallenge = auth, c
+			a.mu.Unlock()
+			return nil
+		}
+	}
+
+	return err
+}
+
+// parseChallenges parses the challenges of Proxy-Authenticate header values,
+// as specified by RFC 9110, section 11.
+func parseChallenges(values []string) []AuthChallenge {
+	var challenges []AuthChallenge
+	for _, v := range values {
+		p := &authParser{s: v}
+		for {
+			p.skip(", \t")
+			scheme := p.token()
+			if scheme == "" {
+				break
+			}
+			c := AuthChallenge{Scheme: scheme, Params: make(map[string]string)}
+			p.skip(" \t")
+			if t := p.token68(); t != "" {
+				c.Params[""] = t
+			} else {
+				for {
+					save := p.i
+					p.skip(", \t")
+					name := p.token()
+					p.skip(" \t")
+					if name == "" || !p.consume('=') {
+						// Another challenge.
+						p.i = save
+						break
+					}
+					p.skip(" \t")
+					c.Params[strings.ToLower(name)] = p.value()
+				}
+			}
+			challenges = append(challenges, c)
+		}
+	}
+
+	return challenges
+}
+
+type authParser struct {
+	s string
+	i int
+}
+
+func (p *authParser) skip(chars string) {
+	for p.i < len(p.s) && strings.IndexByte(chars, p.s[p.i]) >= 0 {
+		p.i++
+	}
+}
+
+func (p *authParser) consume(b byte) bool {
+	if p.i < len(p.s) && p.s[p.i] == b {
+		p.i++
+		return true
+	}
+	return false
+}
+
+func (p *authParser) token() string {
+	start := p.i
+	for p.i < len(p.s) && isTokenChar(p.s[p.i]) {
+		p.i++
+	}
+	return p.s[start:p.i]
+}
+
+// token68 reads a token68, which is the only credential of a challenge, or
+// returns "".
+func (p *authParser) token68() string {
+	start := p.i
+	for p.i < len(p.s) && (isAlphanumeric(p.s[p.i]) || strings.IndexByte("-._~+/", p.s[p.i]) >= 0) {
+		p.i++
+	}
+	if p.i == start {
+		return ""
+	}
+	for p.i < len(p.s) && p.s[p.i] == '=' {
+		p.i++
+	}
+	end := p.i
+	p.skip(" \t")
+	if p.i < len(p.s) && p.s[p.i] != ',' {
+		// The start of an auth-param.
+		p.i = start
+		return ""
+	}
+
+	return p.s[start:end]
+}
+
+func (p *authParser) value() string {
+	if !p.consume('"') {
+		return p.token()
+	}
+	var b strings.Builder
+	for p.i < len(p.s) {
+		c := p.s[p.i]
+		p.i++
+		switch c {
+		case '"':
+			return b.String()
+		case '\\':
+			if p.i < len(p.s) {
+				b.WriteByte(p.s[p.i])
+				p.i++
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+func isTokenChar(b byte) bool {
+	return b < 0x7f && b > ' ' && !strings.ContainsRune(`"(),/:;<=>?@[\]{}`, rune(b))
+}
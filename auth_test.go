@@ -0,0 +1,207 @@
+// Copyright 2023 Wayback Archiver. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package proxier // import "github.com/wabarc/proxier"
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+
+	utls "github.com/refraction-networking/utls"
+)
+
+// digestCheck returns a proxyCheck for the Digest credentials of user, with
+// algorithm and the auth quality of protection. It offers Basic too.
+func digestCheck(user *url.Userinfo, algorithm string) proxyCheck {
+	const realm, nonce, opaque = "test", "dcd98b7102dd2f0e8b11d0f600bfb0c093", "5ccc069c403ebaf9f0171e9517f40e41"
+	newHash := md5.New
+	if algorithm == "SHA-256" {
+		newHash = sha256.New
+	}
+	h := func(s ...string) string {
+		d := newHash()
+		io.WriteString(d, strings.Join(s, ":"))
+		return hex.EncodeToString(d.Sum(nil))
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) bool {
+		challenges := parseChallenges(r.Header.Values("Proxy-Authorization"))
+		if len(challenges) == 1 && challenges[0].Scheme == "Digest" {
+			p := challenges[0].Params
+			password, _ := user.Password()
+			uri := r.RequestURI
+			ha1 := h(user.Username(), realm, password)
+			ha2 := h(r.Method, uri)
+			if p["username"] == user.Username() && p["uri"] == uri && p["opaque"] == opaque && p["qop"] == "auth" &&
+				p["response"] == h(ha1, nonce, p["nc"], p["cnonce"], "auth", ha2) {
+				return true
+			}
+		}
+		w.Header().Add("Proxy-Authenticate", `Basic realm="test"`)
+		w.Header().Add("Proxy-Authenticate", `Digest realm="`+realm+`", qop="auth,auth-int", algorithm=`+algorithm+`, nonce="`+nonce+`", opaque="`+opaque+`"`)
+		w.WriteHeader(http.StatusProxyAuthRequired)
+		return false
+	}
+}
+
+// bearerCheck returns a proxyCheck for a Bearer token.
+func bearerCheck(token string) proxyCheck {
+	return func(w http.ResponseWriter, r *http.Request) bool {
+		if r.Header.Get("Proxy-Authorization") == "Bearer "+token {
+			return true
+		}
+		w.Header().Set("Proxy-Authenticate", `Bearer realm="test"`)
+		w.WriteHeader(http.StatusProxyAuthRequired)
+		return false
+	}
+}
+
+// Test that 407 challenges of HTTP proxies are answered, for both HTTPS and
+// HTTP requests.
+func TestProxyAuthChallenge(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	defer server.Close()
+	httpServer := httptest.NewServer(server.Config.Handler)
+	defer httpServer.Close()
+
+	user := url.UserPassword(testUsername, testPassword)
+	for _, test := range []struct {
+		name  string
+		check proxyCheck
+		opts  []UTLSOption
+	}{
+		{"digest md5", digestCheck(user, "MD5"), nil},
+		{"digest sha-256", digestCheck(user, "SHA-256"), nil},
+		{"bearer", bearerCheck("token"), []UTLSOption{ProxyAuth(BearerAuth("token"))}},
+	} {
+		log := make(chan string, 10)
+		proxyURL := connectProxy(t, test.name, false, test.check, log)
+		proxyURL.User = user
+		opts := append(test.opts, Config(&utls.Config{InsecureSkipVerify: true}), Proxy(proxyURL))
+		rt, err := NewUTLSRoundTripper(opts...)
+		if err != nil {
+			t.Fatalf("unexpected create utls round tripper: %v", err)
+		}
+		client := &http.Client{Transport: rt}
+
+		for _, target := range []string{server.URL, httpServer.URL, server.URL + "/again"} {
+			resp, err := client.Get(target)
+			if err != nil {
+				t.Fatalf("unexpected request to %s with %s: %v", target, test.name, err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if string(body) != "hello" {
+				t.Errorf("expected body %q from %s with %s, got %q", "hello", target, test.name, body)
+			}
+			client.CloseIdleConnections()
+		}
+	}
+}
+
+// Test that a challenge left unanswered is reported.
+func TestProxyAuthUnanswered(t *testing.T) {
+	log := make(chan string, 1)
+	proxyURL := connectProxy(t, "bearer", false, bearerCheck("token"), log)
+	proxyURL.User = url.UserPassword(testUsername, testPassword)
+	rt, err := NewUTLSRoundTripper(Proxy(proxyURL))
+	if err != nil {
+		t.Fatalf("unexpected create utls round tripper: %v", err)
+	}
+
+	_, err = rt.RoundTrip(newRequest(t, "https://example.com"))
+	if err == nil || !strings.Contains(err.Error(), "407") {
+		t.Errorf("expected 407 error, got %v", err)
+	}
+}
+
+func TestParseChallenges(t *testing.T) {
+	got := parseChallenges([]string{
+		`Newauth realm="apps", type=1, title="Login to \"apps\"", Basic realm="simple"`,
+		`Negotiate a87421000492aa874209af8bc028==, Bearer`,
+	})
+	want := []AuthChallenge{
+		{"Newauth", map[string]string{"realm": "apps", "type": "1", "title": `Login to "apps"`}},
+		{"Basic", map[string]string{"realm": "simple"}},
+		{"Negotiate", map[string]string{"": "a87421000492aa874209af8bc028=="}},
+		{"Bearer", map[string]string{}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected challenges %q, got %q", want, got)
+	}
+}
+
+// Test a Digest response against the example of RFC 7616, section 3.9.1.
+func TestDigestAuth(t *testing.T) {
+	c := &AuthChallenge{Scheme: "Digest", Params: map[string]string{
+		"realm":     "http-auth@example.org",
+		"qop":       "auth, auth-int",
+		"algorithm": "SHA-256",
+		"nonce":     "7ypf/xlj9XXwfDPEoM4URrv/xwf94BcCAzFZH4GiTo0v",
+		"opaque":    "FQhe/qaU925kfnzjCev0ciny7QMkPqMAFRtzCUYo5tdS",
+	}}
+	req := newRequest(t, "http://www.example.org/dir/index.html")
+	req.URL = &url.URL{Path: "/dir/index.html"}
+	authz, err := DigestAuth("Mufasa", "Circle of Life").Authorize(c, req)
+	if err != nil {
+		t.Fatalf("unexpected authorize: %v", err)
+	}
+
+	p := parseChallenges([]string{authz})[0].Params
+	h := func(newHash func() hash.Hash, s ...string) string {
+		d := newHash()
+		io.WriteString(d, strings.Join(s, ":"))
+		return hex.EncodeToString(d.Sum(nil))
+	}
+	ha1 := h(sha256.New, "Mufasa", c.Params["realm"], "Circle of Life")
+	ha2 := h(sha256.New, "GET", "/dir/index.html")
+	if want := h(sha256.New, ha1, c.Params["nonce"], p["nc"], p["cnonce"], "auth", ha2); p["response"] != want {
+		t.Errorf("expected response %s, got %s", want, p["response"])
+	}
+	if p["nc"] != "00000001" || p["uri"] != "/dir/index.html" || p["opaque"] != c.Params["opaque"] || p["algorithm"] != "SHA-256" {
+		t.Errorf("unexpected authorization %s", authz)
+	}
+
+	// With the cnonce of the example.
+	ha1 = h(sha256.New, "Mufasa", "http-auth@example.org", "Circle of Life")
+	if got := h(sha256.New, ha1, c.Params["nonce"], "00000001", "f2/wE4q74E6zIJEtWaHKaf5wv/H5QzzpXusqGemxURZJ", "auth", ha2); got != "753927fa0e85d155564e2e272a28d1802ca10daf4496794697cf8db5856cb6c1" {
+		t.Errorf("unexpected response of the example: %s", got)
+	}
+}
+
+// Test that the nonce count goes up with each request, and starts again with
+// a new nonce.
+func TestDigestAuthNonceCount(t *testing.T) {
+	auth := DigestAuth("Mufasa", "Circle of Life")
+	req := newRequest(t, "http://www.example.org/")
+	for _, tt := range []struct {
+		nonce, nc string
+	}{
+		{"a", "00000001"},
+		{"a", "00000002"},
+		{"b", "00000001"},
+		{"b", "00000002"},
+		{"a", "00000001"},
+	} {
+		c := &AuthChallenge{Scheme: "Digest", Params: map[string]string{"realm": "proxy", "qop": "auth", "nonce": tt.nonce}}
+		authz, err := auth.Authorize(c, req)
+		if err != nil {
+			t.Fatalf("unexpected authorize: %v", err)
+		}
+		if nc := parseChallenges([]string{authz})[0].Params["nc"]; nc != tt.nc {
+			t.Errorf("expected nc %s with nonce %s, got %s", tt.nc, tt.nonce, nc)
+		}
+	}
+}
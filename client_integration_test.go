@@ -54,3 +54,30 @@ func TestClient(t *testing.T) {
 		t.Errorf("unexpected fingerprint, got %s instead of %s", fp.JA3, ja3)
 	}
 }
+
+func TestClientHTTP2Fingerprint(t *testing.T) {
+	proxier := NewClient(nil)
+	proxier.Client.Transport, _ = NewUTLSRoundTripper(Profile("chrome"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		t.Fatalf("unexpected new request: %v", err)
+	}
+
+	resp, err := proxier.Do(req)
+	if err != nil {
+		t.Fatalf("unexpected request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var fp Fingerprint
+	if err := json.NewDecoder(resp.Body).Decode(&fp); err != nil {
+		t.Fatalf("unexpected unmarshal json: %v", err)
+	}
+	if want := chrome106.HTTP2.String(); fp.Akamai != want {
+		t.Errorf("unexpected http2 fingerprint, got %s instead of %s", fp.Akamai, want)
+	}
+}
@@ -0,0 +1,69 @@
+// Copyright 2023 Wayback Archiver. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package proxier // import "github.com/wabarc/proxier"
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+// decompress replaces the body of resp with its decoded content if it is
+// encoded with one of the codings browsers accept.
+func decompress(resp *http.Response) {
+	var newReader func(io.Reader) (io.Reader, error)
+	switch strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding"))) {
+	case "gzip":
+		newReader = func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) }
+	case "deflate":
+		// The "deflate" coding is the zlib format, see RFC 9110.
+		newReader = func(r io.Reader) (io.Reader, error) { return zlib.NewReader(r) }
+	case "br":
+		newReader = func(r io.Reader) (io.Reader, error) { return brotli.NewReader(r), nil }
+	default:
+		return
+	}
+
+	resp.Body = &decodingReader{body: resp.Body, newReader: newReader}
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	resp.Uncompressed = true
+}
+
+// decodingReader decodes a response body on the first call to Read, so that
+// empty bodies, such as those of HEAD requests, are not an error.
+type decodingReader struct {
+	body      io.ReadCloser
+	newReader func(io.Reader) (io.Reader, error)
+
+	r   io.Reader
+	err error
+}
+
+func (d *decodingReader) Read(p []byte) (int, error) {
+	if d.err != nil {
+		return 0, d.err
+	}
+	if d.r == nil {
+		d.r, d.err = d.newReader(d.body)
+		if d.err != nil {
+			return 0, d.err
+		}
+	}
+
+	return d.r.Read(p)
+}
+
+func (d *decodingReader) Close() error {
+	if c, ok := d.r.(io.Closer); ok {
+		c.Close()
+	}
+	return d.body.Close()
+}
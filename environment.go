@@ -0,0 +1,140 @@
+// Copyright 2023 Wayback Archiver. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package proxier // import "github.com/wabarc/proxier"
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+
+	"golang.org/x/net/http/httpproxy"
+)
+
+// envProxyFunc returns a function that chooses the proxy of a request from
+// the environment, as read now.
+func envProxyFunc() func(*http.Request) ([]*url.URL, error) {
+	cfg := httpproxy.FromEnvironment()
+	if all := getEnvAny("ALL_PROXY", "all_proxy"); all != "" {
+		if cfg.HTTPProxy == "" {
+			cfg.HTTPProxy = all
+		}
+		if cfg.HTTPSProxy == "" {
+			cfg.HTTPSProxy = all
+		}
+	}
+	proxyFunc := cfg.ProxyFunc()
+
+	return func(req *http.Request) ([]*url.URL, error) {
+		proxyURL, err := proxyFunc(req.URL)
+		if proxyURL == nil || err != nil {
+			return nil, err
+		}
+		return []*url.URL{proxyURL}, nil
+	}
+}
+
+func getEnvAny(names ...string) string {
+	for _, n := range names {
+		if val := os.Getenv(n); val != "" {
+			return val
+		}
+	}
+	return ""
+}
+
+// proxyRoutes sends each request through the proxy chosen for it, with a
+// round tripper for each proxy.
+type proxyRoutes struct {
+	// Options of the round trippers, but for their proxy.
+	opts UTLS
+	// Returns the proxies to try for a request, in order, nil standing
+	// for a direct connection. None means a direct connection too.
+	proxyFunc func(*http.Request) ([]*url.URL, error)
+	// Round tripper of requests that use no proxy.
+	direct *UTLSRoundTripper
+
+	mu sync.Mutex
+	// Round trippers, keyed by proxy URL.
+	rts map[string]*UTLSRoundTripper
+}
+
+// roundTrip sends req through the first of its proxies that can be used.
+func (r *proxyRoutes) roundTrip(req *http.Request) (*http.Response, error) {
+	proxies, err := r.proxyFunc(req)
+	if err != nil {
+		return nil, err
+	}
+	if len(proxies) == 0 {
+		return r.direct.roundTrip(req)
+	}
+
+	for i, proxyURL := range proxies {
+		var rt *UTLSRoundTripper
+		if rt, err = r.roundTripper(proxyURL); err == nil {
+			var resp *http.Response
+			if resp, err = rt.roundTrip(req); err == nil {
+				return resp, nil
+			}
+		}
+
+		// Fail over to the next proxy if this one could not be used,
+		// unless it could not reach the target, which the next one
+		// would not either.
+		var dialErr *ProxyDialError
+		if i == len(proxies)-1 || req.Context().Err() != nil || rt != nil && !errors.As(err, &dialErr) ||
+			errors.Is(err, ErrTargetUnreachable) {
+			break
+		}
+		retry, ok := rewindable(req)
+		if !ok {
+			break
+		}
+		req = retry
+	}
+
+	return nil, err
+}
+
+// roundTripper returns the round tripper of proxyURL, or of direct
+// connections if nil.
+func (r *proxyRoutes) roundTripper(proxyURL *url.URL) (*UTLSRoundTripper, error) {
+	if proxyURL == nil {
+		return r.direct, nil
+	}
+
+	key := proxyURL.String()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if rt, ok := r.rts[key]; ok {
+		return rt, nil
+	}
+	opts := r.opts
+	opts.proxy = proxyURL
+	rt, err := newUTLSRoundTripper(opts)
+	if err != nil {
+		return nil, err
+	}
+	if r.rts == nil {
+		r.rts = make(map[string]*UTLSRoundTripper)
+	}
+	r.rts[key] = rt
+
+	return rt, nil
+}
+
+func (r *proxyRoutes) closeIdleConnections() {
+	r.mu.Lock()
+	rts := make([]*UTLSRoundTripper, 0, len(r.rts))
+	for _, rt := range r.rts {
+		rts = append(rts, rt)
+	}
+	r.mu.Unlock()
+
+	for _, rt := range rts {
+		rt.CloseIdleConnections()
+	}
+}
@@ -0,0 +1,98 @@
+// Copyright 2023 Wayback Archiver. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package proxier // import "github.com/wabarc/proxier"
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	utls "github.com/refraction-networking/utls"
+)
+
+func TestEnvProxyFunc(t *testing.T) {
+	t.Setenv("HTTP_PROXY", "")
+	t.Setenv("http_proxy", "")
+	t.Setenv("HTTPS_PROXY", "https://secure.proxy:8443")
+	t.Setenv("ALL_PROXY", "socks5h://socks.proxy:1080")
+	t.Setenv("NO_PROXY", "internal.example,.corp.example,10.0.0.0/8,192.0.2.1:8080")
+	t.Setenv("REQUEST_METHOD", "")
+
+	proxyFunc := envProxyFunc()
+	for _, test := range []struct {
+		url, proxy string
+	}{
+		{"https://example.com", "https://secure.proxy:8443"},
+		{"http://example.com", "socks5h://socks.proxy:1080"},
+		{"http://internal.example", ""},
+		{"https://api.internal.example", ""},
+		{"https://corp.example", "https://secure.proxy:8443"},
+		{"https://www.corp.example", ""},
+		{"http://10.1.2.3", ""},
+		{"http://192.0.2.1:8080", ""},
+		{"http://192.0.2.1", "socks5h://socks.proxy:1080"},
+		{"http://localhost", ""},
+		{"http://127.0.0.1:8080", ""},
+	} {
+		proxies, err := proxyFunc(newRequest(t, test.url))
+		if err != nil {
+			t.Fatalf("unexpected proxy of %s: %v", test.url, err)
+		}
+		var got string
+		if len(proxies) > 0 {
+			got = proxies[0].String()
+		}
+		if got != test.proxy {
+			t.Errorf("expected proxy %q for %s, got %q", test.proxy, test.url, got)
+		}
+	}
+}
+
+// Test that HTTP and HTTPS requests go through the proxy of the environment.
+func TestProxyFromEnvironment(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	defer server.Close()
+	httpServer := httptest.NewServer(server.Config.Handler)
+	defer httpServer.Close()
+
+	addrs := make(chan string, 10)
+	for _, name := range []string{"HTTP_PROXY", "http_proxy", "HTTPS_PROXY", "https_proxy", "NO_PROXY", "no_proxy", "REQUEST_METHOD"} {
+		t.Setenv(name, "")
+	}
+	t.Setenv("ALL_PROXY", "socks5h://"+socks5Server(t, addrs))
+
+	rt, err := NewUTLSRoundTripper(
+		Config(&utls.Config{InsecureSkipVerify: true}),
+		ProxyFromEnvironment(),
+	)
+	if err != nil {
+		t.Fatalf("unexpected create utls round tripper: %v", err)
+	}
+	client := &http.Client{Transport: rt}
+
+	for _, target := range []*httptest.Server{server, httpServer} {
+		_, port, _ := net.SplitHostPort(target.Listener.Addr().String())
+		scheme := "http"
+		if target.TLS != nil {
+			scheme = "https"
+		}
+		resp, err := client.Get(scheme + "://" + testHost + ":" + port)
+		if err != nil {
+			t.Fatalf("unexpected %s request: %v", scheme, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != "hello" {
+			t.Errorf("expected body %q, got %q", "hello", body)
+		}
+		if got := <-addrs; got != testHost+":"+port {
+			t.Errorf("expected proxy to be sent %s, got %s", testHost+":"+port, got)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+// Copyright 2023 Wayback Archiver. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package proxier // import "github.com/wabarc/proxier"
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+)
+
+// ErrProxyAuthRequired matches, with errors.Is, the errors of proxies that
+// still want authentication after the challenges were answered, or that could
+// not be answered.
+var ErrProxyAuthRequired = errors.New("proxy authentication required")
+
+// ErrTargetUnreachable matches, with errors.Is, the errors of proxies that
+// report they cannot reach the target, so that trying another proxy would not
+// help: a ConnectError, SOCKS4Error or SOCKS5Error.
+var ErrTargetUnreachable = errors.New("proxy cannot reach the target")
+
+// A ProxyDialError is returned when a connection cannot be made through a
+// proxy of the chain, because the proxy cannot be reached, or it fails or
+// rejects the request. A connection through the proxy to a host that is
+// down fails this way too, with an error matching ErrTargetUnreachable if the
+// proxy says so. So is a proxy that cannot reach the next proxy of the chain,
+// reported by the proxy before it.
+type ProxyDialError struct {
+	// Hop is the position of the proxy in the chain, from 1.
+	Hop int
+	// Proxy is the URL of the proxy.
+	Proxy *url.URL
+	Err   error
+}
+
+func (e *ProxyDialError) Error() string {
+	return fmt.Sprintf("proxy hop %d (%s): %v", e.Hop, e.Proxy.Redacted(), e.Err)
+}
+
+func (e *ProxyDialError) Unwrap() error { return e.Err }
+
+// A ConnectError is returned when an HTTP or HTTPS proxy answers a CONNECT
+// request with a status other than 200. It matches ErrProxyAuthRequired if
+// the status is 407, and ErrTargetUnreachable if it is 502 or 504.
+type ConnectError struct {
+	StatusCode int
+	Status     string
+	Header     http.Header
+	// Body holds the start of the response body.
+	Body []byte
+}
+
+func (e *ConnectError) Error() string {
+	return fmt.Sprintf("proxy server returned %q", e.Status)
+}
+
+func (e *ConnectError) Is(target error) bool {
+	switch target {
+	case ErrProxyAuthRequired:
+		return e.StatusCode == http.StatusProxyAuthRequired
+	case ErrTargetUnreachable:
+		return e.StatusCode == http.StatusBadGateway || e.StatusCode == http.StatusGatewayTimeout
+	}
+	return false
+}
+
+// A TLSHandshakeError is returned when the TLS handshake with a server or an
+// HTTPS proxy fails.
+type TLSHandshakeError struct {
+	// Addr is the host:port address of the server.
+	Addr string
+	// RemoteAlert is whether the server sent a TLS alert, which Err
+	// describes.
+	RemoteAlert bool
+	Err         error
+}
+
+func (e *TLSHandshakeError) Error() string {
+	return fmt.Sprintf("tls handshake with %s failed: %v", e.Addr, e.Err)
+}
+
+func (e *TLSHandshakeError) Unwrap() error { return e.Err }
+
+// newTLSHandshakeError returns a TLSHandshakeError for err.
+func newTLSHandshakeError(addr string, err error) *TLSHandshakeError {
+	// uTLS reports the alerts of the server as the errors of a
+	// net.OpError.
+	var opErr *net.OpError
+	remote := errors.As(err, &opErr) && opErr.Op == "remote error"
+
+	return &TLSHandshakeError{Addr: addr, RemoteAlert: remote, Err: err}
+}
+
+// An ALPNMismatchError is returned when a connection to a server negotiates
+// another ALPN protocol than the earlier connections to it did. The request
+// is retried once on a new transport.
+type ALPNMismatchError struct {
+	Addr      string
+	Want, Got string
+}
+
+func (e *ALPNMismatchError) Error() string {
+	return fmt.Sprintf("unexpected switch from ALPN %q to %q", e.Want, e.Got)
+}
+
+// An UnsupportedSchemeError is returned for a request URL, or a proxy URL,
+// whose scheme is not supported.
+type UnsupportedSchemeError struct {
+	Scheme string
+}
+
+func (e *UnsupportedSchemeError) Error() string {
+	return fmt.Sprintf("unsupported URL scheme %q", e.Scheme)
+}
@@ -0,0 +1,175 @@
+// Copyright 2023 Wayback Archiver. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package proxier // import "github.com/wabarc/proxier"
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	utls "github.com/refraction-networking/utls"
+)
+
+// Test that a rejected CONNECT request is reported with the hop of the proxy,
+// its status and its body.
+func TestConnectError(t *testing.T) {
+	log := make(chan string, 10)
+	first := connectProxy(t, "first", false, nil, log)
+	second := connectProxy(t, "second", false, func(w http.ResponseWriter, r *http.Request) bool {
+		w.Header().Set("Proxy-Authenticate", `Basic realm="test"`)
+		w.WriteHeader(http.StatusProxyAuthRequired)
+		w.Write([]byte("denied"))
+		return false
+	}, log)
+
+	rt, err := NewUTLSRoundTripper(Proxy([]*url.URL{first, second}))
+	if err != nil {
+		t.Fatalf("unexpected create utls round tripper: %v", err)
+	}
+	_, err = rt.RoundTrip(newRequest(t, "https://example.com"))
+
+	var dialErr *ProxyDialError
+	if !errors.As(err, &dialErr) || dialErr.Hop != 2 || dialErr.Proxy.Host != second.Host {
+		t.Fatalf("expected dial error on proxy hop 2, got %v", err)
+	}
+	var connectErr *ConnectError
+	if !errors.As(err, &connectErr) {
+		t.Fatalf("expected connect error, got %v", err)
+	}
+	if connectErr.StatusCode != http.StatusProxyAuthRequired || string(connectErr.Body) != "denied" ||
+		connectErr.Header.Get("Proxy-Authenticate") == "" {
+		t.Errorf("unexpected connect error: %+v", connectErr)
+	}
+	if !errors.Is(err, ErrProxyAuthRequired) || errors.Is(err, ErrTargetUnreachable) {
+		t.Errorf("expected error to match ErrProxyAuthRequired only, got %v", err)
+	}
+
+	// A proxy that cannot reach the target says so.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected listen: %v", err)
+	}
+	ln.Close()
+	rt, err = NewUTLSRoundTripper(Proxy([]*url.URL{first}))
+	if err != nil {
+		t.Fatalf("unexpected create utls round tripper: %v", err)
+	}
+	_, err = rt.RoundTrip(newRequest(t, "https://"+ln.Addr().String()))
+	if !errors.As(err, &dialErr) || dialErr.Hop != 1 || !errors.Is(err, ErrTargetUnreachable) {
+		t.Errorf("expected unreachable target on proxy hop 1, got %v", err)
+	}
+}
+
+// Test that the SOCKS replies of proxies that cannot reach the target match
+// ErrTargetUnreachable.
+func TestSOCKSErrorTargetUnreachable(t *testing.T) {
+	for _, test := range []struct {
+		err         error
+		unreachable bool
+	}{
+		{SOCKS4Rejected, true},
+		{SOCKS4NoIdentd, false},
+		{SOCKS4IdentdMismatch, false},
+		{SOCKS5GeneralFailure, false},
+		{SOCKS5NotAllowed, false},
+		{SOCKS5NetworkUnreachable, true},
+		{SOCKS5HostUnreachable, true},
+		{SOCKS5ConnectionRefused, true},
+		{SOCKS5TTLExpired, true},
+		{SOCKS5CommandNotSupported, false},
+		{SOCKS5AddressTypeNotSupported, false},
+	} {
+		if errors.Is(test.err, ErrTargetUnreachable) != test.unreachable {
+			t.Errorf("expected %q to match ErrTargetUnreachable %t", test.err, test.unreachable)
+		}
+	}
+
+	// x/net/proxy words the reply codes of SOCKS5 proxies.
+	err := socks5Error(&net.OpError{Op: "socks connect", Err: errors.New("unknown error host unreachable")})
+	if !errors.Is(err, SOCKS5HostUnreachable) {
+		t.Errorf("expected host unreachable, got %v", err)
+	}
+}
+
+// Test that a proxy of a chain that cannot be reached is reported with its
+// hop, or by the proxy before it.
+func TestProxyDialErrorHop(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected listen: %v", err)
+	}
+	down := &url.URL{Scheme: "http", Host: ln.Addr().String()}
+	ln.Close()
+
+	log := make(chan string, 10)
+	first := connectProxy(t, "first", false, nil, log)
+	for _, test := range []struct {
+		hops  []*url.URL
+		hop   int
+		proxy *url.URL
+	}{
+		{[]*url.URL{down, first}, 1, down},
+		{[]*url.URL{first, down}, 1, first},
+	} {
+		rt, err := NewUTLSRoundTripper(Proxy(test.hops))
+		if err != nil {
+			t.Fatalf("unexpected create utls round tripper: %v", err)
+		}
+		for _, target := range []string{"https://example.com", "http://example.com"} {
+			_, err = rt.RoundTrip(newRequest(t, target))
+			var dialErr *ProxyDialError
+			if !errors.As(err, &dialErr) || dialErr.Hop != test.hop || dialErr.Proxy.Host != test.proxy.Host {
+				t.Errorf("expected dial error on proxy hop %d for %s, got %v", test.hop, target, err)
+			}
+		}
+	}
+}
+
+// Test that a TLS alert of the server is reported.
+func TestTLSHandshakeError(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.NotFoundHandler())
+	server.TLS = &tls.Config{MinVersion: tls.VersionTLS13}
+	server.StartTLS()
+	defer server.Close()
+
+	rt, err := NewUTLSRoundTripper(
+		ClientHello(&utls.HelloGolang),
+		Config(&utls.Config{InsecureSkipVerify: true, MaxVersion: utls.VersionTLS12}),
+	)
+	if err != nil {
+		t.Fatalf("unexpected create utls round tripper: %v", err)
+	}
+	_, err = rt.RoundTrip(newRequest(t, server.URL))
+
+	var tlsErr *TLSHandshakeError
+	if !errors.As(err, &tlsErr) {
+		t.Fatalf("expected tls handshake error, got %v", err)
+	}
+	if !tlsErr.RemoteAlert || !strings.Contains(tlsErr.Error(), "protocol version") || tlsErr.Addr != server.Listener.Addr().String() {
+		t.Errorf("unexpected tls handshake error: %+v", tlsErr)
+	}
+}
+
+func TestUnsupportedSchemeError(t *testing.T) {
+	_, err := NewUTLSRoundTripper(Proxy("ftp://example.com:21"))
+	var schemeErr *UnsupportedSchemeError
+	if !errors.As(err, &schemeErr) || schemeErr.Scheme != "ftp" {
+		t.Errorf("expected unsupported scheme error, got %v", err)
+	}
+
+	rt, err := NewUTLSRoundTripper()
+	if err != nil {
+		t.Fatalf("unexpected create utls round tripper: %v", err)
+	}
+	_, err = rt.RoundTrip(newRequest(t, "ftp://example.com"))
+	if !errors.As(err, &schemeErr) || schemeErr.Scheme != "ftp" {
+		t.Errorf("expected unsupported scheme error, got %v", err)
+	}
+}
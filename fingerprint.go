@@ -0,0 +1,369 @@
+// Copyright 2023 Wayback Archiver. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package proxier // import "github.com/wabarc/proxier"
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	utls "github.com/refraction-networking/utls"
+	"golang.org/x/crypto/cryptobyte"
+)
+
+// A TLSFingerprint identifies a TLS ClientHello.
+type TLSFingerprint struct {
+	// JA3 is the JA3 string of the ClientHello, and JA3Hash its MD5 hash
+	// in hexadecimal.
+	JA3     string
+	JA3Hash string
+	// JA4 is the JA4 fingerprint of the ClientHello, sent over TCP.
+	JA4 string
+}
+
+// FingerprintClientHello returns the fingerprint of raw, a ClientHello
+// handshake message, or a TLS record holding one.
+func FingerprintClientHello(raw []byte) (*TLSFingerprint, error) {
+	hello, err := parseClientHello(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	return hello.fingerprint(), nil
+}
+
+// FingerprintClientHelloID returns the fingerprint of the ClientHello sent
+// for id to serverName. Randomized ClientHellos without a seed give a
+// different fingerprint on each call.
+func FingerprintClientHelloID(id utls.ClientHelloID, serverName string) (*TLSFingerprint, error) {
+	return fingerprintUConn(utls.UClient(nil, fingerprintConfig(serverName), id))
+}
+
+// FingerprintClientHelloSpec returns the fingerprint of the ClientHello sent
+// for spec to serverName. Like utls.UConn.ApplyPreset, it may modify the
+// extensions of spec, which should not be used for a connection afterwards.
+func FingerprintClientHelloSpec(spec *utls.ClientHelloSpec, serverName string) (*TLSFingerprint, error) {
+	uconn := utls.UClient(nil, fingerprintConfig(serverName), utls.HelloCustom)
+	if err := uconn.ApplyPreset(spec); err != nil {
+		return nil, err
+	}
+
+	return fingerprintUConn(uconn)
+}
+
+// Fingerprint returns the fingerprint of the ClientHello sent to addr, a
+// host:port address. With RotateClientHello, it is that of the ClientHello
+// the HelloSelector would choose, which must be a HelloPeeker, without
+// moving on.
+func (u *UTLSRoundTripper) Fingerprint(addr string) (*TLSFingerprint, error) {
+	d := u.tlsDialer
+	id := d.clientHelloID
+	if d.selector != nil && d.clientHelloSpec == nil {
+		if p, ok := d.selector.(HelloPeeker); ok {
+			id = p.PeekHello(addr)
+		} else {
+			id = nil
+		}
+		if id == nil {
+			return nil, errors.New("cannot tell the ClientHello the HelloSelector would choose")
+		}
+	}
+	uconn, err := d.uclient(nil, addr, id)
+	if err != nil {
+		return nil, err
+	}
+
+	return fingerprintUConn(uconn)
+}
+
+// fingerprintConfig returns a Config for a ClientHello sent to serverName.
+// Nothing is verified, since there is no handshake.
+func fingerprintConfig(serverName string) *utls.Config {
+	return &utls.Config{ServerName: serverName, InsecureSkipVerify: true}
+}
+
+// fingerprintUConn returns the fingerprint of the ClientHello that uconn
+// would send.
+func fingerprintUConn(uconn *utls.UConn) (*TLSFingerprint, error) {
+	if err := uconn.BuildHandshakeState(); err != nil {
+		return nil, err
+	}
+	if uconn.HandshakeState.Hello == nil || len(uconn.HandshakeState.Hello.Raw) == 0 {
+		return nil, fmt.Errorf("cannot fingerprint the ClientHello of %s", uconn.ClientHelloID.Str())
+	}
+
+	return FingerprintClientHello(uconn.HandshakeState.Hello.Raw)
+}
+
+// TLS extensions read from a ClientHello.
+const (
+	extensionServerName          uint16 = 0
+	extensionSupportedGroups     uint16 = 10
+	extensionECPointFormats      uint16 = 11
+	extensionSignatureAlgorithms uint16 = 13
+	extensionALPN                uint16 = 16
+	extensionSupportedVersions   uint16 = 43
+)
+
+// The parts of a ClientHello that make up its fingerprints, GREASE values
+// left out.
+type clientHello struct {
+	version      uint16
+	ciphers      []uint16
+	extensions   []uint16
+	groups       []uint16
+	pointFormats []uint8
+	sigAlgs      []uint16
+	versions     []uint16
+	alpn         []string
+	serverName   bool
+}
+
+var errMalformedClientHello = errors.New("malformed ClientHello")
+
+func parseClientHello(raw []byte) (*clientHello, error) {
+	s := cryptobyte.String(raw)
+	// A handshake record.
+	if len(raw) > 0 && raw[0] == 22 {
+		var record cryptobyte.String
+		if !s.Skip(3) || !s.ReadUint16LengthPrefixed(&record) {
+			return nil, errMalformedClientHello
+		}
+		s = record
+	}
+
+	var (
+		msgType uint8
+		msg     cryptobyte.String
+		hello   clientHello
+	)
+	if !s.ReadUint8(&msgType) || msgType != 1 || !s.ReadUint24LengthPrefixed(&msg) {
+		return nil, errMalformedClientHello
+	}
+	var sessionID, ciphers, compression cryptobyte.String
+	if !msg.ReadUint16(&hello.version) || !msg.Skip(32) ||
+		!msg.ReadUint8LengthPrefixed(&sessionID) ||
+		!msg.ReadUint16LengthPrefixed(&ciphers) ||
+		!msg.ReadUint8LengthPrefixed(&compression) {
+		return nil, errMalformedClientHello
+	}
+	var err error
+	if hello.ciphers, err = readUint16s(ciphers); err != nil {
+		return nil, err
+	}
+	if msg.Empty() {
+		return &hello, nil
+	}
+
+	var extensions cryptobyte.String
+	if !msg.ReadUint16LengthPrefixed(&extensions) || !msg.Empty() {
+		return nil, errMalformedClientHello
+	}
+	for !extensions.Empty() {
+		var (
+			typ  uint16
+			data cryptobyte.String
+		)
+		if !extensions.ReadUint16(&typ) || !extensions.ReadUint16LengthPrefixed(&data) {
+			return nil, errMalformedClientHello
+		}
+		if isGREASE(typ) {
+			continue
+		}
+		hello.extensions = append(hello.extensions, typ)
+
+		var list cryptobyte.String
+		switch typ {
+		case extensionServerName:
+			hello.serverName = true
+		case extensionSupportedGroups:
+			if !data.ReadUint16LengthPrefixed(&list) {
+				return nil, errMalformedClientHello
+			}
+			hello.groups, err = readUint16s(list)
+		case extensionECPointFormats:
+			if !data.ReadUint8LengthPrefixed(&list) {
+				return nil, errMalformedClientHello
+			}
+			hello.pointFormats = list
+		case extensionSignatureAlgorithms:
+			if !data.ReadUint16LengthPrefixed(&list) {
+				return nil, errMalformedClientHello
+			}
+			hello.sigAlgs, err = readUint16s(list)
+		case extensionALPN:
+			if !data.ReadUint16LengthPrefixed(&list) {
+				return nil, errMalformedClientHello
+			}
+			for !list.Empty() {
+				var proto cryptobyte.String
+				if !list.ReadUint8LengthPrefixed(&proto) {
+					return nil, errMalformedClientHello
+				}
+				hello.alpn = append(hello.alpn, string(proto))
+			}
+		case extensionSupportedVersions:
+			if !data.ReadUint8LengthPrefixed(&list) {
+				return nil, errMalformedClientHello
+			}
+			hello.versions, err = readUint16s(list)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &hello, nil
+}
+
+// readUint16s reads a list of 16-bit values, leaving out GREASE values.
+func readUint16s(s cryptobyte.String) ([]uint16, error) {
+	var vv []uint16
+	for !s.Empty() {
+		var v uint16
+		if !s.ReadUint16(&v) {
+			return nil, errMalformedClientHello
+		}
+		if !isGREASE(v) {
+			vv = append(vv, v)
+		}
+	}
+
+	return vv, nil
+}
+
+// isGREASE reports whether v is a GREASE value, as defined by RFC 8701.
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+func (h *clientHello) fingerprint() *TLSFingerprint {
+	ja3 := strings.Join([]string{
+		strconv.Itoa(int(h.version)),
+		joinUint16s(h.ciphers, "-", false),
+		joinUint16s(h.extensions, "-", false),
+		joinUint16s(h.groups, "-", false),
+		joinUint16s(bytesToUint16s(h.pointFormats), "-", false),
+	}, ",")
+	ja3Hash := md5.Sum([]byte(ja3))
+
+	return &TLSFingerprint{
+		JA3:     ja3,
+		JA3Hash: hex.EncodeToString(ja3Hash[:]),
+		JA4:     h.ja4(),
+	}
+}
+
+// ja4 returns the JA4 fingerprint of h, as specified at
+// https://github.com/FoxIO-LLC/ja4/blob/main/technical_details/JA4.md.
+func (h *clientHello) ja4() string {
+	version := h.version
+	for _, v := range h.versions {
+		version = max(version, v)
+	}
+	var a strings.Builder
+	a.WriteByte('t')
+	switch version {
+	case utls.VersionTLS13:
+		a.WriteString("13")
+	case utls.VersionTLS12:
+		a.WriteString("12")
+	case utls.VersionTLS11:
+		a.WriteString("11")
+	case utls.VersionTLS10:
+		a.WriteString("10")
+	case utls.VersionSSL30:
+		a.WriteString("s3")
+	default:
+		a.WriteString("00")
+	}
+	if h.serverName {
+		a.WriteByte('d')
+	} else {
+		a.WriteByte('i')
+	}
+	fmt.Fprintf(&a, "%02d%02d", min(len(h.ciphers), 99), min(len(h.extensions), 99))
+	a.WriteString(ja4ALPN(h.alpn))
+
+	ciphers := sortedUint16s(h.ciphers)
+	var extensions []uint16
+	for _, e := range sortedUint16s(h.extensions) {
+		if e != extensionServerName && e != extensionALPN {
+			extensions = append(extensions, e)
+		}
+	}
+	c := joinUint16s(extensions, ",", true)
+	if len(h.sigAlgs) > 0 {
+		c += "_" + joinUint16s(h.sigAlgs, ",", true)
+	}
+
+	return a.String() + "_" + ja4Hash(joinUint16s(ciphers, ",", true), len(ciphers)) +
+		"_" + ja4Hash(c, len(h.extensions))
+}
+
+// ja4ALPN returns the first and last characters of the first ALPN protocol,
+// or of its hexadecimal form if either is not alphanumeric, or "00".
+func ja4ALPN(alpn []string) string {
+	if len(alpn) == 0 || alpn[0] == "" {
+		return "00"
+	}
+	proto := alpn[0]
+	first, last := proto[0], proto[len(proto)-1]
+	if !isAlphanumeric(first) || !isAlphanumeric(last) {
+		h := hex.EncodeToString([]byte(proto))
+		first, last = h[0], h[len(h)-1]
+	}
+
+	return string([]byte{first, last})
+}
+
+func isAlphanumeric(b byte) bool {
+	return '0' <= b && b <= '9' || 'a' <= b && b <= 'z' || 'A' <= b && b <= 'Z'
+}
+
+// ja4Hash returns the first 12 hexadecimal digits of the SHA-256 hash of s,
+// or zeros if it is made of no values.
+func ja4Hash(s string, n int) string {
+	if n == 0 {
+		return "000000000000"
+	}
+	sum := sha256.Sum256([]byte(s))
+
+	return hex.EncodeToString(sum[:6])
+}
+
+func joinUint16s(vv []uint16, sep string, hexadecimal bool) string {
+	ss := make([]string, len(vv))
+	for i, v := range vv {
+		if hexadecimal {
+			ss[i] = fmt.Sprintf("%04x", v)
+		} else {
+			ss[i] = strconv.Itoa(int(v))
+		}
+	}
+
+	return strings.Join(ss, sep)
+}
+
+func sortedUint16s(vv []uint16) []uint16 {
+	vv = append([]uint16(nil), vv...)
+	sort.Slice(vv, func(i, j int) bool { return vv[i] < vv[j] })
+
+	return vv
+}
+
+func bytesToUint16s(bb []byte) []uint16 {
+	vv := make([]uint16, len(bb))
+	for i, b := range bb {
+		vv[i] = uint16(b)
+	}
+
+	return vv
+}
@@ -0,0 +1,81 @@
+// Copyright 2023 Wayback Archiver. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package proxier // import "github.com/wabarc/proxier"
+
+import (
+	"testing"
+
+	utls "github.com/refraction-networking/utls"
+)
+
+const (
+	chrome102JA3     = "771,4865-4866-4867-49195-49199-49196-49200-52393-52392-49171-49172-156-157-47-53,0-23-65281-10-11-35-16-5-13-18-51-45-43-27-17513-21,29-23-24,0"
+	chrome102JA3Hash = "cd08e31494f9531f560d64c695473da9"
+	chrome102JA4     = "t13d1516h2_8daaf6152771_e5627efa2ab1"
+)
+
+func TestFingerprintClientHelloID(t *testing.T) {
+	fp, err := FingerprintClientHelloID(utls.HelloChrome_102, "tls.peet.ws")
+	if err != nil {
+		t.Fatalf("unexpected fingerprint: %v", err)
+	}
+	if fp.JA3 != chrome102JA3 || fp.JA3Hash != chrome102JA3Hash || fp.JA4 != chrome102JA4 {
+		t.Errorf("unexpected fingerprint %+v", fp)
+	}
+
+	// Without a server name, no SNI is sent.
+	fp, err = FingerprintClientHelloID(utls.HelloChrome_102, "")
+	if err != nil {
+		t.Fatalf("unexpected fingerprint: %v", err)
+	}
+	if fp.JA4[:4] != "t13i" {
+		t.Errorf("expected JA4 of a ClientHello without SNI, got %s", fp.JA4)
+	}
+}
+
+func TestFingerprintClientHelloSpec(t *testing.T) {
+	spec, err := utls.UTLSIdToSpec(utls.HelloChrome_102)
+	if err != nil {
+		t.Fatalf("unexpected spec: %v", err)
+	}
+	fp, err := FingerprintClientHelloSpec(&spec, "tls.peet.ws")
+	if err != nil {
+		t.Fatalf("unexpected fingerprint: %v", err)
+	}
+	if fp.JA3 != chrome102JA3 || fp.JA4 != chrome102JA4 {
+		t.Errorf("unexpected fingerprint %+v", fp)
+	}
+}
+
+// Test that the fingerprint reported by a UTLSRoundTripper is that of the
+// ClientHello it sends.
+func TestUTLSRoundTripperFingerprint(t *testing.T) {
+	for _, id := range []*utls.ClientHelloID{&utls.HelloChrome_102, &utls.HelloFirefox_105, &utls.HelloIOS_14} {
+		rt, err := NewUTLSRoundTripper(ClientHello(id))
+		if err != nil {
+			t.Fatalf("unexpected create utls round tripper: %v", err)
+		}
+		want, err := rt.(*UTLSRoundTripper).Fingerprint("localhost:443")
+		if err != nil {
+			t.Fatalf("unexpected fingerprint: %v", err)
+		}
+
+		buf, err := clientHelloResultingFromRoundTrip(t, "localhost", rt.(*UTLSRoundTripper))
+		if err != nil {
+			t.Fatalf("unexpected round trip: %v", err)
+		}
+		got, err := FingerprintClientHello(buf)
+		if err != nil {
+			t.Fatalf("unexpected fingerprint of %+q: %v", buf, err)
+		}
+		if *got != *want {
+			t.Errorf("expected fingerprint %+v with %s, got %+v", want, id.Str(), got)
+		}
+	}
+
+	if _, err := FingerprintClientHello([]byte("\x16\x03\x01\x00\x05\x01\x00\x00\x01\x03")); err == nil {
+		t.Error("expected error fingerprinting a truncated ClientHello")
+	}
+}
@@ -1,19 +1,31 @@
 module github.com/wabarc/proxier
 
-go 1.20
+go 1.24
 
 require (
+	github.com/andybalholm/brotli v1.0.5
+	github.com/dop251/goja v0.0.0-20260106131823-651366fbe6e3
 	github.com/posener/h2conn v0.0.0-20180911140238-13e7df33ed15
+	github.com/quic-go/quic-go v0.48.2
 	github.com/refraction-networking/utls v1.3.2
-	golang.org/x/net v0.10.0
+	golang.org/x/crypto v0.33.0
+	golang.org/x/net v0.35.0
 )
 
 require (
-	github.com/andybalholm/brotli v1.0.5 // indirect
+	github.com/dlclark/regexp2 v1.11.4 // indirect
 	github.com/gaukas/godicttls v0.0.3 // indirect
+	github.com/go-sourcemap/sourcemap v2.1.3+incompatible // indirect
+	github.com/go-task/slim-sprig v0.0.0-20230315185526-52ccab3ef572 // indirect
+	github.com/google/pprof v0.0.0-20230207041349-798e818bf904 // indirect
 	github.com/klauspost/compress v1.16.5 // indirect
-	github.com/stretchr/testify v1.8.2 // indirect
-	golang.org/x/crypto v0.9.0 // indirect
-	golang.org/x/sys v0.8.0 // indirect
-	golang.org/x/text v0.9.0 // indirect
+	github.com/onsi/ginkgo/v2 v2.9.5 // indirect
+	github.com/quic-go/qpack v0.5.1 // indirect
+	go.uber.org/mock v0.4.0 // indirect
+	golang.org/x/exp v0.0.0-20240506185415-9bf2ced13842 // indirect
+	golang.org/x/mod v0.17.0 // indirect
+	golang.org/x/sync v0.11.0 // indirect
+	golang.org/x/sys v0.30.0 // indirect
+	golang.org/x/text v0.22.0 // indirect
+	golang.org/x/tools v0.21.1-0.20240508182429-e35e4ccd0d2d // indirect
 )
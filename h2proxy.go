@@ -0,0 +1,150 @@
+// Copyright 2023 Wayback Archiver. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package proxier // import "github.com/wabarc/proxier"
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	utls "github.com/refraction-networking/utls"
+	"golang.org/x/net/http2"
+)
+
+// https://httpwg.org/specs/rfc9113.html#CONNECT
+
+const (
+	// HTTP/2 connections to a proxy are closed after being idle this long.
+	h2IdleTimeout = 90 * time.Second
+	// A PING is sent on an HTTP/2 connection to a proxy that has been
+	// silent this long, unless ReadIdleTimeout is set, so that tunnels do
+	// not hang on a dead connection.
+	h2ReadIdleTimeout = 30 * time.Second
+)
+
+// h2Conns holds the HTTP/2 connections to an HTTPS proxy, over which CONNECT
+// requests are sent as streams.
+type h2Conns struct {
+	t *http2.Transport
+
+	mu    sync.Mutex
+	conns []*h2Conn
+}
+
+type h2Conn struct {
+	*http2.ClientConn
+	local, remote net.Addr
+}
+
+func newH2Conns(timeouts http2Timeouts) *h2Conns {
+	if timeouts.readIdleTimeout == 0 {
+		timeouts.readIdleTimeout = h2ReadIdleTimeout
+	}
+
+	return &h2Conns{t: &http2.Transport{
+		IdleConnTimeout:    h2IdleTimeout,
+		DisableCompression: true,
+		ReadIdleTimeout:    timeouts.readIdleTimeout,
+		PingTimeout:        timeouts.pingTimeout,
+		WriteByteTimeout:   timeouts.writeByteTimeout,
+	}}
+}
+
+// get returns a connection that can take another stream, or nil.
+func (p *h2Conns) get() *h2Conn {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var cc *h2Conn
+	conns := p.conns[:0]
+	for _, c := range p.conns {
+		if st := c.State(); st.Closed || st.Closing {
+			continue
+		}
+		conns = append(conns, c)
+		if cc == nil && c.CanTakeNewRequest() {
+			cc = c
+		}
+	}
+	clear(p.conns[len(conns):])
+	p.conns = conns
+
+	return cc
+}
+
+// add returns an HTTP/2 connection over conn if it negotiated HTTP/2 with the
+// proxy, or nil.
+func (p *h2Conns) add(conn net.Conn) (*h2Conn, error) {
+	c, ok := conn.(interface{ ConnectionState() utls.ConnectionState })
+	if !ok || c.ConnectionState().NegotiatedProtocol != http2.NextProtoTLS {
+		return nil, nil
+	}
+	clientConn, err := p.t.NewClientConn(conn)
+	if err != nil {
+		return nil, err
+	}
+	cc := &h2Conn{ClientConn: clientConn, local: conn.LocalAddr(), remote: conn.RemoteAddr()}
+
+	p.mu.Lock()
+	p.conns = append(p.conns, cc)
+	p.mu.Unlock()
+
+	return cc, nil
+}
+
+// connectH2 sends connectReq as a new stream of cc, and returns the stream as
+// a connection if the proxy answers 200. The body of another response is read,
+// as by readConnectBody.
+func (pr *httpProxy) connectH2(ctx, connectCtx context.Context, cc *h2Conn, connectReq *http.Request) (net.Conn, *http.Response, error) {
+	// The stream lasts as long as the tunnel, not ctx.
+	streamCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	body, w := io.Pipe()
+	req := connectReq.Clone(streamCtx)
+	req.Body = body
+
+	type result struct {
+		resp *http.Response
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		resp, err := cc.RoundTrip(req)
+		if err == nil && resp.StatusCode != http.StatusOK {
+			body := resp.Body
+			readConnectBody(resp)
+			body.Close()
+		}
+		done <- result{resp, err}
+	}()
+
+	var res result
+	select {
+	case res = <-done:
+	case <-connectCtx.Done():
+		cancel()
+		if res = <-done; res.err == nil {
+			res.resp.Body.Close()
+		}
+		res.err = connectCtx.Err()
+	}
+	if res.err != nil || res.resp.StatusCode != http.StatusOK {
+		cancel()
+		w.Close()
+		return nil, res.resp, res.err
+	}
+
+	// The response body and w are the two halves of the stream.
+	respBody := res.resp.Body
+	tunnel := newPipeTunnel(respBody, w, func() {
+		w.Close()
+		respBody.Close()
+		cancel()
+	}, cc.local, cc.remote)
+
+	return tunnel, res.resp, nil
+}
@@ -0,0 +1,150 @@
+// Copyright 2023 Wayback Archiver. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package proxier // import "github.com/wabarc/proxier"
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	utls "github.com/refraction-networking/utls"
+)
+
+// h2Proxy starts an HTTPS proxy that speaks HTTP/2 and tunnels CONNECT
+// streams, and forwards other requests. It counts the connections made to it
+// in conns.
+func h2Proxy(t *testing.T, conns *atomic.Int32) *url.URL {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			r.RequestURI = ""
+			resp, err := http.DefaultTransport.RoundTrip(r)
+			if err != nil {
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
+			defer resp.Body.Close()
+			w.WriteHeader(resp.StatusCode)
+			io.Copy(w, resp.Body)
+			return
+		}
+		if r.ProtoMajor != 2 {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		upstream, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		defer upstream.Close()
+		w.WriteHeader(http.StatusOK)
+		rc := http.NewResponseController(w)
+		rc.Flush()
+
+		go func() {
+			io.Copy(upstream, r.Body)
+			upstream.(*net.TCPConn).CloseWrite()
+		}()
+		b := make([]byte, 32<<10)
+		for {
+			n, err := upstream.Read(b)
+			if n > 0 {
+				w.Write(b[:n])
+				rc.Flush()
+			}
+			if err != nil {
+				return
+			}
+		}
+	}))
+	server.EnableHTTP2 = true
+	server.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	server.StartTLS()
+	t.Cleanup(server.Close)
+
+	proxyURL, _ := url.Parse(server.URL)
+
+	return proxyURL
+}
+
+// Test that tunnels through an HTTPS proxy that negotiates HTTP/2 are streams
+// of one connection, and that HTTP requests are sent to it over HTTP/1.1.
+func TestProxyHTTP2(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	defer server.Close()
+	httpServer := httptest.NewServer(server.Config.Handler)
+	defer httpServer.Close()
+
+	var conns atomic.Int32
+	rt, err := NewUTLSRoundTripper(
+		Config(&utls.Config{InsecureSkipVerify: true}),
+		Proxy(h2Proxy(t, &conns)),
+	)
+	if err != nil {
+		t.Fatalf("unexpected create utls round tripper: %v", err)
+	}
+	client := &http.Client{Transport: rt}
+
+	for i := 0; i < 3; i++ {
+		resp, err := client.Get(server.URL)
+		if err != nil {
+			t.Fatalf("unexpected request: %v", err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != "hello" {
+			t.Errorf("expected body %q, got %q", "hello", body)
+		}
+		// Make the next request dial another tunnel.
+		client.CloseIdleConnections()
+	}
+	if n := conns.Load(); n != 1 {
+		t.Errorf("expected 1 connection to the proxy, got %d", n)
+	}
+
+	resp, err := client.Get(httpServer.URL)
+	if err != nil {
+		t.Fatalf("unexpected request to %s: %v", httpServer.URL, err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "hello" {
+		t.Errorf("expected body %q from %s, got %q", "hello", httpServer.URL, body)
+	}
+}
+
+// Test that HTTP/2 connections to a proxy are health checked, with the
+// configured timeouts.
+func TestProxyHTTP2HealthCheck(t *testing.T) {
+	proxyURL, _ := url.Parse("https://proxy.example:443")
+	for _, tt := range []struct {
+		opts                   []UTLSOption
+		readIdle, ping, writeB time.Duration
+	}{
+		{nil, h2ReadIdleTimeout, 0, 0},
+		{[]UTLSOption{ReadIdleTimeout(time.Second), PingTimeout(2 * time.Second), WriteByteTimeout(3 * time.Second)}, time.Second, 2 * time.Second, 3 * time.Second},
+	} {
+		pd, err := httpsDialer(ProxyHop{URL: proxyURL}, nil, UTLSOptions(tt.opts...))
+		if err != nil {
+			t.Fatalf("unexpected make proxy dialer: %v", err)
+		}
+		t2 := pd.(*httpProxy).h2.t
+		if t2.ReadIdleTimeout != tt.readIdle || t2.PingTimeout != tt.ping || t2.WriteByteTimeout != tt.writeB {
+			t.Errorf("expected timeouts %v, %v and %v, got %v, %v and %v",
+				tt.readIdle, tt.ping, tt.writeB, t2.ReadIdleTimeout, t2.PingTimeout, t2.WriteByteTimeout)
+		}
+	}
+}
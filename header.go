@@ -0,0 +1,356 @@
+// Copyright 2023 Wayback Archiver. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package proxier // import "github.com/wabarc/proxier"
+
+import (
+	"bytes"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// HeaderOrderKey is a request header listing header names in the order they
+// are sent, for example:
+//
+//	req.Header[proxier.HeaderOrderKey] = []string{"Host", "user-agent", "accept"}
+//
+// Names are matched without regard to case, and are spelled as listed over
+// HTTP/1.1. Headers that are not listed follow those that are. It takes
+// precedence over the header order of the browser profile, and is not sent
+// to the server. It has no effect on HTTP/3, nor on HTTP/2 unless a profile
+// or HTTP2Fingerprint is set.
+const HeaderOrderKey = "Proxier-Header-Order"
+
+// Headers that http.Transport writes itself, or leaves out, unless they are
+// spelled in their canonical form.
+var transportHeaders = []string{"Host", "User-Agent", "Content-Length", "Transfer-Encoding", "Trailer"}
+
+// orderHeaders returns req with HeaderOrderKey set to the order and spelling
+// of its headers on the wire, or removed if there is none. The order of
+// HeaderOrderKey, or else of the profile, is amended with the spelling of
+// header names set in a non-canonical form.
+func orderHeaders(req *http.Request, profileOrder []string) *http.Request {
+	order, ok := headerOrder(req.Header)
+	if !ok {
+		order = append(order, profileOrder...)
+	}
+	for k := range req.Header {
+		if k != HeaderOrderKey && k != http.CanonicalHeaderKey(k) {
+			order = spellHeader(order, k)
+		}
+	}
+	if len(order) == 0 && !ok {
+		return req
+	}
+
+	req = req.Clone(req.Context())
+	for _, name := range transportHeaders {
+		for k, vv := range req.Header {
+			if k != name && strings.EqualFold(k, name) {
+				delete(req.Header, k)
+				req.Header[name] = append(req.Header[name], vv...)
+			}
+		}
+	}
+	if len(order) == 0 {
+		delete(req.Header, HeaderOrderKey)
+	} else {
+		req.Header[HeaderOrderKey] = []string{strings.Join(order, ",")}
+	}
+
+	return req
+}
+
+// withoutHeaderOrder returns req without HeaderOrderKey, for transports
+// that do not honour it.
+func withoutHeaderOrder(req *http.Request) *http.Request {
+	if _, ok := req.Header[HeaderOrderKey]; !ok {
+		return req
+	}
+	req = req.Clone(req.Context())
+	delete(req.Header, HeaderOrderKey)
+
+	return req
+}
+
+// headerOrder returns the names listed in the HeaderOrderKey of h, and
+// whether it is set.
+func headerOrder(h http.Header) ([]string, bool) {
+	vv, ok := h[HeaderOrderKey]
+	var order []string
+	for _, v := range vv {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				order = append(order, name)
+			}
+		}
+	}
+
+	return order, ok
+}
+
+// spellHeader replaces the entry of order matching name with name, or adds
+// name at the end if there is none.
+func spellHeader(order []string, name string) []string {
+	for i, o := range order {
+		if strings.EqualFold(o, name) {
+			order[i] = name
+			return order
+		}
+	}
+
+	return append(order, name)
+}
+
+// headerRank returns the position of name in order, matched without regard
+// to case, or len(order) if it is not listed.
+func headerRank(order []string, name string) int {
+	for i, o := range order {
+		if strings.EqualFold(o, name) {
+			return i
+		}
+	}
+
+	return len(order)
+}
+
+// States of an http1OrderConn.
+const (
+	// Reading the head of a request.
+	http1Head = iota
+	// Forwarding a body of known length.
+	http1Body
+	// Reading the size line of a chunk.
+	http1ChunkSize
+	// Forwarding the data of a chunk and its CRLF.
+	http1ChunkData
+	// Reading the trailer of a chunked body.
+	http1Trailer
+	// Forwarding everything; the connection no longer carries requests,
+	// or never did.
+	http1Tunnel
+)
+
+// Requests with a larger head are not rewritten.
+const maxRequestHeadLen = 1 << 20
+
+// An http1OrderConn rewrites the heads of the HTTP/1.1 requests written by an
+// http.Transport, ordering and spelling header lines as HeaderOrderKey says.
+// Connections that turn out to carry something else, such as a TLS or SOCKS
+// handshake, or an upgraded protocol, are left alone.
+type http1OrderConn struct {
+	net.Conn
+
+	state int
+	// Bytes not handled yet: part of a request head, chunk size line or
+	// trailer.
+	buf []byte
+	// Bytes left to forward as they are.
+	remaining int64
+	// Whether the connection becomes a tunnel after the current request.
+	upgrade bool
+
+	out bytes.Buffer
+}
+
+func newHTTP1OrderConn(conn net.Conn) *http1OrderConn {
+	return &http1OrderConn{Conn: conn}
+}
+
+func (c *http1OrderConn) Write(p []byte) (int, error) {
+	c.rewrite(p)
+	if c.out.Len() > 0 {
+		_, err := c.Conn.Write(c.out.Bytes())
+		c.out.Reset()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return len(p), nil
+}
+
+// rewrite handles the written bytes p, adding what is to be sent to c.out.
+func (c *http1OrderConn) rewrite(p []byte) {
+	for len(p) > 0 {
+		switch c.state {
+		case http1Tunnel:
+			c.out.Write(p)
+			return
+		case http1Body, http1ChunkData:
+			n := int(min(c.remaining, int64(len(p))))
+			c.out.Write(p[:n])
+			p = p[n:]
+			c.remaining -= int64(n)
+			if c.remaining == 0 {
+				c.endBody()
+			}
+		case http1Head:
+			p = c.readHead(p)
+		case http1ChunkSize, http1Trailer:
+			var line []byte
+			line, p = c.readLine(p)
+			if line == nil {
+				continue
+			}
+			c.out.Write(line)
+			line = bytes.TrimSuffix(line, []byte("\r\n"))
+			if c.state == http1Trailer {
+				if len(line) == 0 {
+					c.endRequest()
+				}
+				continue
+			}
+			size, _, _ := bytes.Cut(line, []byte(";"))
+			n, err := strconv.ParseInt(string(bytes.TrimSpace(size)), 16, 64)
+			switch {
+			case err != nil:
+				c.state = http1Tunnel
+			case n == 0:
+				c.state = http1Trailer
+			default:
+				c.state = http1ChunkData
+				// The data is followed by a CRLF.
+				c.remaining = n + 2
+			}
+		}
+	}
+}
+
+// readLine moves bytes from p to c.buf until it holds a line, which it
+// returns along with the rest of p.
+func (c *http1OrderConn) readLine(p []byte) ([]byte, []byte) {
+	i := bytes.IndexByte(p, '\n')
+	if i < 0 {
+		c.buf = append(c.buf, p...)
+		return nil, nil
+	}
+	line := append(c.buf, p[:i+1]...)
+	c.buf = nil
+
+	return line, p[i+1:]
+}
+
+// readHead moves bytes from p to c.buf until it holds a request head, which
+// it writes rewritten, and returns the rest of p.
+func (c *http1OrderConn) readHead(p []byte) []byte {
+	start := max(len(c.buf)-3, 0)
+	c.buf = append(c.buf, p...)
+
+	// A request line starts with a method token in upper case.
+	for i, b := range c.buf {
+		if b == ' ' && i > 0 {
+			break
+		}
+		if b < 'A' || b > 'Z' {
+			c.state = http1Tunnel
+			c.out.Write(c.buf)
+			c.buf = nil
+			return nil
+		}
+	}
+
+	i := bytes.Index(c.buf[start:], []byte("\r\n\r\n"))
+	if i < 0 {
+		if len(c.buf) > maxRequestHeadLen {
+			c.state = http1Tunnel
+			c.out.Write(c.buf)
+			c.buf = nil
+		}
+		return nil
+	}
+	end := start + i + 4
+	rest := c.buf[end:]
+	c.writeHead(c.buf[:end])
+	c.buf = nil
+
+	return rest
+}
+
+// writeHead writes a request head with its header lines ordered, and sets up
+// the state for its body.
+func (c *http1OrderConn) writeHead(head []byte) {
+	lines := strings.Split(strings.TrimSuffix(string(head), "\r\n\r\n"), "\r\n")
+	requestLine, lines := lines[0], lines[1:]
+
+	var (
+		order   []string
+		ordered = lines[:0]
+		length  int64
+		chunked bool
+		upgrade bool
+	)
+	for _, line := range lines {
+		name, value, _ := strings.Cut(line, ":")
+		value = strings.TrimSpace(value)
+		switch {
+		case strings.EqualFold(name, HeaderOrderKey):
+			o, _ := headerOrder(http.Header{HeaderOrderKey: {value}})
+			order = append(order, o...)
+			continue
+		case strings.EqualFold(name, "Content-Length"):
+			length, _ = strconv.ParseInt(value, 10, 64)
+		case strings.EqualFold(name, "Transfer-Encoding"):
+			chunked = strings.Contains(strings.ToLower(value), "chunked")
+		case strings.EqualFold(name, "Upgrade"):
+			upgrade = true
+		}
+		ordered = append(ordered, line)
+	}
+
+	if order != nil {
+		rank := func(line string) int {
+			name, _, _ := strings.Cut(line, ":")
+			return headerRank(order, name)
+		}
+		sort.SliceStable(ordered, func(i, j int) bool {
+			return rank(ordered[i]) < rank(ordered[j])
+		})
+	}
+
+	c.out.WriteString(requestLine)
+	c.out.WriteString("\r\n")
+	for _, line := range ordered {
+		name, value, _ := strings.Cut(line, ":")
+		if i := headerRank(order, name); i < len(order) {
+			name = order[i]
+		}
+		c.out.WriteString(name)
+		c.out.WriteByte(':')
+		c.out.WriteString(value)
+		c.out.WriteString("\r\n")
+	}
+	c.out.WriteString("\r\n")
+
+	// The connection carries another protocol after a successful
+	// upgrade or CONNECT request.
+	c.upgrade = upgrade || strings.HasPrefix(requestLine, "CONNECT ")
+	switch {
+	case chunked:
+		c.state = http1ChunkSize
+	case length > 0:
+		c.state = http1Body
+		c.remaining = length
+	default:
+		c.endRequest()
+	}
+}
+
+func (c *http1OrderConn) endBody() {
+	if c.state == http1ChunkData {
+		c.state = http1ChunkSize
+		return
+	}
+	c.endRequest()
+}
+
+func (c *http1OrderConn) endRequest() {
+	c.state = http1Head
+	if c.upgrade {
+		c.state = http1Tunnel
+	}
+}
@@ -0,0 +1,297 @@
+// Copyright 2023 Wayback Archiver. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package proxier // import "github.com/wabarc/proxier"
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/textproto"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	utls "github.com/refraction-networking/utls"
+)
+
+// http1Server starts an HTTP/1.1 server that replies to every request with
+// the names of its header lines as received, one per line, followed by its
+// body.
+func http1Server(t *testing.T, useTLS bool) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	scheme := "http"
+	if useTLS {
+		ts := httptest.NewTLSServer(nil)
+		ts.Close()
+		ln = tls.NewListener(ln, &tls.Config{
+			Certificates: ts.TLS.Certificates,
+			NextProtos:   []string{"http/1.1"},
+		})
+		scheme = "https"
+	}
+
+	serve := func(conn net.Conn) {
+		defer conn.Close()
+		tp := textproto.NewReader(bufio.NewReader(conn))
+		for {
+			if _, err := tp.ReadLine(); err != nil {
+				return
+			}
+			var (
+				names   []string
+				length  int64
+				chunked bool
+			)
+			for {
+				line, err := tp.ReadLine()
+				if err != nil {
+					return
+				}
+				if line == "" {
+					break
+				}
+				name, value, _ := strings.Cut(line, ":")
+				names = append(names, name)
+				switch strings.ToLower(name) {
+				case "content-length":
+					length, _ = strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+				case "transfer-encoding":
+					chunked = true
+				}
+			}
+
+			var body []byte
+			if chunked {
+				body, err = io.ReadAll(httputil.NewChunkedReader(tp.R))
+				if err != nil {
+					return
+				}
+				// The trailer.
+				if _, err := tp.ReadLine(); err != nil {
+					return
+				}
+			} else {
+				body = make([]byte, length)
+				if _, err := io.ReadFull(tp.R, body); err != nil {
+					return
+				}
+			}
+
+			reply := strings.Join(names, "\n") + "\n\n" + string(body)
+			fmt.Fprintf(conn, "HTTP/1.1 200 OK\r\nContent-Length: %d\r\n\r\n%s", len(reply), reply)
+		}
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serve(conn)
+		}
+	}()
+
+	return scheme + "://" + ln.Addr().String()
+}
+
+// headerNames does req with rt and returns the names of the header lines the
+// server received, and the body it received.
+func headerNames(t *testing.T, rt http.RoundTripper, req *http.Request) ([]string, string) {
+	resp, err := rt.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("unexpected request: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.ProtoMajor != 1 {
+		t.Fatalf("expected HTTP/1.1 response, got %s", resp.Proto)
+	}
+	reply, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("unexpected read body: %v", err)
+	}
+	names, body, _ := strings.Cut(string(reply), "\n\n")
+
+	return strings.Split(names, "\n"), body
+}
+
+func TestHeaderOrderHTTP1(t *testing.T) {
+	for _, useTLS := range []bool{false, true} {
+		url := http1Server(t, useTLS)
+		rt, err := NewUTLSRoundTripper(Config(&utls.Config{InsecureSkipVerify: true}))
+		if err != nil {
+			t.Fatalf("unexpected create utls round tripper: %v", err)
+		}
+
+		// Bodies of known and unknown length, to check that the
+		// requests after them are rewritten too.
+		for _, body := range []io.Reader{nil, strings.NewReader("hello"), io.MultiReader(strings.NewReader("hello"))} {
+			req, err := http.NewRequest("POST", url, body)
+			if err != nil {
+				t.Fatalf("unexpected create request: %v", err)
+			}
+			req.Header["x-lower"] = []string{"1"}
+			req.Header["X-UPPER"] = []string{"1"}
+			req.Header.Set("Accept", "*/*")
+			req.Header.Set("X-Unlisted", "1")
+			req.Header[HeaderOrderKey] = []string{"accept, X-Upper", "x-lower,user-agent,HOST"}
+
+			names, got := headerNames(t, rt, req)
+			want := []string{"accept", "X-UPPER", "x-lower", "user-agent", "HOST"}
+			if len(names) < len(want) || !reflect.DeepEqual(names[:len(want)], want) {
+				t.Errorf("expected headers to start with %q, got %q", want, names)
+			}
+			for _, name := range names {
+				if strings.EqualFold(name, HeaderOrderKey) {
+					t.Errorf("unexpected %s header sent", name)
+				}
+			}
+			if body != nil && got != "hello" {
+				t.Errorf("expected body %q, got %q", "hello", got)
+			}
+		}
+	}
+}
+
+// Test that the header order of a profile is followed, that the casing of
+// the caller's headers is kept, and that a header spelled in a
+// non-canonical form is not sent twice.
+func TestHeaderOrderProfile(t *testing.T) {
+	url := http1Server(t, true)
+	rt, err := NewUTLSRoundTripper(Profile("chrome"), Config(&utls.Config{InsecureSkipVerify: true}))
+	if err != nil {
+		t.Fatalf("unexpected create utls round tripper: %v", err)
+	}
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		t.Fatalf("unexpected create request: %v", err)
+	}
+	req.Header["accept-LANGUAGE"] = []string{"fr"}
+	req.Header["user-agent"] = []string{"test"}
+
+	names, _ := headerNames(t, rt, req)
+	var want []string
+	for _, name := range chrome106.HeaderOrder {
+		switch name {
+		case "Accept-Language":
+			name = "accept-LANGUAGE"
+		case "User-Agent":
+			name = "user-agent"
+		case "Cookie":
+			continue
+		}
+		want = append(want, name)
+	}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("expected headers %q, got %q", want, names)
+	}
+}
+
+// Test that the HeaderOrderKey orders regular header fields over HTTP/2,
+// and is not sent.
+func TestHeaderOrderHTTP2(t *testing.T) {
+	header := http.Header{
+		"X-B":          {"1"},
+		"X-A":          {"1"},
+		"Accept":       {"*/*"},
+		HeaderOrderKey: {"x-a,accept,x-b"},
+	}
+	_, fields := http2Preface(t, header, Profile("chrome"))
+
+	var names []string
+	for _, f := range fields {
+		names = append(names, f.Name)
+	}
+	want := []string{"x-a", "accept", "x-b"}
+	if len(names) < len(want) || !reflect.DeepEqual(names[:len(want)], want) {
+		t.Errorf("expected header fields to start with %q, got %q", want, names)
+	}
+	for _, name := range names {
+		if strings.EqualFold(name, HeaderOrderKey) {
+			t.Errorf("unexpected %s header field sent", name)
+		}
+	}
+}
+
+// Test that the HeaderOrderKey is not sent to the server, whether directly
+// or through a proxy, over HTTP/1.1 or HTTP/2, with or without a profile.
+func TestHeaderOrderProxies(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := r.Header[HeaderOrderKey]; ok {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	})
+	h1Server := httptest.NewTLSServer(handler)
+	defer h1Server.Close()
+	h2Server := httptest.NewUnstartedServer(handler)
+	h2Server.EnableHTTP2 = true
+	h2Server.StartTLS()
+	defer h2Server.Close()
+	httpServer := httptest.NewServer(handler)
+	defer httpServer.Close()
+
+	// Logs are not checked.
+	log := make(chan string)
+	addrs := make(chan string)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-log:
+			case <-addrs:
+			case <-done:
+				return
+			}
+		}
+	}()
+	var conns atomic.Int32
+	proxies := map[string]string{
+		"direct": "",
+		"http":   connectProxy(t, "http", false, nil, log).String(),
+		"https":  connectProxy(t, "https", true, nil, log).String(),
+		"h2":     h2Proxy(t, &conns).String(),
+		"socks5": "socks5://" + socks5Server(t, addrs),
+	}
+	for name, proxyURL := range proxies {
+		for _, profile := range []string{"", "firefox"} {
+			opts := []UTLSOption{Config(&utls.Config{InsecureSkipVerify: true})}
+			if profile != "" {
+				opts = append(opts, Profile(profile))
+			}
+			if proxyURL != "" {
+				opts = append(opts, Proxy(proxyURL))
+			}
+			rt, err := NewUTLSRoundTripper(opts...)
+			if err != nil {
+				t.Fatalf("unexpected create utls round tripper with %s: %v", name, err)
+			}
+			for _, target := range []string{h1Server.URL, h2Server.URL, httpServer.URL} {
+				req := newRequest(t, target)
+				req.Header[HeaderOrderKey] = []string{"accept,user-agent"}
+				resp, err := rt.RoundTrip(req)
+				if err != nil {
+					t.Fatalf("unexpected request to %s through %s: %v", target, name, err)
+				}
+				resp.Body.Close()
+				if resp.StatusCode != http.StatusOK {
+					t.Errorf("expected no %s header at %s through %s with profile %q", HeaderOrderKey, target, name, profile)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,737 @@
+// Copyright 2023 Wayback Archiver. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package proxier // import "github.com/wabarc/proxier"
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+)
+
+// HTTP2Settings describes the HTTP/2 fingerprint of a client: its connection
+// preface and how it sends request headers.
+type HTTP2Settings struct {
+	// Settings lists the parameters of the initial SETTINGS frame, in
+	// order. If nil, those of http2.Transport are sent. Unless they set
+	// SETTINGS_ENABLE_PUSH to 0, streams pushed by the server are refused.
+	Settings []http2.Setting
+
+	// ConnectionFlow is the increment of the WINDOW_UPDATE frame sent for
+	// the connection after the SETTINGS frame. If zero, that of
+	// http2.Transport is sent.
+	ConnectionFlow uint32
+
+	// Priorities lists PRIORITY frames sent after the connection window
+	// update.
+	Priorities []HTTP2Priority
+
+	// HeaderPriority, if set, is sent in the HEADERS frame of every
+	// request.
+	HeaderPriority *http2.PriorityParam
+
+	// PseudoHeaderOrder lists the request pseudo-headers, such as
+	// ":method" and ":path", in the order they are sent.
+	PseudoHeaderOrder []string
+}
+
+// configure makes t2, an HTTP/2 transport configured from t1, advertise and
+// honour the settings in s, so that its flow control and header decoding
+// agree with what the rewritten preface tells the server.
+func (s *HTTP2Settings) configure(t1 *http.Transport, t2 *http2.Transport) {
+	conf := &http.HTTP2Config{
+		MaxReceiveBufferPerConnection: int(s.ConnectionFlow),
+	}
+	if s.Settings != nil {
+		// Defaults of the protocol for settings that are left out.
+		conf.MaxReceiveBufferPerStream = 65535
+		t2.MaxDecoderHeaderTableSize = 4096
+	}
+	for _, setting := range s.Settings {
+		switch setting.ID {
+		case http2.SettingHeaderTableSize:
+			t2.MaxDecoderHeaderTableSize = setting.Val
+		case http2.SettingInitialWindowSize:
+			conf.MaxReceiveBufferPerStream = int(setting.Val)
+		case http2.SettingMaxFrameSize:
+			t2.MaxReadFrameSize = setting.Val
+		case http2.SettingMaxHeaderListSize:
+			t2.MaxHeaderListSize = setting.Val
+		}
+	}
+	t1.HTTP2 = conf
+}
+
+// pushEnabled reports whether s lets the server push streams, which
+// http2.Transport does not support.
+func (s *HTTP2Settings) pushEnabled() bool {
+	if s.Settings == nil {
+		return false
+	}
+	for _, setting := range s.Settings {
+		if setting.ID == http2.SettingEnablePush {
+			return setting.Val != 0
+		}
+	}
+	return true
+}
+
+// isZero reports whether s leaves the frames of http2.Transport as they are.
+func (s *HTTP2Settings) isZero() bool {
+	return s.Settings == nil && s.ConnectionFlow == 0 && len(s.Priorities) == 0 &&
+		s.HeaderPriority == nil && len(s.PseudoHeaderOrder) == 0
+}
+
+// An http2PlainTransport is an http2.Transport whose frames are not
+// rewritten, so header order is not kept.
+type http2PlainTransport struct {
+	*http2.Transport
+}
+
+func (t http2PlainTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return t.Transport.RoundTrip(withoutHeaderOrder(req))
+}
+
+// HTTP2Priority is a PRIORITY frame.
+type HTTP2Priority struct {
+	StreamID uint32
+	Param    http2.PriorityParam
+}
+
+var pseudoHeaderAbbrevs = map[string]string{
+	":method":    "m",
+	":authority": "a",
+	":scheme":    "s",
+	":path":      "p",
+}
+
+// ParseHTTP2Fingerprint parses an HTTP/2 fingerprint in the format proposed
+// by Akamai, such as "1:65536;2:0;4:6291456;6:262144|15663105|0|m,a,s,p",
+// which lists the SETTINGS parameters, the connection window update, the
+// PRIORITY frames as stream:exclusive:dependency:weight and the order of
+// the pseudo-headers. The priority of HEADERS frames is not part of it.
+func ParseHTTP2Fingerprint(fp string) (HTTP2Settings, error) {
+	var s HTTP2Settings
+
+	parts := strings.Split(fp, "|")
+	if len(parts) != 4 {
+		return s, fmt.Errorf("http2 fingerprint %q: want 4 parts, got %d", fp, len(parts))
+	}
+
+	for _, kv := range strings.Split(parts[0], ";") {
+		id, val, ok := strings.Cut(kv, ":")
+		if !ok {
+			return s, fmt.Errorf("http2 fingerprint %q: invalid setting %q", fp, kv)
+		}
+		i, err := strconv.ParseUint(id, 10, 16)
+		if err != nil {
+			return s, fmt.Errorf("http2 fingerprint %q: invalid setting %q: %w", fp, kv, err)
+		}
+		v, err := strconv.ParseUint(val, 10, 32)
+		if err != nil {
+			return s, fmt.Errorf("http2 fingerprint %q: invalid setting %q: %w", fp, kv, err)
+		}
+		s.Settings = append(s.Settings, http2.Setting{ID: http2.SettingID(i), Val: uint32(v)})
+	}
+
+	flow, err := strconv.ParseUint(parts[1], 10, 32)
+	if err != nil {
+		return s, fmt.Errorf("http2 fingerprint %q: invalid window update: %w", fp, err)
+	}
+	s.ConnectionFlow = uint32(flow)
+
+	if parts[2] != "0" {
+		for _, p := range strings.Split(parts[2], ",") {
+			var stream, exclusive, dep, weight uint64
+			fields := strings.Split(p, ":")
+			if len(fields) == 4 {
+				stream, err = strconv.ParseUint(fields[0], 10, 31)
+				if err == nil {
+					exclusive, err = strconv.ParseUint(fields[1], 10, 1)
+				}
+				if err == nil {
+					dep, err = strconv.ParseUint(fields[2], 10, 31)
+				}
+				if err == nil {
+					weight, err = strconv.ParseUint(fields[3], 10, 16)
+				}
+			}
+			if len(fields) != 4 || err != nil || weight < 1 || weight > 256 {
+				return s, fmt.Errorf("http2 fingerprint %q: invalid priority %q", fp, p)
+			}
+			s.Priorities = append(s.Priorities, HTTP2Priority{
+				StreamID: uint32(stream),
+				Param: http2.PriorityParam{
+					StreamDep: uint32(dep),
+					Exclusive: exclusive == 1,
+					Weight:    uint8(weight - 1),
+				},
+			})
+		}
+	}
+
+	for _, abbrev := range strings.Split(parts[3], ",") {
+		name := ""
+		for k, v := range pseudoHeaderAbbrevs {
+			if v == abbrev {
+				name = k
+			}
+		}
+		if name == "" {
+			return s, fmt.Errorf("http2 fingerprint %q: unknown pseudo-header %q", fp, abbrev)
+		}
+		s.PseudoHeaderOrder = append(s.PseudoHeaderOrder, name)
+	}
+
+	return s, nil
+}
+
+// String returns s in the format read by ParseHTTP2Fingerprint.
+func (s HTTP2Settings) String() string {
+	var b strings.Builder
+
+	for i, setting := range s.Settings {
+		if i > 0 {
+			b.WriteByte(';')
+		}
+		fmt.Fprintf(&b, "%d:%d", setting.ID, setting.Val)
+	}
+	fmt.Fprintf(&b, "|%d|", s.ConnectionFlow)
+	if len(s.Priorities) == 0 {
+		b.WriteByte('0')
+	}
+	for i, p := range s.Priorities {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		exclusive := 0
+		if p.Param.Exclusive {
+			exclusive = 1
+		}
+		fmt.Fprintf(&b, "%d:%d:%d:%d", p.StreamID, exclusive, p.Param.StreamDep, int(p.Param.Weight)+1)
+	}
+	b.WriteByte('|')
+	for i, name := range s.PseudoHeaderOrder {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(pseudoHeaderAbbrevs[name])
+	}
+
+	return b.String()
+}
+
+const (
+	frameHeaderLen = 9
+	// The smallest SETTINGS_MAX_FRAME_SIZE a server may announce.
+	minMaxFrameSize = 1 << 14
+)
+
+// An http2FingerprintConn rewrites the frames written by an http2.Transport,
+// so that its connection preface and HEADERS frames follow an HTTP2Settings,
+// and header fields are ordered as HeaderOrderKey says.
+//
+// Header blocks are decoded and encoded again with an HPACK encoder of our
+// own, whose dynamic table is the one the server sees. The encoder follows
+// the table size updates of the transport's encoder, which tracks the
+// server's SETTINGS_HEADER_TABLE_SIZE.
+//
+// If the settings let the server push streams, which http2.Transport would
+// take for a protocol error, PUSH_PROMISE frames are answered with
+// RST_STREAM frames, and their header blocks passed on to the transport in
+// HEADERS frames of the promised streams, which it ignores, so that its
+// HPACK decoder stays in step with the server's encoder. DATA frames of
+// pushed streams are dropped, and their length given back to the server's
+// connection window.
+type http2FingerprintConn struct {
+	net.Conn
+
+	s *HTTP2Settings
+
+	// Written bytes not handled yet: part of the client preface, or an
+	// incomplete frame.
+	buf []byte
+	// Payload bytes of the current frame left to be forwarded as they are.
+	passthrough int
+
+	prefaceDone    bool
+	settingsDone   bool
+	prioritiesDone bool
+
+	// Frames to send to the server.
+	out bytes.Buffer
+	fr  *http2.Framer
+
+	// Header block of a HEADERS frame awaiting CONTINUATION frames.
+	headers *http2.FrameHeader
+	block   []byte
+
+	dec    *hpack.Decoder
+	fields []hpack.HeaderField
+	enc    *hpack.Encoder
+	encBuf bytes.Buffer
+
+	// Guards writes to Conn, and pending.
+	wmu sync.Mutex
+	// Frames sent by the read side, waiting for the end of a frame being
+	// written.
+	pending []byte
+
+	// Whether pushed streams are refused.
+	refusePush bool
+	// Read bytes not handled yet: an incomplete frame.
+	rbuf []byte
+	rtmp []byte
+	// Frames to return, and the error to return after them.
+	in   bytes.Buffer
+	infr *http2.Framer
+	rerr error
+	// Payload bytes of the current frame read left to be returned as
+	// they are, or dropped.
+	rpassthrough int
+	rdrop        int
+	// Stream of a PUSH_PROMISE frame awaiting CONTINUATION frames, and
+	// the stream it promised.
+	pushStream, promised uint32
+}
+
+func newHTTP2FingerprintConn(conn net.Conn, s *HTTP2Settings) *http2FingerprintConn {
+	c := &http2FingerprintConn{Conn: conn, s: s}
+	c.fr = http2.NewFramer(&c.out, nil)
+	c.dec = hpack.NewDecoder(4096, func(f hpack.HeaderField) {
+		c.fields = append(c.fields, f)
+	})
+	c.enc = hpack.NewEncoder(&c.encBuf)
+	if s.pushEnabled() {
+		c.refusePush = true
+		c.rtmp = make([]byte, 32<<10)
+		c.infr = http2.NewFramer(&c.in, nil)
+	}
+
+	return c
+}
+
+func (c *http2FingerprintConn) Write(p []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	if err := c.rewrite(p); err != nil {
+		return 0, err
+	}
+	if c.frameDone() && len(c.pending) > 0 {
+		c.out.Write(c.pending)
+		c.pending = c.pending[:0]
+	}
+	if c.out.Len() > 0 {
+		_, err := c.Conn.Write(c.out.Bytes())
+		c.out.Reset()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return len(p), nil
+}
+
+// rewrite handles the written bytes p, adding what is to be sent to c.out.
+func (c *http2FingerprintConn) rewrite(p []byte) error {
+	for len(p) > 0 {
+		if c.passthrough > 0 {
+			n := min(c.passthrough, len(p))
+			c.out.Write(p[:n])
+			p = p[n:]
+			c.passthrough -= n
+			continue
+		}
+
+		if !c.prefaceDone {
+			c.buf, p = fill(c.buf, p, len(http2.ClientPreface))
+			if len(c.buf) == len(http2.ClientPreface) {
+				c.out.Write(c.buf)
+				c.buf = c.buf[:0]
+				c.prefaceDone = true
+			}
+			continue
+		}
+
+		c.buf, p = fill(c.buf, p, frameHeaderLen)
+		if len(c.buf) < frameHeaderLen {
+			continue
+		}
+		fh := parseFrameHeader(c.buf)
+		length := int(fh.Length)
+		if !c.rewritten(fh) {
+			c.out.Write(c.buf)
+			c.buf = c.buf[:0]
+			c.passthrough = length
+			continue
+		}
+
+		c.buf, p = fill(c.buf, p, frameHeaderLen+length)
+		if len(c.buf) < frameHeaderLen+length {
+			continue
+		}
+		err := c.rewriteFrame(fh, c.buf[frameHeaderLen:])
+		c.buf = c.buf[:0]
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// frameDone reports whether the bytes sent so far end with a whole frame.
+func (c *http2FingerprintConn) frameDone() bool {
+	return c.prefaceDone && c.passthrough == 0
+}
+
+// send sends frames made by the read side, after the frame being written if
+// there is one.
+func (c *http2FingerprintConn) send(frames []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	c.pending = append(c.pending, frames...)
+	if !c.frameDone() {
+		return nil
+	}
+	_, err := c.Conn.Write(c.pending)
+	c.pending = c.pending[:0]
+
+	return err
+}
+
+func (c *http2FingerprintConn) Read(p []byte) (int, error) {
+	if !c.refusePush {
+		return c.Conn.Read(p)
+	}
+
+	for c.in.Len() == 0 && c.rerr == nil {
+		n, err := c.Conn.Read(c.rtmp)
+		if ferr := c.filter(c.rtmp[:n]); ferr != nil {
+			err = ferr
+		}
+		c.rerr = err
+	}
+	if c.in.Len() == 0 {
+		err := c.rerr
+		c.rerr = nil
+		return 0, err
+	}
+
+	return c.in.Read(p)
+}
+
+// filter handles the read bytes p, adding what is to be returned to c.in.
+func (c *http2FingerprintConn) filter(p []byte) error {
+	for len(p) > 0 {
+		if c.rpassthrough > 0 {
+			n := min(c.rpassthrough, len(p))
+			c.in.Write(p[:n])
+			p = p[n:]
+			c.rpassthrough -= n
+			continue
+		}
+		if c.rdrop > 0 {
+			n := min(c.rdrop, len(p))
+			p = p[n:]
+			c.rdrop -= n
+			continue
+		}
+
+		c.rbuf, p = fill(c.rbuf, p, frameHeaderLen)
+		if len(c.rbuf) < frameHeaderLen {
+			continue
+		}
+		fh := parseFrameHeader(c.rbuf)
+		switch {
+		case fh.Type == http2.FramePushPromise:
+			c.rbuf, p = fill(c.rbuf, p, frameHeaderLen+int(fh.Length))
+			if len(c.rbuf) < frameHeaderLen+int(fh.Length) {
+				continue
+			}
+			err := c.refuse(fh, c.rbuf[frameHeaderLen:])
+			c.rbuf = c.rbuf[:0]
+			if err != nil {
+				return err
+			}
+			continue
+		case fh.Type == http2.FrameContinuation && c.promised != 0 && fh.StreamID == c.pushStream:
+			binary.BigEndian.PutUint32(c.rbuf[5:], c.promised)
+			if fh.Flags.Has(http2.FlagContinuationEndHeaders) {
+				c.pushStream, c.promised = 0, 0
+			}
+		case fh.Type == http2.FrameData && fh.StreamID != 0 && fh.StreamID%2 == 0:
+			c.rbuf = c.rbuf[:0]
+			c.rdrop = int(fh.Length)
+			if fh.Length == 0 {
+				continue
+			}
+			var b bytes.Buffer
+			http2.NewFramer(&b, nil).WriteWindowUpdate(0, fh.Length)
+			if err := c.send(b.Bytes()); err != nil {
+				return err
+			}
+			continue
+		}
+		c.in.Write(c.rbuf)
+		c.rbuf = c.rbuf[:0]
+		c.rpassthrough = int(fh.Length)
+	}
+
+	return nil
+}
+
+// refuse refuses the stream promised by a PUSH_PROMISE frame, and passes
+// its header block on.
+func (c *http2FingerprintConn) refuse(fh http2.FrameHeader, payload []byte) error {
+	if fh.Flags.Has(http2.FlagPushPromisePadded) {
+		if len(payload) < 1 || int(payload[0]) >= len(payload) {
+			return fmt.Errorf("http2: invalid padding in PUSH_PROMISE frame")
+		}
+		payload = payload[1 : len(payload)-int(payload[0])]
+	}
+	if len(payload) < 4 {
+		return fmt.Errorf("http2: invalid PUSH_PROMISE frame")
+	}
+	promised := binary.BigEndian.Uint32(payload) & (1<<31 - 1)
+
+	endHeaders := fh.Flags & http2.FlagPushPromiseEndHeaders
+	if err := c.infr.WriteRawFrame(http2.FrameHeaders, endHeaders, promised, payload[4:]); err != nil {
+		return err
+	}
+	if endHeaders == 0 {
+		c.pushStream, c.promised = fh.StreamID, promised
+	}
+
+	var b bytes.Buffer
+	http2.NewFramer(&b, nil).WriteRSTStream(promised, http2.ErrCodeRefusedStream)
+	return c.send(b.Bytes())
+}
+
+// parseFrameHeader parses the frame header at the start of b.
+func parseFrameHeader(b []byte) http2.FrameHeader {
+	return http2.FrameHeader{
+		Type:     http2.FrameType(b[3]),
+		Flags:    http2.Flags(b[4]),
+		Length:   uint32(b[0])<<16 | uint32(b[1])<<8 | uint32(b[2]),
+		StreamID: binary.BigEndian.Uint32(b[5:]) & (1<<31 - 1),
+	}
+}
+
+// fill moves bytes from p to buf until it holds n bytes, and returns buf and
+// the rest of p.
+func fill(buf, p []byte, n int) ([]byte, []byte) {
+	k := min(n-len(buf), len(p))
+
+	return append(buf, p[:k]...), p[k:]
+}
+
+// rewritten reports whether a frame must be read in full to be rewritten.
+func (c *http2FingerprintConn) rewritten(fh http2.FrameHeader) bool {
+	switch fh.Type {
+	case http2.FrameSettings:
+		return !c.settingsDone && !fh.Flags.Has(http2.FlagSettingsAck)
+	case http2.FrameWindowUpdate:
+		return !c.prioritiesDone && fh.StreamID == 0
+	case http2.FrameHeaders, http2.FrameContinuation:
+		return true
+	}
+
+	return false
+}
+
+func (c *http2FingerprintConn) rewriteFrame(fh http2.FrameHeader, payload []byte) error {
+	switch fh.Type {
+	case http2.FrameSettings:
+		c.settingsDone = true
+		if c.s.Settings == nil {
+			return c.fr.WriteRawFrame(fh.Type, fh.Flags, fh.StreamID, payload)
+		}
+		return c.fr.WriteSettings(c.s.Settings...)
+	case http2.FrameWindowUpdate:
+		c.prioritiesDone = true
+		// http2.Transport sends no less than the initial window, and
+		// will not mind a smaller one.
+		var err error
+		if c.s.ConnectionFlow == 0 {
+			err = c.fr.WriteRawFrame(fh.Type, fh.Flags, fh.StreamID, payload)
+		} else {
+			err = c.fr.WriteWindowUpdate(0, c.s.ConnectionFlow)
+		}
+		if err != nil {
+			return err
+		}
+		for _, p := range c.s.Priorities {
+			if err := c.fr.WritePriority(p.StreamID, p.Param); err != nil {
+				return err
+			}
+		}
+		return nil
+	case http2.FrameHeaders:
+		if c.headers != nil {
+			return fmt.Errorf("http2: HEADERS frame for stream %d while awaiting CONTINUATION", fh.StreamID)
+		}
+		if fh.Flags.Has(http2.FlagHeadersPadded) {
+			if len(payload) < 1 || int(payload[0]) >= len(payload) {
+				return fmt.Errorf("http2: invalid padding in HEADERS frame")
+			}
+			payload = payload[1 : len(payload)-int(payload[0])]
+		}
+		if fh.Flags.Has(http2.FlagHeadersPriority) {
+			if len(payload) < 5 {
+				return fmt.Errorf("http2: invalid priority in HEADERS frame")
+			}
+			payload = payload[5:]
+		}
+		c.headers = &fh
+		c.block = append(c.block[:0], payload...)
+	case http2.FrameContinuation:
+		if c.headers == nil || c.headers.StreamID != fh.StreamID {
+			return fmt.Errorf("http2: unexpected CONTINUATION frame for stream %d", fh.StreamID)
+		}
+		c.block = append(c.block, payload...)
+	}
+
+	if !fh.Flags.Has(http2.FlagHeadersEndHeaders) {
+		return nil
+	}
+	headers := c.headers
+	c.headers = nil
+
+	return c.writeHeaders(headers, c.block)
+}
+
+// writeHeaders decodes a complete header block, and sends it encoded again
+// in the order and with the priority of the fingerprint.
+func (c *http2FingerprintConn) writeHeaders(fh *http2.FrameHeader, block []byte) error {
+	updates, err := tableSizeUpdates(block)
+	if err != nil {
+		return err
+	}
+	for _, v := range updates {
+		c.enc.SetMaxDynamicTableSize(v)
+	}
+
+	c.fields = c.fields[:0]
+	if _, err := c.dec.Write(block); err != nil {
+		return fmt.Errorf("http2: decode headers: %w", err)
+	}
+	if err := c.dec.Close(); err != nil {
+		return fmt.Errorf("http2: decode headers: %w", err)
+	}
+
+	c.fields = c.orderFields(c.fields)
+
+	c.encBuf.Reset()
+	for _, f := range c.fields {
+		if err := c.enc.WriteField(f); err != nil {
+			return err
+		}
+	}
+	block = c.encBuf.Bytes()
+
+	var priority http2.PriorityParam
+	first := minMaxFrameSize
+	if c.s.HeaderPriority != nil {
+		priority = *c.s.HeaderPriority
+		first -= 5
+		// Streams of requests may be those of the PRIORITY frames,
+		// since http2.Transport numbers them from 1, and cannot depend
+		// on themselves.
+		if priority.StreamDep == fh.StreamID {
+			priority.StreamDep = 0
+		}
+	}
+	frag := block[:min(first, len(block))]
+	block = block[len(frag):]
+	err = c.fr.WriteHeaders(http2.HeadersFrameParam{
+		StreamID:      fh.StreamID,
+		BlockFragment: frag,
+		EndStream:     fh.Flags.Has(http2.FlagHeadersEndStream),
+		EndHeaders:    len(block) == 0,
+		Priority:      priority,
+	})
+	for err == nil && len(block) > 0 {
+		frag = block[:min(minMaxFrameSize, len(block))]
+		block = block[len(frag):]
+		err = c.fr.WriteContinuation(fh.StreamID, len(block) == 0, frag)
+	}
+
+	return err
+}
+
+// orderFields sorts the pseudo-headers in fields by PseudoHeaderOrder and
+// the regular header fields, which follow them, by the HeaderOrderKey field,
+// which it removes.
+func (c *http2FingerprintConn) orderFields(fields []hpack.HeaderField) []hpack.HeaderField {
+	var order []string
+	kept := fields[:0]
+	for _, f := range fields {
+		if strings.EqualFold(f.Name, HeaderOrderKey) {
+			o, _ := headerOrder(http.Header{HeaderOrderKey: {f.Value}})
+			order = append(order, o...)
+			continue
+		}
+		kept = append(kept, f)
+	}
+	fields = kept
+
+	pseudo := len(c.s.PseudoHeaderOrder)
+	rank := func(f hpack.HeaderField) int {
+		if !f.IsPseudo() {
+			return pseudo + 1 + headerRank(order, f.Name)
+		}
+		for i, name := range c.s.PseudoHeaderOrder {
+			if f.Name == name {
+				return i
+			}
+		}
+		return pseudo
+	}
+	sort.SliceStable(fields, func(i, j int) bool {
+		return rank(fields[i]) < rank(fields[j])
+	})
+
+	return fields
+}
+
+// tableSizeUpdates returns the dynamic table size updates at the start of an
+// HPACK header block.
+func tableSizeUpdates(block []byte) ([]uint32, error) {
+	var updates []uint32
+	for len(block) > 0 && block[0]&0xe0 == 0x20 {
+		// A 5-bit prefix integer, see RFC 7541 section 5.1.
+		v := uint64(block[0] & 0x1f)
+		block = block[1:]
+		if v == 0x1f {
+			var m uint
+			for {
+				if len(block) == 0 || m > 28 {
+					return nil, fmt.Errorf("http2: invalid table size update in header block")
+				}
+				b := block[0]
+				block = block[1:]
+				v += uint64(b&0x7f) << m
+				m += 7
+				if b&0x80 == 0 {
+					break
+				}
+			}
+		}
+		updates = append(updates, uint32(v))
+	}
+
+	return updates, nil
+}
@@ -0,0 +1,373 @@
+// Copyright 2023 Wayback Archiver. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package proxier // import "github.com/wabarc/proxier"
+
+import (
+	"bytes"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+
+	utls "github.com/refraction-networking/utls"
+)
+
+// http2Preface returns the HTTP/2 fingerprint and the request header fields
+// observed by a server receiving a request with header made with opts.
+func http2Preface(t *testing.T, header http.Header, opts ...UTLSOption) (HTTP2Settings, []hpack.HeaderField) {
+	type preface struct {
+		s      HTTP2Settings
+		fields []hpack.HeaderField
+	}
+	ch := make(chan preface, 1)
+	server := httptest.NewUnstartedServer(nil)
+	server.EnableHTTP2 = true
+	server.Config.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){
+		http2.NextProtoTLS: func(_ *http.Server, conn *tls.Conn, _ http.Handler) {
+			var (
+				s      HTTP2Settings
+				fields []hpack.HeaderField
+			)
+			defer func() { ch <- preface{s, fields} }()
+
+			if _, err := io.ReadFull(conn, make([]byte, len(http2.ClientPreface))); err != nil {
+				return
+			}
+			fr := http2.NewFramer(nil, conn)
+			fr.ReadMetaHeaders = hpack.NewDecoder(4096, nil)
+			for {
+				f, err := fr.ReadFrame()
+				if err != nil {
+					return
+				}
+				switch f := f.(type) {
+				case *http2.SettingsFrame:
+					f.ForeachSetting(func(setting http2.Setting) error {
+						s.Settings = append(s.Settings, setting)
+						return nil
+					})
+				case *http2.WindowUpdateFrame:
+					s.ConnectionFlow = f.Increment
+				case *http2.PriorityFrame:
+					s.Priorities = append(s.Priorities, HTTP2Priority{StreamID: f.StreamID, Param: f.PriorityParam})
+				case *http2.MetaHeadersFrame:
+					if f.HasPriority() {
+						s.HeaderPriority = &f.Priority
+					}
+					for _, field := range f.PseudoFields() {
+						s.PseudoHeaderOrder = append(s.PseudoHeaderOrder, field.Name)
+					}
+					fields = f.RegularFields()
+					return
+				}
+			}
+		},
+	}
+	server.StartTLS()
+	defer server.Close()
+
+	opts = append(opts, Config(&utls.Config{InsecureSkipVerify: true}))
+	rt, err := NewUTLSRoundTripper(opts...)
+	if err != nil {
+		t.Fatalf("unexpected create utls round tripper: %v", err)
+	}
+	req, err := http.NewRequest("GET", server.URL, nil)
+	if err != nil {
+		t.Fatalf("unexpected create request: %v", err)
+	}
+	for k, vv := range header {
+		req.Header[k] = vv
+	}
+	// The server hangs up after reading the request headers.
+	rt.RoundTrip(req)
+	p := <-ch
+
+	return p.s, p.fields
+}
+
+// Test that the HTTP/2 frames sent match the fingerprint of the profile.
+func TestHTTP2Fingerprint(t *testing.T) {
+	for _, name := range []string{"chrome-102", "chrome", "edge", "firefox", "safari", "ios-safari"} {
+		p, _ := LookupProfile(name)
+		got, _ := http2Preface(t, nil, Profile(name))
+		if want := p.HTTP2.String(); got.String() != want {
+			t.Errorf("expected fingerprint %s with profile %s, got %s", want, name, got)
+		}
+		if got.HeaderPriority == nil || *got.HeaderPriority != *p.HTTP2.HeaderPriority {
+			t.Errorf("expected header priority %+v with profile %s, got %+v", *p.HTTP2.HeaderPriority, name, got.HeaderPriority)
+		}
+	}
+}
+
+func TestHTTP2FingerprintOption(t *testing.T) {
+	for _, fp := range []string{
+		"1:65536;3:1000;4:6291456|15663105|3:1:0:256|m,s,a,p",
+		// A connection window update smaller than http2.Transport allows.
+		"4:32768|1000|0|m,a,s,p",
+	} {
+		s, err := ParseHTTP2Fingerprint(fp)
+		if err != nil {
+			t.Fatalf("unexpected parse fingerprint: %v", err)
+		}
+
+		got, _ := http2Preface(t, nil, Profile("firefox"), HTTP2Fingerprint(s))
+		if got.String() != fp {
+			t.Errorf("expected fingerprint %s, got %s", fp, got)
+		}
+		if got.HeaderPriority != nil {
+			t.Errorf("expected no header priority, got %+v", got.HeaderPriority)
+		}
+	}
+}
+
+// Test that rewritten requests are understood by a server, including large
+// header blocks split over CONTINUATION frames and header compression across
+// requests.
+func TestHTTP2FingerprintRequests(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("X-Method", r.Method)
+		w.Header().Set("X-Large", r.Header.Get("X-Large"))
+		w.Write(body)
+	}))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+
+	for _, name := range []string{"chrome", "firefox", "safari"} {
+		rt, err := NewUTLSRoundTripper(Profile(name), Config(&utls.Config{InsecureSkipVerify: true}))
+		if err != nil {
+			t.Fatalf("unexpected create utls round tripper: %v", err)
+		}
+		client := &http.Client{Transport: rt}
+
+		for i, size := range []int{10, 40000, 10, 20000} {
+			large := strings.Repeat("x", size)
+			req, err := http.NewRequest("POST", server.URL, strings.NewReader(large))
+			if err != nil {
+				t.Fatalf("unexpected create request: %v", err)
+			}
+			req.Header.Set("X-Large", large)
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatalf("unexpected request %d with profile %s: %v", i, name, err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if resp.ProtoMajor != 2 {
+				t.Errorf("expected HTTP/2 response, got %s", resp.Proto)
+			}
+			if resp.Header.Get("X-Method") != "POST" || resp.Header.Get("X-Large") != large || !bytes.Equal(body, []byte(large)) {
+				t.Errorf("unexpected response to request %d with profile %s", i, name)
+			}
+		}
+		client.CloseIdleConnections()
+	}
+}
+
+// Test that many requests can be made on one connection, whose streams
+// include those of the PRIORITY frames of the profile. Requests with a body
+// that cannot be sent again are not retried.
+func TestHTTP2FingerprintManyRequests(t *testing.T) {
+	var conns atomic.Int32
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(w, r.Body)
+	}))
+	server.EnableHTTP2 = true
+	server.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	server.StartTLS()
+	defer server.Close()
+
+	for _, name := range []string{"chrome", "firefox", "safari"} {
+		conns.Store(0)
+		rt, err := NewUTLSRoundTripper(Profile(name), Config(&utls.Config{InsecureSkipVerify: true}))
+		if err != nil {
+			t.Fatalf("unexpected create utls round tripper: %v", err)
+		}
+		client := &http.Client{Transport: rt}
+
+		for i := 0; i < 10; i++ {
+			req, err := http.NewRequest("POST", server.URL, io.NopCloser(strings.NewReader("hello")))
+			if err != nil {
+				t.Fatalf("unexpected create request: %v", err)
+			}
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatalf("unexpected request %d with profile %s: %v", i, name, err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if string(body) != "hello" {
+				t.Errorf("expected body %q of request %d with profile %s, got %q", "hello", i, name, body)
+			}
+		}
+		if n := conns.Load(); n != 1 {
+			t.Errorf("expected 1 connection with profile %s, got %d", name, n)
+		}
+		client.CloseIdleConnections()
+	}
+}
+
+func TestParseHTTP2Fingerprint(t *testing.T) {
+	for _, fp := range []string{
+		"1:65536;2:0;4:6291456;6:262144|15663105|0|m,a,s,p",
+		"1:65536;4:131072;5:16384|12517377|3:0:0:201,5:0:0:101,7:0:0:1,9:0:7:1,11:0:3:1,13:0:0:241|m,p,a,s",
+		"4:4194304;3:100|10485760|0|m,s,p,a",
+	} {
+		s, err := ParseHTTP2Fingerprint(fp)
+		if err != nil {
+			t.Fatalf("unexpected parse fingerprint %s: %v", fp, err)
+		}
+		if s.String() != fp {
+			t.Errorf("expected %s, got %s", fp, s)
+		}
+	}
+
+	for _, fp := range []string{
+		"",
+		"1:65536|15663105|0",
+		"1=65536|15663105|0|m,a,s,p",
+		"1:65536|-1|0|m,a,s,p",
+		"1:65536|15663105|3:0:0:257|m,a,s,p",
+		"1:65536|15663105|0|m,a,s,x",
+	} {
+		if _, err := ParseHTTP2Fingerprint(fp); err == nil {
+			t.Errorf("expected error parsing %q", fp)
+		}
+	}
+}
+
+// Test that streams pushed by the server are refused with profiles that
+// leave server push enabled, and that the connection goes on working.
+func TestHTTP2FingerprintPush(t *testing.T) {
+	pushErrs := make(chan error, 10)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/style.css" {
+			w.Write([]byte(strings.Repeat("pushed", 10000)))
+			return
+		}
+		pushErrs <- w.(http.Pusher).Push("/style.css", &http.PushOptions{
+			Header: http.Header{"X-Pushed": {strings.Repeat("x", 100)}},
+		})
+		w.Header().Set("X-Pushed", strings.Repeat("x", 100))
+		w.Write([]byte("hello"))
+	}))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+
+	for _, name := range []string{"chrome-83", "firefox", "safari", "ios-safari"} {
+		rt, err := NewUTLSRoundTripper(Profile(name), Config(&utls.Config{InsecureSkipVerify: true}))
+		if err != nil {
+			t.Fatalf("unexpected create utls round tripper: %v", err)
+		}
+		for i := 0; i < 3; i++ {
+			resp, err := rt.RoundTrip(newRequest(t, server.URL))
+			if err != nil {
+				t.Fatalf("unexpected request %d with profile %s: %v", i, name, err)
+			}
+			body, err := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if err != nil || string(body) != "hello" {
+				t.Errorf("unexpected body of request %d with profile %s: %q, %v", i, name, body, err)
+			}
+			if err := <-pushErrs; err != nil {
+				t.Errorf("unexpected push with profile %s: %v", name, err)
+			}
+		}
+	}
+}
+
+// Test that a pushed stream is refused, its header block passed on, and its
+// data given back to the connection window.
+func TestHTTP2FingerprintConnPush(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected listen: %v", err)
+	}
+	defer ln.Close()
+	sent := make(chan []http2.Frame, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		if _, err := io.ReadFull(conn, make([]byte, len(http2.ClientPreface))); err != nil {
+			return
+		}
+		fr := http2.NewFramer(conn, conn)
+		if _, err := fr.ReadFrame(); err != nil {
+			return
+		}
+
+		var block bytes.Buffer
+		enc := hpack.NewEncoder(&block)
+		enc.WriteField(hpack.HeaderField{Name: ":method", Value: "GET"})
+		enc.WriteField(hpack.HeaderField{Name: ":path", Value: "/style.css"})
+		fr.WritePushPromise(http2.PushPromiseParam{StreamID: 1, PromiseID: 2, BlockFragment: block.Bytes(), EndHeaders: true})
+		fr.WriteData(2, true, make([]byte, 100))
+		fr.WriteData(1, true, []byte("hello"))
+
+		var frames []http2.Frame
+		for len(frames) < 2 {
+			f, err := fr.ReadFrame()
+			if err != nil {
+				break
+			}
+			frames = append(frames, f)
+		}
+		sent <- frames
+	}()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("unexpected dial: %v", err)
+	}
+	p, _ := LookupProfile("firefox")
+	c := newHTTP2FingerprintConn(conn, &p.HTTP2)
+	defer c.Close()
+	c.Write([]byte(http2.ClientPreface))
+	fr := http2.NewFramer(c, c)
+	fr.WriteSettings()
+	fr.ReadMetaHeaders = hpack.NewDecoder(4096, nil)
+
+	f, err := fr.ReadFrame()
+	if err != nil {
+		t.Fatalf("unexpected read frame: %v", err)
+	}
+	if h, ok := f.(*http2.MetaHeadersFrame); !ok || h.StreamID != 2 || h.PseudoValue("path") != "/style.css" {
+		t.Errorf("expected header block of the pushed stream, got %v", f)
+	}
+	f, err = fr.ReadFrame()
+	if err != nil {
+		t.Fatalf("unexpected read frame: %v", err)
+	}
+	if d, ok := f.(*http2.DataFrame); !ok || d.StreamID != 1 || string(d.Data()) != "hello" {
+		t.Errorf("expected data of stream 1, got %v", f)
+	}
+
+	frames := <-sent
+	if len(frames) != 2 {
+		t.Fatalf("expected 2 frames sent, got %d", len(frames))
+	}
+	if f, ok := frames[0].(*http2.RSTStreamFrame); !ok || f.StreamID != 2 || f.ErrCode != http2.ErrCodeRefusedStream {
+		t.Errorf("expected pushed stream refused, got %v", frames[0])
+	}
+	if f, ok := frames[1].(*http2.WindowUpdateFrame); !ok || f.StreamID != 0 || f.Increment != 100 {
+		t.Errorf("expected connection window update of 100, got %v", frames[1])
+	}
+}
@@ -0,0 +1,264 @@
+// Copyright 2023 Wayback Archiver. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package proxier // import "github.com/wabarc/proxier"
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+
+	utls "github.com/refraction-networking/utls"
+)
+
+// HTTP3Mode controls when a UTLSRoundTripper uses HTTP/3 over QUIC. HTTP/3 is
+// opt-in, since it does not preserve the TLS fingerprint; see HTTP3.
+type HTTP3Mode int
+
+const (
+	// HTTP3Disabled never uses HTTP/3. This is the default.
+	HTTP3Disabled HTTP3Mode = iota
+	// HTTP3Auto uses HTTP/3 for servers that advertise it in an Alt-Svc
+	// response header, as browsers do.
+	HTTP3Auto
+	// HTTP3Force tries HTTP/3 first for every server.
+	HTTP3Force
+)
+
+const (
+	// Alt-Svc max age if the header does not specify one.
+	defaultAltSvcMaxAge = 24 * time.Hour
+	// How long to stick to TCP after QUIC failed for an address, e.g.
+	// because UDP is blocked.
+	http3BrokenTimeout = 5 * time.Minute
+	// How long to wait for a QUIC handshake before falling back to TCP.
+	http3HandshakeTimeout = 2 * time.Second
+)
+
+// defaultQUICConfig returns QUIC transport parameters close to those sent by
+// Chrome.
+func defaultQUICConfig() *quic.Config {
+	return &quic.Config{
+		HandshakeIdleTimeout:           10 * time.Second,
+		MaxIdleTimeout:                 30 * time.Second,
+		InitialStreamReceiveWindow:     6 << 20,
+		MaxStreamReceiveWindow:         6 << 20,
+		InitialConnectionReceiveWindow: 15 << 20,
+		MaxConnectionReceiveWindow:     15 << 20,
+		MaxIncomingStreams:             100,
+		MaxIncomingUniStreams:          103,
+		InitialPacketSize:              1250,
+	}
+}
+
+// An http3RoundTripper sends requests over HTTP/3 to servers known to support
+// it, and keeps track of which servers those are.
+type http3RoundTripper struct {
+	mode HTTP3Mode
+	rt   *http3.Transport
+
+	mu sync.Mutex
+	// Alternative HTTP/3 endpoints learned from Alt-Svc, keyed by the
+	// host:port of the origin.
+	altSvc map[string]altSvc
+	// Origins for which QUIC failed, and until when to avoid it.
+	broken map[string]time.Time
+}
+
+type altSvc struct {
+	addr    string
+	expires time.Time
+}
+
+// http3DialError wraps a failure to establish a QUIC connection, after which
+// a request can safely fall back to TCP.
+type http3DialError struct {
+	err error
+}
+
+func (e *http3DialError) Error() string { return "http3: dial failed: " + e.err.Error() }
+func (e *http3DialError) Unwrap() error { return e.err }
+
+func newHTTP3RoundTripper(mode HTTP3Mode, cfg *utls.Config, quicConfig *quic.Config) *http3RoundTripper {
+	h3 := &http3RoundTripper{
+		mode:   mode,
+		altSvc: make(map[string]altSvc),
+		broken: make(map[string]time.Time),
+	}
+	if quicConfig == nil {
+		quicConfig = defaultQUICConfig()
+	}
+	h3.rt = &http3.Transport{
+		TLSClientConfig: quicTLSConfig(cfg),
+		QUICConfig:      quicConfig,
+		Dial: func(ctx context.Context, addr string, tlsCfg *tls.Config, cfg *quic.Config) (quic.EarlyConnection, error) {
+			// Blocked UDP shows only as a handshake that never
+			// completes.
+			ctx, cancel := context.WithTimeout(ctx, http3HandshakeTimeout)
+			defer cancel()
+			conn, err := quic.DialAddrEarly(ctx, h3.endpoint(addr), tlsCfg, cfg)
+			if err != nil {
+				return nil, &http3DialError{err}
+			}
+			return conn, nil
+		},
+	}
+
+	return h3
+}
+
+// quicTLSConfig converts the uTLS settings that matter for QUIC. The TLS
+// handshake inside QUIC is done by crypto/tls, not by uTLS.
+func quicTLSConfig(cfg *utls.Config) *tls.Config {
+	if cfg == nil {
+		return nil
+	}
+	return &tls.Config{
+		ServerName:         cfg.ServerName,
+		RootCAs:            cfg.RootCAs,
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+	}
+}
+
+// usable reports whether a request to addr should be tried over HTTP/3.
+func (h3 *http3RoundTripper) usable(addr string) bool {
+	now := time.Now()
+
+	h3.mu.Lock()
+	defer h3.mu.Unlock()
+
+	if until, ok := h3.broken[addr]; ok {
+		if now.Before(until) {
+			return false
+		}
+		delete(h3.broken, addr)
+	}
+	if h3.mode == HTTP3Force {
+		return true
+	}
+	alt, ok := h3.altSvc[addr]
+	if ok && now.After(alt.expires) {
+		delete(h3.altSvc, addr)
+		return false
+	}
+
+	return ok
+}
+
+// endpoint returns the address to dial over QUIC for the origin addr.
+func (h3 *http3RoundTripper) endpoint(addr string) string {
+	h3.mu.Lock()
+	defer h3.mu.Unlock()
+
+	if alt, ok := h3.altSvc[addr]; ok {
+		return alt.addr
+	}
+	return addr
+}
+
+func (h3 *http3RoundTripper) markBroken(addr string) {
+	h3.mu.Lock()
+	h3.broken[addr] = time.Now().Add(http3BrokenTimeout)
+	h3.mu.Unlock()
+}
+
+// observe records the HTTP/3 endpoint, if any, that resp advertises for the
+// origin addr.
+func (h3 *http3RoundTripper) observe(addr string, resp *http.Response) {
+	header := resp.Header.Get("Alt-Svc")
+	if header == "" {
+		return
+	}
+
+	h3.mu.Lock()
+	defer h3.mu.Unlock()
+
+	if strings.TrimSpace(header) == "clear" {
+		delete(h3.altSvc, addr)
+		return
+	}
+	host, _, _ := net.SplitHostPort(addr)
+	if alt, ok := parseAltSvc(header, host); ok {
+		h3.altSvc[addr] = alt
+	}
+}
+
+func (h3 *http3RoundTripper) closeIdleConnections() {
+	h3.rt.CloseIdleConnections()
+}
+
+// parseAltSvc returns the first "h3" alternative in an Alt-Svc header value,
+// as defined in RFC 7838. An alternative without a host refers to host.
+func parseAltSvc(header, host string) (altSvc, bool) {
+	for _, value := range strings.Split(header, ",") {
+		params := strings.Split(value, ";")
+		protocol, authority, ok := strings.Cut(strings.TrimSpace(params[0]), "=")
+		if !ok || protocol != "h3" {
+			continue
+		}
+		authority, err := strconv.Unquote(authority)
+		if err != nil {
+			continue
+		}
+		altHost, port, err := net.SplitHostPort(authority)
+		if err != nil {
+			continue
+		}
+		if altHost == "" {
+			altHost = host
+		}
+
+		maxAge := defaultAltSvcMaxAge
+		for _, param := range params[1:] {
+			k, v, _ := strings.Cut(strings.TrimSpace(param), "=")
+			if k != "ma" {
+				continue
+			}
+			if secs, err := strconv.Atoi(v); err == nil {
+				maxAge = time.Duration(secs) * time.Second
+			}
+		}
+
+		return altSvc{
+			addr:    net.JoinHostPort(altHost, port),
+			expires: time.Now().Add(maxAge),
+		}, true
+	}
+
+	return altSvc{}, false
+}
+
+// http3RoundTrip sends req over HTTP/3 if addr is known to support it. It
+// reports false if the request should be sent over TCP instead, because
+// HTTP/3 is not known to be supported or the QUIC connection failed.
+func (u *UTLSRoundTripper) http3RoundTrip(req *http.Request, addr string) (*http.Response, bool, error) {
+	if u.h3 == nil || !u.h3.usable(addr) {
+		return nil, false, nil
+	}
+
+	// Header order is not kept over HTTP/3.
+	req = withoutHeaderOrder(req)
+	resp, err := u.h3.rt.RoundTrip(req)
+	var dialErr *http3DialError
+	if errors.As(err, &dialErr) && req.Context().Err() == nil {
+		// UDP may be blocked; remember to use TCP for a while.
+		u.h3.markBroken(addr)
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, true, err
+	}
+	u.h3.observe(addr, resp)
+
+	return resp, true, nil
+}
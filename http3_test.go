@@ -0,0 +1,160 @@
+// Copyright 2023 Wayback Archiver. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package proxier // import "github.com/wabarc/proxier"
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+
+	utls "github.com/refraction-networking/utls"
+)
+
+func protoHandler(altSvc string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if altSvc != "" {
+			w.Header().Set("Alt-Svc", altSvc)
+		}
+		w.Write([]byte(r.Proto))
+	})
+}
+
+func getProto(t *testing.T, client *http.Client, url string) string {
+	resp, err := client.Get(url)
+	if err != nil {
+		t.Fatalf("unexpected request: %v", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	return resp.Proto
+}
+
+func TestUTLSHTTP3AltSvc(t *testing.T) {
+	udpConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected listen udp: %v", err)
+	}
+	defer udpConn.Close()
+	_, port, _ := net.SplitHostPort(udpConn.LocalAddr().String())
+
+	handler := protoHandler(fmt.Sprintf(`h3=":%s"; ma=60`, port))
+	server := httptest.NewTLSServer(handler)
+	defer server.Close()
+
+	h3Server := &http3.Server{
+		Handler:   handler,
+		TLSConfig: http3.ConfigureTLSConfig(&tls.Config{Certificates: server.TLS.Certificates}),
+	}
+	go h3Server.Serve(udpConn)
+	defer h3Server.Close()
+
+	rt, err := NewUTLSRoundTripper(
+		Config(&utls.Config{InsecureSkipVerify: true}),
+		HTTP3(HTTP3Auto),
+	)
+	if err != nil {
+		t.Fatalf("unexpected create utls round tripper: %v", err)
+	}
+	client := &http.Client{Transport: rt}
+	defer client.CloseIdleConnections()
+
+	if proto := getProto(t, client, server.URL); proto == "HTTP/3.0" {
+		t.Errorf("expected first request over TCP, got %s", proto)
+	}
+	if proto := getProto(t, client, server.URL); proto != "HTTP/3.0" {
+		t.Errorf("expected upgrade to HTTP/3 after Alt-Svc, got %s", proto)
+	}
+}
+
+func TestUTLSHTTP3Fallback(t *testing.T) {
+	// Nothing listens on UDP, as if it were blocked.
+	server := httptest.NewTLSServer(protoHandler(""))
+	defer server.Close()
+
+	for _, opts := range [][]UTLSOption{
+		{QUICConfig(&quic.Config{HandshakeIdleTimeout: 200 * time.Millisecond})},
+		// The handshake is given up before the idle timeout of QUIC.
+		{},
+	} {
+		opts = append(opts, Config(&utls.Config{InsecureSkipVerify: true}), HTTP3(HTTP3Force))
+		rt, err := NewUTLSRoundTripper(opts...)
+		if err != nil {
+			t.Fatalf("unexpected create utls round tripper: %v", err)
+		}
+		client := &http.Client{Transport: rt}
+		defer client.CloseIdleConnections()
+
+		for i := 0; i < 2; i++ {
+			start := time.Now()
+			if proto := getProto(t, client, server.URL); proto == "HTTP/3.0" {
+				t.Errorf("expected fallback to TCP, got %s", proto)
+			}
+			elapsed := time.Since(start)
+			if i == 0 && elapsed > 2*http3HandshakeTimeout {
+				t.Errorf("expected fallback to TCP after the handshake timeout, took %v", elapsed)
+			}
+			if i > 0 && elapsed > 150*time.Millisecond {
+				t.Errorf("expected QUIC to be skipped after a failure, took %v", elapsed)
+			}
+		}
+	}
+}
+
+// Test that HTTP/3 cannot be combined with a chosen TLS fingerprint.
+func TestUTLSHTTP3Fingerprint(t *testing.T) {
+	for name, opt := range map[string]UTLSOption{
+		"ClientHello":       ClientHello(&utls.HelloFirefox_Auto),
+		"ClientHelloSpec":   ClientHelloSpec(func() *utls.ClientHelloSpec { return &utls.ClientHelloSpec{} }),
+		"RotateClientHello": RotateClientHello(HelloSelectorFunc(func(string) *utls.ClientHelloID { return &utls.HelloChrome_Auto })),
+		"Profile":           Profile("firefox"),
+	} {
+		if _, err := NewUTLSRoundTripper(HTTP3(HTTP3Force), opt); err == nil {
+			t.Errorf("expected error creating utls round tripper with HTTP3 and %s", name)
+		}
+	}
+
+	// Go's ClientHello is sent over TCP too.
+	for _, opts := range [][]UTLSOption{
+		{HTTP3(HTTP3Auto)},
+		{HTTP3(HTTP3Force), ClientHello(&utls.HelloGolang)},
+	} {
+		rt, err := NewUTLSRoundTripper(opts...)
+		if err != nil {
+			t.Fatalf("unexpected create utls round tripper: %v", err)
+		}
+		if id := rt.(*UTLSRoundTripper).tlsDialer.clientHelloID; *id != utls.HelloGolang {
+			t.Errorf("unexpected ClientHello, got %v want %v", id, utls.HelloGolang)
+		}
+	}
+}
+
+func TestParseAltSvc(t *testing.T) {
+	tests := []struct {
+		header string
+		addr   string
+		ok     bool
+	}{
+		{`h3=":443"; ma=86400`, "example.com:443", true},
+		{`h3-29=":443", h3="alt.example.com:8443"`, "alt.example.com:8443", true},
+		{`h2=":443"`, "", false},
+		{`h3=443`, "", false},
+	}
+
+	for _, tt := range tests {
+		alt, ok := parseAltSvc(tt.header, "example.com")
+		if ok != tt.ok || alt.addr != tt.addr {
+			t.Errorf("parseAltSvc(%q) = %q, %t; want %q, %t", tt.header, alt.addr, ok, tt.addr, tt.ok)
+		}
+	}
+}
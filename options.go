@@ -5,15 +5,67 @@
 package proxier // import "github.com/wabarc/proxier"
 
 import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"golang.org/x/net/proxy"
+
 	utls "github.com/refraction-networking/utls"
 )
 
+// Defaults for direct connections, the same as http.DefaultTransport uses.
+const (
+	defaultDialTimeout = 30 * time.Second
+	defaultKeepAlive   = 30 * time.Second
+)
+
 // UTLS represents a uTLS struct.
 type UTLS struct {
-	proxy interface{}
+	proxy     interface{}
+	proxyFunc func(*http.Request) ([]*url.URL, error)
+	pool      *ProxyPool
+	dialer    interface{}
+
+	profileName string
+	profile     *BrowserProfile
+
+	clientHello     *utls.ClientHelloID
+	clientHelloSpec func() *utls.ClientHelloSpec
+	helloSelector   HelloSelector
+	onHello         func(addr string, id utls.ClientHelloID)
+	config          *utls.Config
+
+	resolver            HostResolver
+	proxyAuthenticators []ProxyAuthenticator
+
+	proxyConnectHeader     http.Header
+	getProxyConnectHeader  func(ctx context.Context, proxyURL *url.URL, target string) (http.Header, error)
+	onProxyConnectResponse func(ctx context.Context, proxyURL *url.URL, connectReq *http.Request, connectRes *http.Response) error
+
+	dialTimeout           time.Duration
+	keepAlive             time.Duration
+	connectTimeout        time.Duration
+	tlsHandshakeTimeout   time.Duration
+	responseHeaderTimeout time.Duration
+	idleConnTimeout       time.Duration
 
-	clientHello *utls.ClientHelloID
-	config      *utls.Config
+	http2         http2Timeouts
+	http2Settings *HTTP2Settings
+
+	http3Mode  HTTP3Mode
+	quicConfig *quic.Config
+}
+
+// http2Timeouts holds the health check settings of http2.Transport.
+type http2Timeouts struct {
+	readIdleTimeout  time.Duration
+	pingTimeout      time.Duration
+	writeByteTimeout time.Duration
 }
 
 // UTLSOption is a function type that modifies a UTLS struct by setting one of its fields.
@@ -27,17 +79,243 @@ func UTLSOptions(options ...UTLSOption) UTLS {
 		o(&u)
 	}
 
+	if u.profileName != "" {
+		u.profile, _ = LookupProfile(u.profileName)
+	}
 	if u.clientHello == nil {
-		u.clientHello = defaultClientHelloID
+		u.clientHello = defaultProfile.ClientHelloID
+		if u.http3Mode != HTTP3Disabled {
+			// The QUIC handshake sends the ClientHello of crypto/tls.
+			u.clientHello = &utls.HelloGolang
+		}
+		if u.profile != nil {
+			u.clientHello = u.profile.ClientHelloID
+		}
+	}
+	if u.dialTimeout == 0 {
+		u.dialTimeout = defaultDialTimeout
+	}
+	if u.keepAlive == 0 {
+		u.keepAlive = defaultKeepAlive
 	}
 
 	return u
 }
 
-// Proxy sets the proxy field of a UTLS struct to the given proxy.
+// hostResolver returns the resolver of host names sent to socks4 and socks5
+// proxies.
+func (u UTLS) hostResolver() HostResolver {
+	if u.resolver == nil {
+		return net.DefaultResolver
+	}
+
+	return u.resolver
+}
+
+// baseDialer returns the dialer used for direct connections, either to the
+// server or to the first proxy.
+func (u UTLS) baseDialer() (proxy.Dialer, error) {
+	if u.dialer == nil {
+		timeout := u.dialTimeout
+		if timeout < 0 {
+			timeout = 0
+		}
+		return &net.Dialer{
+			Timeout:   timeout,
+			KeepAlive: u.keepAlive,
+		}, nil
+	}
+
+	d, ok := asDialer(u.dialer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported dialer type %T", u.dialer)
+	}
+	return d, nil
+}
+
+// asDialer returns d as a proxy.Dialer, if it is one of the types accepted by
+// the Dialer option.
+func asDialer(d interface{}) (proxy.Dialer, bool) {
+	switch v := d.(type) {
+	case net.Dialer:
+		return &v, true
+	case proxy.Dialer:
+		return v, true
+	case proxy.ContextDialer:
+		return dialFunc(v.DialContext), true
+	case func(ctx context.Context, network, addr string) (net.Conn, error):
+		return dialFunc(v), true
+	}
+	return nil, false
+}
+
+// A dialFunc is a function used as a proxy.Dialer.
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+func (f dialFunc) Dial(network, addr string) (net.Conn, error) {
+	return f(context.Background(), network, addr)
+}
+
+func (f dialFunc) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return f(ctx, network, addr)
+}
+
+// transport returns a clone of http.DefaultTransport with the configured
+// timeouts applied.
+func (u UTLS) transport() *http.Transport {
+	tr := httpRoundTripper.Clone()
+	tr.TLSHandshakeTimeout = u.handshakeTimeout()
+	if u.responseHeaderTimeout != 0 {
+		tr.ResponseHeaderTimeout = u.responseHeaderTimeout
+	}
+	if u.idleConnTimeout != 0 {
+		tr.IdleConnTimeout = u.idleConnTimeout
+	}
+
+	return tr
+}
+
+// handshakeTimeout returns the maximum amount of time to wait for a TLS
+// handshake.
+func (u UTLS) handshakeTimeout() time.Duration {
+	if u.tlsHandshakeTimeout != 0 {
+		return u.tlsHandshakeTimeout
+	}
+	return httpRoundTripper.TLSHandshakeTimeout
+}
+
+// Proxy sets the proxy, or the chain of proxies, that connections go through.
+// It accepts a URL as a string or *url.URL, a ProxyHop, or a chain of them as
+// a []string, []*url.URL or []ProxyHop, in which each proxy is reached
+// through the previous one, or a *ProxyPool. Supported schemes are socks4, socks4a, socks5,
+// socks5h, http, https, ssh and ss, the first six also over Unix sockets, as
+// in socks5+unix:///run/tor/socks, and those registered with
+// RegisterProxyScheme. It overrides the ProxyFromEnvironment and ProxyPAC
+// options, and the other way around. A dialer of one of the types accepted by
+// the Dialer option, such as a proxy.Dialer made by proxy.FromURL, is set as
+// with the Dialer option, with no proxy.
 func Proxy(p interface{}) UTLSOption {
 	return func(o *UTLS) {
-		o.proxy = p
+		o.proxy, o.proxyFunc, o.pool = p, nil, nil
+		if pool, ok := p.(*ProxyPool); ok {
+			o.proxy, o.proxyFunc, o.pool = nil, pool.proxyFunc, pool
+		}
+		if _, ok := asDialer(p); ok {
+			o.proxy, o.dialer = nil, p
+		}
+	}
+}
+
+// Dialer sets the dialer of direct connections, either to the server or to
+// the first proxy, on which proxies and uTLS are built. It accepts a
+// net.Dialer or *net.Dialer, whose settings are used as they are, in place of
+// the DialTimeout and KeepAlive options, any proxy.Dialer or
+// proxy.ContextDialer, or a func(ctx context.Context, network, addr string)
+// (net.Conn, error). HTTP/3 is not used with it, since QUIC cannot be sent
+// through a dialer.
+func Dialer(d interface{}) UTLSOption {
+	return func(o *UTLS) {
+		o.dialer = d
+	}
+}
+
+// ProxyFromEnvironment makes each request go through the proxy set by the
+// HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables, or their
+// lowercase versions, as http.ProxyFromEnvironment does, for both HTTP and
+// HTTPS requests. ALL_PROXY, which may be a socks5 or socks5h URL too, is used
+// for the schemes that have no proxy of their own. NO_PROXY is a
+// comma-separated list of host names, which match their subdomains, domain
+// suffixes starting with ".", IP addresses and CIDR ranges, each with an
+// optional port, or "*" for none. Requests to localhost and loopback
+// addresses never use a proxy. The environment is read once, when the option
+// is applied. It overrides the Proxy and ProxyPAC options, and the other way
+// around.
+func ProxyFromEnvironment() UTLSOption {
+	return func(o *UTLS) {
+		o.proxy, o.pool = nil, nil
+		o.proxyFunc = envProxyFunc()
+	}
+}
+
+// ProxyPAC makes each request go through the proxies that the proxy
+// auto-config file p chooses for it. A request is sent through the next
+// proxy of the list when a connection cannot be made through one, if its
+// body can be sent again. It overrides the Proxy and ProxyFromEnvironment
+// options, and the other way around.
+func ProxyPAC(p *PAC) UTLSOption {
+	return func(o *UTLS) {
+		o.proxy, o.pool = nil, nil
+		o.proxyFunc = func(req *http.Request) ([]*url.URL, error) {
+			return p.FindProxy(req.Context(), req.URL)
+		}
+	}
+}
+
+// ProxyAuth sets how HTTP and HTTPS proxies are authenticated to, in order of
+// preference, when they answer with 407 Proxy Authentication Required. By
+// default, the credentials of a proxy's URL are sent as Basic credentials,
+// and used to answer Digest and Basic challenges. ProxyHop.Auth takes
+// precedence over it.
+func ProxyAuth(authenticators ...ProxyAuthenticator) UTLSOption {
+	return func(o *UTLS) {
+		o.proxyAuthenticators = authenticators
+	}
+}
+
+// ProxyConnectHeader sets headers sent in CONNECT requests to HTTP and HTTPS
+// proxies, as in http.Transport. It can be used to choose a session of a
+// rotating proxy, or to set the User-Agent seen by the proxy. Once set, HTTP
+// requests are tunnelled through CONNECT too, rather than sent to the last
+// proxy of the chain.
+func ProxyConnectHeader(h http.Header) UTLSOption {
+	return func(o *UTLS) {
+		o.proxyConnectHeader = h
+	}
+}
+
+// GetProxyConnectHeader sets a function that returns the headers sent in the
+// CONNECT request for target, a host:port address, to the HTTP or HTTPS
+// proxy at proxyURL, as in http.Transport. It takes precedence over
+// ProxyConnectHeader. Once set, HTTP requests are tunnelled through CONNECT
+// too, rather than sent to the last proxy of the chain.
+func GetProxyConnectHeader(f func(ctx context.Context, proxyURL *url.URL, target string) (http.Header, error)) UTLSOption {
+	return func(o *UTLS) {
+		o.getProxyConnectHeader = f
+	}
+}
+
+// OnProxyConnectResponse sets a function called with every response of an
+// HTTP or HTTPS proxy to a CONNECT request, as in http.Transport, for example
+// to read the exit address the proxy reports in a header. The body of a
+// response other than 200 has been read. An error returned aborts the dial.
+// Once set, HTTP requests are tunnelled through CONNECT too, rather than
+// sent to the last proxy of the chain.
+func OnProxyConnectResponse(f func(ctx context.Context, proxyURL *url.URL, connectReq *http.Request, connectRes *http.Response) error) UTLSOption {
+	return func(o *UTLS) {
+		o.onProxyConnectResponse = f
+	}
+}
+
+// Resolver sets the resolver of host names for socks4 and socks5 proxies,
+// which are sent IP addresses, unlike socks4a and socks5h proxies, which
+// resolve names themselves. Lookups are not made through the proxies. It
+// defaults to net.DefaultResolver.
+func Resolver(r HostResolver) UTLSOption {
+	return func(o *UTLS) {
+		o.resolver = r
+	}
+}
+
+// Profile selects a registered browser profile by name, such as "chrome" or
+// "firefox-105", which sets the ClientHello, User-Agent, default headers and
+// HTTP/2 settings together so that they match. Unversioned names refer to
+// the latest version. There are profiles only for the releases whose
+// ClientHello uTLS reproduces, so "safari" is Safari 16 and "android-okhttp"
+// OkHttp on Android 11, with no other versions. The ClientHello and
+// ClientHelloSpec options take precedence over the profile's ClientHello.
+func Profile(name string) UTLSOption {
+	return func(o *UTLS) {
+		o.profileName = name
 	}
 }
 
@@ -48,9 +326,154 @@ func ClientHello(ch *utls.ClientHelloID) UTLSOption {
 	}
 }
 
+// ClientHelloSpec sets a factory for a custom ClientHelloSpec, which is
+// applied to every TLS connection, including the one to an HTTPS proxy whose
+// ProxyHop has no ClientHello, in place of the ClientHelloID. The spec's
+// extensions hold per-connection state, so the factory must return a new
+// spec on every call. It takes precedence over ClientHello.
+func ClientHelloSpec(factory func() *utls.ClientHelloSpec) UTLSOption {
+	return func(o *UTLS) {
+		o.clientHelloSpec = factory
+	}
+}
+
+// RotateClientHello sets a HelloSelector that chooses the ClientHello of each
+// new connection to a server, in place of ClientHello. The connection to an
+// HTTPS proxy still uses ClientHello. ClientHelloSpec takes precedence over
+// it.
+func RotateClientHello(s HelloSelector) UTLSOption {
+	return func(o *UTLS) {
+		o.helloSelector = s
+	}
+}
+
+// OnClientHello sets a function called with the address and ClientHelloID of
+// every TLS connection established to a server, so that the choices of
+// RotateClientHello can be logged. It must be safe for concurrent use.
+func OnClientHello(f func(addr string, id utls.ClientHelloID)) UTLSOption {
+	return func(o *UTLS) {
+		o.onHello = f
+	}
+}
+
 // Config sets the utls config field of a UTLS struct to the given config.
 func Config(c *utls.Config) UTLSOption {
 	return func(o *UTLS) {
 		o.config = c
 	}
 }
+
+// DialTimeout sets the maximum amount of time a dial will wait for a TCP
+// connect to complete, either to the server or to the first proxy. It
+// defaults to 30 seconds; a negative value means no timeout. It does not
+// apply to a Dialer.
+func DialTimeout(d time.Duration) UTLSOption {
+	return func(o *UTLS) {
+		o.dialTimeout = d
+	}
+}
+
+// KeepAlive sets the interval between TCP keep-alive probes, as in
+// net.Dialer. It defaults to 30 seconds; a negative value disables them. It
+// does not apply to a Dialer.
+func KeepAlive(d time.Duration) UTLSOption {
+	return func(o *UTLS) {
+		o.keepAlive = d
+	}
+}
+
+// ProxyConnectTimeout sets the maximum amount of time to wait for an HTTP or
+// HTTPS proxy to answer a CONNECT request. Zero means no timeout.
+func ProxyConnectTimeout(d time.Duration) UTLSOption {
+	return func(o *UTLS) {
+		o.connectTimeout = d
+	}
+}
+
+// TLSHandshakeTimeout sets the maximum amount of time to wait for a TLS
+// handshake, to the server or to an HTTPS proxy. It defaults to the value of
+// http.DefaultTransport, 10 seconds.
+func TLSHandshakeTimeout(d time.Duration) UTLSOption {
+	return func(o *UTLS) {
+		o.tlsHandshakeTimeout = d
+	}
+}
+
+// ResponseHeaderTimeout sets the amount of time to wait for a server's
+// response headers after fully writing the request, for both HTTP/1.1 and
+// HTTP/2. Zero means no timeout.
+func ResponseHeaderTimeout(d time.Duration) UTLSOption {
+	return func(o *UTLS) {
+		o.responseHeaderTimeout = d
+	}
+}
+
+// IdleConnTimeout sets the maximum amount of time an idle connection will
+// remain idle before closing itself, for both HTTP/1.1 and HTTP/2. It
+// defaults to the value of http.DefaultTransport, 90 seconds.
+func IdleConnTimeout(d time.Duration) UTLSOption {
+	return func(o *UTLS) {
+		o.idleConnTimeout = d
+	}
+}
+
+// ReadIdleTimeout sets the timeout after which a health check using a PING
+// frame will be carried out if no frame is received on an HTTP/2 connection.
+// Zero means no health check is performed, except on HTTP/2 connections to
+// HTTPS proxies, which are checked after 30 seconds.
+func ReadIdleTimeout(d time.Duration) UTLSOption {
+	return func(o *UTLS) {
+		o.http2.readIdleTimeout = d
+	}
+}
+
+// PingTimeout sets the timeout after which an HTTP/2 connection will be
+// closed if a response to a health check PING is not received. It defaults
+// to 15 seconds.
+func PingTimeout(d time.Duration) UTLSOption {
+	return func(o *UTLS) {
+		o.http2.pingTimeout = d
+	}
+}
+
+// WriteByteTimeout sets the timeout after which an HTTP/2 connection will be
+// closed if no data can be written to it. Zero means no timeout.
+func WriteByteTimeout(d time.Duration) UTLSOption {
+	return func(o *UTLS) {
+		o.http2.writeByteTimeout = d
+	}
+}
+
+// HTTP2Fingerprint sets the HTTP/2 connection preface, header priority and
+// pseudo-header order of HTTPS connections that negotiate HTTP/2, in place of
+// those of the browser profile. See ParseHTTP2Fingerprint to set them from
+// an Akamai fingerprint.
+func HTTP2Fingerprint(s HTTP2Settings) UTLSOption {
+	return func(o *UTLS) {
+		o.http2Settings = &s
+	}
+}
+
+// HTTP3 sets when HTTPS requests are sent over HTTP/3 instead of TCP. Requests
+// fall back to TCP when the QUIC connection cannot be established, e.g.
+// because UDP is blocked. HTTP/3 is not used through a proxy.
+//
+// The TLS handshake of QUIC is done by crypto/tls, whose ClientHello is Go's
+// own and does not match the one sent over TCP, so HTTP/3 does not preserve
+// the TLS fingerprint. TCP connections therefore send Go's ClientHello as
+// well, and NewUTLSRoundTripper returns an error when HTTP3 is combined with
+// ClientHello, ClientHelloSpec, RotateClientHello or Profile. A QUIC handshake
+// that does not complete within two seconds falls back to TCP.
+func HTTP3(mode HTTP3Mode) UTLSOption {
+	return func(o *UTLS) {
+		o.http3Mode = mode
+	}
+}
+
+// QUICConfig sets the QUIC configuration used for HTTP/3. It defaults to
+// transport parameters resembling Chrome's.
+func QUICConfig(c *quic.Config) UTLSOption {
+	return func(o *UTLS) {
+		o.quicConfig = c
+	}
+}
@@ -0,0 +1,401 @@
+// Copyright 2023 Wayback Archiver. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package proxier // import "github.com/wabarc/proxier"
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/dop251/goja"
+)
+
+// https://developer.mozilla.org/en-US/docs/Web/HTTP/Proxy_servers_and_tunneling/Proxy_Auto-Configuration_PAC_file
+
+// A PAC is a proxy auto-config file, whose FindProxyForURL function chooses
+// the proxies of each request. It is safe for concurrent use.
+type PAC struct {
+	// Resolver looks up host names for the script. If nil,
+	// net.DefaultResolver is used.
+	Resolver HostResolver
+
+	script string
+	// Idle runtimes of script, each used by one call at a time, so that
+	// calls waiting for lookups do not hold up the others.
+	runtimes sync.Pool
+}
+
+// A pacRuntime runs the script of a PAC, and is not safe for concurrent use.
+type pacRuntime struct {
+	pac *PAC
+	vm  *goja.Runtime
+	// FindProxyForURL.
+	find goja.Callable
+	// Context of the current call of find.
+	ctx context.Context
+}
+
+// Maximum size of a PAC file.
+const maxPACLen = 1 << 20
+
+// LoadPAC reads the PAC file at location, a local path, or a file, http or
+// https URL.
+func LoadPAC(ctx context.Context, location string) (*PAC, error) {
+	var r io.Reader
+	u, err := url.Parse(location)
+	switch {
+	case err == nil && (u.Scheme == "http" || u.Scheme == "https"):
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, location, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("load PAC file: server returned %q", resp.Status)
+		}
+		r = resp.Body
+	default:
+		if err == nil && u.Scheme == "file" {
+			location = u.Path
+		}
+		f, err := os.Open(location)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	script, err := io.ReadAll(io.LimitReader(r, maxPACLen+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(script) > maxPACLen {
+		return nil, fmt.Errorf("load PAC file: larger than %d bytes", maxPACLen)
+	}
+
+	return ParsePAC(string(script))
+}
+
+// ParsePAC returns the PAC of script, which must define FindProxyForURL.
+func ParsePAC(script string) (*PAC, error) {
+	p := &PAC{script: script}
+	rt, err := p.newRuntime()
+	if err != nil {
+		return nil, err
+	}
+	p.runtimes.Put(rt)
+
+	return p, nil
+}
+
+// newRuntime returns a new runtime of the script of p.
+func (p *PAC) newRuntime() (*pacRuntime, error) {
+	rt := &pacRuntime{pac: p, vm: goja.New(), ctx: context.Background()}
+	for name, f := range map[string]interface{}{
+		"dnsResolve":   rt.dnsResolve,
+		"isResolvable": rt.isResolvable,
+		"isInNet":      rt.isInNet,
+		"myIpAddress":  myIPAddress,
+		"shExpMatch":   shExpMatch,
+		"alert":        func(string) {},
+	} {
+		if err := rt.vm.Set(name, f); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := rt.vm.RunString(pacUtils); err != nil {
+		return nil, err
+	}
+	if _, err := rt.vm.RunString(p.script); err != nil {
+		return nil, fmt.Errorf("parse PAC file: %w", err)
+	}
+	find, ok := goja.AssertFunction(rt.vm.Get("FindProxyForURL"))
+	if !ok {
+		return nil, fmt.Errorf("parse PAC file: FindProxyForURL is not defined")
+	}
+	rt.find = find
+
+	return rt, nil
+}
+
+// runtime returns an idle runtime of p, or a new one if there is none.
+func (p *PAC) runtime() (*pacRuntime, error) {
+	if rt, ok := p.runtimes.Get().(*pacRuntime); ok {
+		return rt, nil
+	}
+	return p.newRuntime()
+}
+
+// FindProxy returns the proxies the PAC file chooses for u, in order of
+// preference, as URLs with the socks5h, socks4, http or https scheme, or nil
+// for a direct connection. As in browsers, the path and query of https URLs
+// are not passed to the script, and SOCKS and SOCKS5 proxies resolve host
+// names themselves.
+func (p *PAC) FindProxy(ctx context.Context, u *url.URL) ([]*url.URL, error) {
+	pacURL := *u
+	pacURL.User = nil
+	pacURL.Fragment = ""
+	if u.Scheme == "https" {
+		pacURL.Path, pacURL.RawPath, pacURL.RawQuery = "/", "", ""
+	}
+
+	rt, err := p.runtime()
+	if err != nil {
+		return nil, err
+	}
+	rt.ctx = ctx
+	interrupted := make(chan struct{})
+	stop := context.AfterFunc(ctx, func() {
+		rt.vm.Interrupt(ctx.Err())
+		close(interrupted)
+	})
+	v, err := rt.find(goja.Undefined(), rt.vm.ToValue(pacURL.String()), rt.vm.ToValue(u.Hostname()))
+	if !stop() {
+		// Wait for the interrupt, not to leave it to the next call.
+		<-interrupted
+	}
+	rt.vm.ClearInterrupt()
+	rt.ctx = context.Background()
+	p.runtimes.Put(rt)
+	if err != nil {
+		return nil, fmt.Errorf("FindProxyForURL: %w", err)
+	}
+
+	return parsePACResult(v.String())
+}
+
+// parsePACResult parses a result of FindProxyForURL, such as
+// "PROXY a:3128; SOCKS5 b:1080; DIRECT". Entries that are not understood are
+// skipped.
+func parsePACResult(result string) ([]*url.URL, error) {
+	var proxies []*url.URL
+	for _, entry := range strings.Split(result, ";") {
+		fields := strings.Fields(entry)
+		if len(fields) == 0 {
+			continue
+		}
+		var scheme string
+		switch strings.ToUpper(fields[0]) {
+		case "DIRECT":
+			proxies = append(proxies, nil)
+			continue
+		case "PROXY", "HTTP":
+			scheme = "http"
+		case "HTTPS":
+			scheme = "https"
+		case "SOCKS", "SOCKS5":
+			scheme = "socks5h"
+		case "SOCKS4":
+			scheme = "socks4"
+		default:
+			continue
+		}
+		if len(fields) != 2 {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(fields[1]); err != nil {
+			continue
+		}
+		proxies = append(proxies, &url.URL{Scheme: scheme, Host: fields[1]})
+	}
+	if len(proxies) == 0 {
+		return nil, fmt.Errorf("no usable proxy in PAC result %q", result)
+	}
+
+	return proxies, nil
+}
+
+func (p *PAC) resolver() HostResolver {
+	if p.Resolver == nil {
+		return net.DefaultResolver
+	}
+	return p.Resolver
+}
+
+// lookup returns an address of host, an IPv4 one if there is any.
+func (rt *pacRuntime) lookup(host string) net.IP {
+	ips, err := lookupIPs(rt.ctx, rt.pac.resolver(), host, false)
+	if err != nil {
+		return nil
+	}
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			return ip
+		}
+	}
+	return ips[0]
+}
+
+func (rt *pacRuntime) dnsResolve(host string) interface{} {
+	if ip := rt.lookup(host); ip != nil {
+		return ip.String()
+	}
+	return nil
+}
+
+func (rt *pacRuntime) isResolvable(host string) bool {
+	return rt.lookup(host) != nil
+}
+
+func (rt *pacRuntime) isInNet(host, pattern, mask string) bool {
+	ip := rt.lookup(host)
+	addr, m := net.ParseIP(pattern), net.ParseIP(mask)
+	if ip == nil || addr == nil || m == nil {
+		return false
+	}
+	if ip4, addr4, m4 := ip.To4(), addr.To4(), m.To4(); ip4 != nil && addr4 != nil && m4 != nil {
+		ip, addr, m = ip4, addr4, m4
+	}
+	if len(ip) != len(addr) || len(addr) != len(m) {
+		return false
+	}
+
+	return ip.Mask(net.IPMask(m)).Equal(addr.Mask(net.IPMask(m)))
+}
+
+// myIPAddress returns the address of the interface that reaches the
+// internet, found without sending any packet.
+func myIPAddress() string {
+	conn, err := net.Dial("udp", "192.0.2.1:80")
+	if err != nil {
+		return "127.0.0.1"
+	}
+	defer conn.Close()
+
+	return conn.LocalAddr().(*net.UDPAddr).IP.String()
+}
+
+// shExpMatch reports whether s matches the shell expression pattern, in which
+// "*" matches any string and "?" any character.
+func shExpMatch(s, pattern string) bool {
+	expr := regexp.QuoteMeta(pattern)
+	expr = strings.NewReplacer(`\*`, `.*`, `\?`, `.`).Replace(expr)
+	matched, _ := regexp.MatchString("^(?s:"+expr+")$", s)
+	return matched
+}
+
+// pacUtils defines the helper functions of PAC files that do not need Go.
+const pacUtils = `
+function isPlainHostName(host) {
+	return host.indexOf(".") < 0;
+}
+
+function dnsDomainIs(host, domain) {
+	return host.length >= domain.length &&
+		host.substring(host.length - domain.length) == domain;
+}
+
+function localHostOrDomainIs(host, hostdom) {
+	return host == hostdom || hostdom.lastIndexOf(host + ".", 0) == 0;
+}
+
+function dnsDomainLevels(host) {
+	return host.split(".").length - 1;
+}
+
+function convert_addr(ipchars) {
+	var bytes = ipchars.split(".");
+	return ((bytes[0] & 0xff) << 24) | ((bytes[1] & 0xff) << 16) |
+		((bytes[2] & 0xff) << 8) | (bytes[3] & 0xff);
+}
+
+function pacArgs(args) {
+	args = Array.prototype.slice.call(args);
+	var gmt = args.length > 0 && args[args.length - 1] == "GMT";
+	if (gmt) {
+		args.pop();
+	}
+	return {args: args, gmt: gmt, now: new Date()};
+}
+
+function pacInRange(lo, now, hi) {
+	return lo <= hi ? lo <= now && now <= hi : now >= lo || now <= hi;
+}
+
+function weekdayRange() {
+	var a = pacArgs(arguments);
+	var day = function(s) {
+		var i = "SUNMONTUEWEDTHUFRISAT".indexOf(s);
+		return i % 3 == 0 ? i / 3 : -1;
+	};
+	var wd1 = day(a.args[0]);
+	var wd2 = a.args.length > 1 ? day(a.args[1]) : wd1;
+	if (wd1 < 0 || wd2 < 0) {
+		return false;
+	}
+	return pacInRange(wd1, a.gmt ? a.now.getUTCDay() : a.now.getDay(), wd2);
+}
+
+function dateRange() {
+	var a = pacArgs(arguments);
+	var n = a.args.length;
+	if (n == 0 || n > 6 || (n > 1 && n % 2 == 1)) {
+		return false;
+	}
+	var now = {
+		d: a.gmt ? a.now.getUTCDate() : a.now.getDate(),
+		m: a.gmt ? a.now.getUTCMonth() : a.now.getMonth(),
+		y: a.gmt ? a.now.getUTCFullYear() : a.now.getFullYear()
+	};
+	// Keys of the dates of args, and of now with the same fields.
+	var key = function(args) {
+		var k = {date: 0, now: 0};
+		for (var i = 0; i < args.length; i++) {
+			var v = args[i], f, w;
+			if (typeof v == "string") {
+				v = "JANFEBMARAPRMAYJUNJULAUGSEPOCTNOVDEC".indexOf(v) / 3;
+				f = "m";
+				w = 100;
+			} else if (v > 31) {
+				f = "y";
+				w = 10000;
+			} else {
+				f = "d";
+				w = 1;
+			}
+			k.date += v * w;
+			k.now += now[f] * w;
+		}
+		return k;
+	};
+	if (n == 1) {
+		var k = key(a.args);
+		return k.date == k.now;
+	}
+	var lo = key(a.args.slice(0, n / 2)), hi = key(a.args.slice(n / 2));
+	return pacInRange(lo.date, lo.now, hi.date);
+}
+
+function timeRange() {
+	var a = pacArgs(arguments);
+	var now = a.gmt ?
+		a.now.getUTCHours() * 3600 + a.now.getUTCMinutes() * 60 + a.now.getUTCSeconds() :
+		a.now.getHours() * 3600 + a.now.getMinutes() * 60 + a.now.getSeconds();
+	var s = a.args;
+	switch (s.length) {
+	case 1:
+		return pacInRange(s[0] * 3600, now, s[0] * 3600 + 3599);
+	case 2:
+		return pacInRange(s[0] * 3600, now, s[1] * 3600 - 1);
+	case 4:
+		return pacInRange(s[0] * 3600 + s[1] * 60, now, s[2] * 3600 + s[3] * 60 - 1);
+	case 6:
+		return pacInRange(s[0] * 3600 + s[1] * 60 + s[2], now, s[3] * 3600 + s[4] * 60 + s[5]);
+	}
+	return false;
+}
+`
@@ -0,0 +1,267 @@
+// Copyright 2023 Wayback Archiver. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package proxier // import "github.com/wabarc/proxier"
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	utls "github.com/refraction-networking/utls"
+)
+
+const testPAC = `
+function FindProxyForURL(url, host) {
+	if (isPlainHostName(host) || dnsDomainIs(host, ".intranet.example")) {
+		return "DIRECT";
+	}
+	if (isInNet(host, "10.0.0.0", "255.0.0.0")) {
+		return "SOCKS 10.0.0.1:1080";
+	}
+	if (shExpMatch(url, "https://*.secure.example/*")) {
+		return "HTTPS proxy.example:8443; PROXY backup.example:3128";
+	}
+	if (dnsResolve(host) == "192.0.2.1") {
+		return "SOCKS4 socks4.example:1080; bogus; DIRECT";
+	}
+	return "PROXY proxy.example:3128; DIRECT";
+}
+`
+
+func TestPACFindProxy(t *testing.T) {
+	p, err := ParsePAC(testPAC)
+	if err != nil {
+		t.Fatalf("unexpected parse PAC: %v", err)
+	}
+	p.Resolver = hostsResolver{"mapped.example": "10.1.2.3", "doc.example": "192.0.2.1", "www.example.com": "198.51.100.1"}
+
+	for _, test := range []struct {
+		url     string
+		proxies []string
+	}{
+		{"http://intranet/", []string{"DIRECT"}},
+		{"http://wiki.intranet.example/", []string{"DIRECT"}},
+		{"http://mapped.example/", []string{"socks5h://10.0.0.1:1080"}},
+		{"https://www.secure.example/path?q=1", []string{"https://proxy.example:8443", "http://backup.example:3128"}},
+		{"http://doc.example/", []string{"socks4://socks4.example:1080", "DIRECT"}},
+		{"http://www.example.com/", []string{"http://proxy.example:3128", "DIRECT"}},
+	} {
+		u, _ := url.Parse(test.url)
+		proxies, err := p.FindProxy(context.Background(), u)
+		if err != nil {
+			t.Fatalf("unexpected find proxy of %s: %v", test.url, err)
+		}
+		var got []string
+		for _, proxyURL := range proxies {
+			if proxyURL == nil {
+				got = append(got, "DIRECT")
+			} else {
+				got = append(got, proxyURL.String())
+			}
+		}
+		if !reflect.DeepEqual(got, test.proxies) {
+			t.Errorf("expected proxies %q for %s, got %q", test.proxies, test.url, got)
+		}
+	}
+
+	if _, err := ParsePAC("function f() {}"); err == nil {
+		t.Errorf("expected error without FindProxyForURL")
+	}
+}
+
+// slowResolver is a hostsResolver whose lookups of host names wait for
+// release, after sending them to started.
+type slowResolver struct {
+	hostsResolver
+	started chan<- string
+	release <-chan struct{}
+}
+
+func (r slowResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	r.started <- host
+	select {
+	case <-r.release:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return r.hostsResolver.LookupIPAddr(ctx, host)
+}
+
+// Test that a call waiting for a lookup does not hold up the others.
+func TestPACFindProxyConcurrent(t *testing.T) {
+	p, err := ParsePAC(testPAC)
+	if err != nil {
+		t.Fatalf("unexpected parse PAC: %v", err)
+	}
+	started := make(chan string, 10)
+	release := make(chan struct{})
+	p.Resolver = slowResolver{hostsResolver{"slow.example": "10.1.2.3"}, started, release}
+
+	slow := make(chan error, 1)
+	go func() {
+		u, _ := url.Parse("http://slow.example/")
+		_, err := p.FindProxy(context.Background(), u)
+		slow <- err
+	}()
+	<-started
+
+	u, _ := url.Parse("http://intranet/")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	proxies, err := p.FindProxy(ctx, u)
+	if err != nil {
+		t.Fatalf("unexpected find proxy during a lookup: %v", err)
+	}
+	if len(proxies) != 1 || proxies[0] != nil {
+		t.Errorf("expected direct connection for %s, got %v", u, proxies)
+	}
+
+	close(release)
+	if err := <-slow; err != nil {
+		t.Errorf("unexpected find proxy after a lookup: %v", err)
+	}
+}
+
+func TestPACUtils(t *testing.T) {
+	p, err := ParsePAC(`function FindProxyForURL(url, host) { return "DIRECT"; }`)
+	if err != nil {
+		t.Fatalf("unexpected parse PAC: %v", err)
+	}
+	p.Resolver = hostsResolver{"www.example.com": "198.51.100.1"}
+	rt, err := p.runtime()
+	if err != nil {
+		t.Fatalf("unexpected runtime: %v", err)
+	}
+
+	for _, expr := range []string{
+		`isPlainHostName("www") && !isPlainHostName("www.example.com")`,
+		`dnsDomainIs("www.example.com", ".example.com") && !dnsDomainIs("www.example.org", ".example.com")`,
+		`localHostOrDomainIs("www", "www.example.com") && localHostOrDomainIs("www.example.com", "www.example.com") && !localHostOrDomainIs("home", "www.example.com")`,
+		`dnsDomainLevels("www") == 0 && dnsDomainLevels("www.example.com") == 2`,
+		`isResolvable("www.example.com") && !isResolvable("unknown.example")`,
+		`dnsResolve("www.example.com") == "198.51.100.1" && dnsResolve("unknown.example") === null`,
+		`isInNet("www.example.com", "198.51.100.0", "255.255.255.0") && !isInNet("www.example.com", "198.51.0.0", "255.255.255.0")`,
+		`convert_addr("104.16.41.2") == 1745889538`,
+		`shExpMatch("http://home.netscape.com/people/ari/index.html", "*/ari/*") && !shExpMatch("http://home.netscape.com/people/montulli/index.html", "*/ari/*")`,
+		`shExpMatch("a.b", "?.b") && !shExpMatch("axb", "a.b")`,
+		`weekdayRange("SUN", "SAT") && !weekdayRange("FOO")`,
+		`var d = new Date(); dateRange(d.getFullYear()) && dateRange(d.getDate()) && !dateRange(d.getFullYear() + 1)`,
+		`dateRange("JAN", "DEC") && dateRange(1, 31)`,
+		`timeRange(0, 24) && timeRange(0, 0, 0, 23, 59, 59) && !timeRange(25)`,
+		`typeof myIpAddress() == "string"`,
+	} {
+		v, err := rt.vm.RunString(expr)
+		if err != nil {
+			t.Fatalf("unexpected evaluate %s: %v", expr, err)
+		}
+		if !v.ToBoolean() {
+			t.Errorf("expected true: %s", expr)
+		}
+	}
+}
+
+// Test that a PAC file is loaded from a path or URL, and that requests fail
+// over to the next proxy.
+func TestProxyPAC(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	defer server.Close()
+	httpServer := httptest.NewServer(server.Config.Handler)
+	defer httpServer.Close()
+
+	// Nothing listens on the first proxy.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected listen: %v", err)
+	}
+	down := ln.Addr().String()
+	ln.Close()
+	addrs := make(chan string, 10)
+	script := fmt.Sprintf(`function FindProxyForURL(url, host) { return "PROXY %s; SOCKS5 %s; DIRECT"; }`, down, socks5Server(t, addrs))
+
+	pacServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, script)
+	}))
+	defer pacServer.Close()
+	path := filepath.Join(t.TempDir(), "proxy.pac")
+	if err := os.WriteFile(path, []byte(script), 0o600); err != nil {
+		t.Fatalf("unexpected write PAC file: %v", err)
+	}
+
+	for _, location := range []string{path, "file://" + path, pacServer.URL} {
+		p, err := LoadPAC(context.Background(), location)
+		if err != nil {
+			t.Fatalf("unexpected load PAC file from %s: %v", location, err)
+		}
+		rt, err := NewUTLSRoundTripper(Config(&utls.Config{InsecureSkipVerify: true}), ProxyPAC(p))
+		if err != nil {
+			t.Fatalf("unexpected create utls round tripper: %v", err)
+		}
+		for _, target := range []*httptest.Server{server, httpServer} {
+			_, port, _ := net.SplitHostPort(target.Listener.Addr().String())
+			scheme := "http"
+			if target.TLS != nil {
+				scheme = "https"
+			}
+			resp, err := rt.RoundTrip(newRequest(t, scheme+"://"+testHost+":"+port))
+			if err != nil {
+				t.Fatalf("unexpected %s request: %v", scheme, err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if string(body) != "hello" {
+				t.Errorf("expected body %q, got %q", "hello", body)
+			}
+			if got := <-addrs; got != testHost+":"+port {
+				t.Errorf("expected proxy to be sent %s, got %s", testHost+":"+port, got)
+			}
+		}
+	}
+}
+
+// Test that requests do not fail over from a proxy that cannot reach the
+// target.
+func TestProxyPACTargetUnreachable(t *testing.T) {
+	// The next proxy would reach the server.
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	_, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+
+	log := make(chan string, 10)
+	unreachable := connectProxy(t, "unreachable", false, func(w http.ResponseWriter, r *http.Request) bool {
+		w.WriteHeader(http.StatusBadGateway)
+		return false
+	}, log)
+	addrs := make(chan string, 10)
+	p, err := ParsePAC(fmt.Sprintf(`function FindProxyForURL(url, host) { return "PROXY %s; SOCKS5 %s"; }`, unreachable.Host, socks5Server(t, addrs)))
+	if err != nil {
+		t.Fatalf("unexpected parse PAC: %v", err)
+	}
+	rt, err := NewUTLSRoundTripper(ProxyPAC(p))
+	if err != nil {
+		t.Fatalf("unexpected create utls round tripper: %v", err)
+	}
+
+	_, err = rt.RoundTrip(newRequest(t, "https://"+testHost+":"+port))
+	if !errors.Is(err, ErrTargetUnreachable) {
+		t.Errorf("expected target unreachable, got %v", err)
+	}
+	select {
+	case addr := <-addrs:
+		t.Errorf("unexpected fail over to the next proxy for %s", addr)
+	default:
+	}
+}
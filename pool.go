@@ -0,0 +1,358 @@
+// Copyright 2023 Wayback Archiver. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package proxier // import "github.com/wabarc/proxier"
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// A PoolStrategy is how a ProxyPool chooses the proxy of a request.
+type PoolStrategy int
+
+const (
+	// PoolRoundRobin takes the proxies in turn.
+	PoolRoundRobin PoolStrategy = iota
+	// PoolRandom takes a proxy at random.
+	PoolRandom
+	// PoolLeastConn takes the proxy with the fewest open connections.
+	PoolLeastConn
+	// PoolLatencyWeighted takes a proxy at random, with a probability
+	// inversely proportional to its dial latency. Proxies not dialled yet
+	// count as the fastest.
+	PoolLatencyWeighted
+)
+
+// Defaults of ProxyPoolOption.
+const (
+	defaultPoolMaxFailures = 3
+	defaultPoolEjectFor    = 30 * time.Second
+)
+
+// Health checks fail after this long.
+const healthCheckTimeout = 10 * time.Second
+
+// A ProxyPool spreads requests over many proxies, and can be given to the
+// Proxy option. Proxies that fail to connect too many times in a row are
+// ejected from the pool for a while, unless every proxy is. It is safe for
+// concurrent use, and may be shared by round trippers.
+type ProxyPool struct {
+	proxies  []*poolProxy
+	strategy PoolStrategy
+	next     atomic.Uint64
+
+	maxFailures int
+	ejectFor    time.Duration
+
+	healthTarget   string
+	healthInterval time.Duration
+	// Cancelled by Close.
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// ProxyPoolOption is a function type that modifies a ProxyPool.
+type ProxyPoolOption func(*ProxyPool)
+
+// PoolSelect sets how the proxy of a request is chosen. It is PoolRoundRobin
+// by default.
+func PoolSelect(s PoolStrategy) ProxyPoolOption {
+	return func(p *ProxyPool) {
+		p.strategy = s
+	}
+}
+
+// PoolEjection sets the number of consecutive failures to connect through a
+// proxy after which it is ejected from the pool, and for how long. It is 3
+// failures and 30 seconds by default.
+func PoolEjection(failures int, d time.Duration) ProxyPoolOption {
+	return func(p *ProxyPool) {
+		p.maxFailures = failures
+		p.ejectFor = d
+	}
+}
+
+// PoolHealthCheck makes the pool connect to target, a host:port address,
+// through each proxy every interval, to update their latency and eject or
+// restore them. A check fails after 10 seconds. Health checks use the
+// default options of proxies.
+func PoolHealthCheck(target string, interval time.Duration) ProxyPoolOption {
+	return func(p *ProxyPool) {
+		p.healthTarget = target
+		p.healthInterval = interval
+	}
+}
+
+// ProxyStats holds the statistics of a proxy of a ProxyPool.
+type ProxyStats struct {
+	URL *url.URL
+	// ActiveConns is the number of connections open through the proxy.
+	ActiveConns int
+	// Dials and Failures are the numbers of connections attempted through
+	// the proxy, including health checks, and of those that failed.
+	Dials, Failures uint64
+	// ConsecutiveFailures is the number of failures since the last
+	// connection made.
+	ConsecutiveFailures int
+	// Latency is a moving average of the time taken to connect.
+	Latency time.Duration
+	// EjectedUntil is when the proxy returns to the pool, if ejected.
+	EjectedUntil time.Time
+}
+
+type poolProxy struct {
+	url    *url.URL
+	active atomic.Int64
+	// Dials through the proxy for health checks.
+	dialer proxy.Dialer
+
+	mu           sync.Mutex
+	dials        uint64
+	failures     uint64
+	consecutive  int
+	latency      time.Duration
+	ejectedUntil time.Time
+}
+
+// NewProxyPool returns a pool of the proxies, given as URLs. Each proxy may
+// use any of the schemes of the Proxy option. Close must be called to stop
+// health checks.
+func NewProxyPool(proxies []string, opts ...ProxyPoolOption) (*ProxyPool, error) {
+	if len(proxies) == 0 {
+		return nil, errors.New("no proxy in the pool")
+	}
+	p := &ProxyPool{
+		maxFailures: defaultPoolMaxFailures,
+		ejectFor:    defaultPoolEjectFor,
+	}
+	for _, s := range proxies {
+		proxyURL, err := url.Parse(s)
+		if err != nil {
+			return nil, err
+		}
+		dialer, _, err := makeProxyDialer(UTLSOptions(Proxy(proxyURL)))
+		if err != nil {
+			return nil, err
+		}
+		p.proxies = append(p.proxies, &poolProxy{url: proxyURL, dialer: dialer})
+	}
+	for _, o := range opts {
+		o(p)
+	}
+	p.ctx, p.cancel = context.WithCancel(context.Background())
+
+	if p.healthTarget != "" && p.healthInterval > 0 {
+		go p.healthChecks()
+	}
+
+	return p, nil
+}
+
+// Close stops the health checks of the pool.
+func (p *ProxyPool) Close() error {
+	p.cancel()
+	return nil
+}
+
+// Stats returns the statistics of each proxy of the pool.
+func (p *ProxyPool) Stats() []ProxyStats {
+	stats := make([]ProxyStats, 0, len(p.proxies))
+	for _, e := range p.proxies {
+		e.mu.Lock()
+		s := ProxyStats{
+			URL:                 e.url,
+			ActiveConns:         int(e.active.Load()),
+			Dials:               e.dials,
+			Failures:            e.failures,
+			ConsecutiveFailures: e.consecutive,
+			Latency:             e.latency,
+		}
+		if time.Now().Before(e.ejectedUntil) {
+			s.EjectedUntil = e.ejectedUntil
+		}
+		e.mu.Unlock()
+		stats = append(stats, s)
+	}
+
+	return stats
+}
+
+// proxyFunc returns the proxies to try for a request: the one chosen,
+// followed by the others in the pool.
+func (p *ProxyPool) proxyFunc(*http.Request) ([]*url.URL, error) {
+	available := p.available()
+	i := p.choose(available)
+	urls := make([]*url.URL, 0, len(available))
+	for j := range available {
+		urls = append(urls, available[(i+j)%len(available)].url)
+	}
+
+	return urls, nil
+}
+
+// available returns the proxies that are not ejected, or all of them if
+// every one is.
+func (p *ProxyPool) available() []*poolProxy {
+	now := time.Now()
+	var available []*poolProxy
+	for _, e := range p.proxies {
+		e.mu.Lock()
+		ejected := now.Before(e.ejectedUntil)
+		e.mu.Unlock()
+		if !ejected {
+			available = append(available, e)
+		}
+	}
+	if len(available) == 0 {
+		return p.proxies
+	}
+
+	return available
+}
+
+// choose returns the index of the proxy to use among proxies.
+func (p *ProxyPool) choose(proxies []*poolProxy) int {
+	switch p.strategy {
+	case PoolRandom:
+		return rand.Intn(len(proxies))
+	case PoolLeastConn:
+		best := 0
+		for i, e := range proxies {
+			if e.active.Load() < proxies[best].active.Load() {
+				best = i
+			}
+		}
+		return best
+	case PoolLatencyWeighted:
+		latencies := make([]time.Duration, len(proxies))
+		fastest := time.Duration(0)
+		for i, e := range proxies {
+			e.mu.Lock()
+			latencies[i] = e.latency
+			e.mu.Unlock()
+			if latencies[i] > 0 && (fastest == 0 || latencies[i] < fastest) {
+				fastest = latencies[i]
+			}
+		}
+		weights := make([]float64, len(proxies))
+		var total float64
+		for i, l := range latencies {
+			if l <= 0 {
+				l = fastest
+			}
+			if l <= 0 {
+				l = time.Millisecond
+			}
+			weights[i] = 1 / l.Seconds()
+			total += weights[i]
+		}
+		r := rand.Float64() * total
+		for i, w := range weights {
+			if r < w {
+				return i
+			}
+			r -= w
+		}
+		return len(proxies) - 1
+	default:
+		return int((p.next.Add(1) - 1) % uint64(len(proxies)))
+	}
+}
+
+// entry returns the proxy of the pool with proxyURL, or nil.
+func (p *ProxyPool) entry(proxyURL *url.URL) *poolProxy {
+	if p == nil || proxyURL == nil {
+		return nil
+	}
+	for _, e := range p.proxies {
+		if e.url == proxyURL || e.url.String() == proxyURL.String() {
+			return e
+		}
+	}
+	return nil
+}
+
+// record counts a connection attempted through e, which took latency.
+func (p *ProxyPool) record(e *poolProxy, err error, latency time.Duration) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.dials++
+	if err != nil {
+		e.failures++
+		e.consecutive++
+		if p.maxFailures > 0 && e.consecutive >= p.maxFailures {
+			e.ejectedUntil = time.Now().Add(p.ejectFor)
+		}
+		return
+	}
+	e.consecutive = 0
+	e.ejectedUntil = time.Time{}
+	if e.latency == 0 {
+		e.latency = latency
+	} else {
+		e.latency = (3*e.latency + latency) / 4
+	}
+}
+
+func (p *ProxyPool) healthChecks() {
+	ticker := time.NewTicker(p.healthInterval)
+	defer ticker.Stop()
+	for {
+		var wg sync.WaitGroup
+		for _, e := range p.proxies {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				p.healthCheck(e)
+			}()
+		}
+		wg.Wait()
+
+		select {
+		case <-ticker.C:
+		case <-p.ctx.Done():
+			return
+		}
+	}
+}
+
+// healthCheck connects to the health check target through e.
+func (p *ProxyPool) healthCheck(e *poolProxy) {
+	ctx, cancel := context.WithTimeout(p.ctx, healthCheckTimeout)
+	defer cancel()
+
+	start := time.Now()
+	conn, err := dialContext(ctx, e.dialer, "tcp", p.healthTarget)
+	if err == nil {
+		conn.Close()
+	}
+	if p.ctx.Err() == nil && !errors.Is(err, ErrTargetUnreachable) {
+		p.record(e, err, time.Since(start))
+	}
+}
+
+// A poolConn is a connection through a proxy of a pool.
+type poolConn struct {
+	net.Conn
+	e    *poolProxy
+	once sync.Once
+}
+
+func (c *poolConn) Close() error {
+	c.once.Do(func() {
+		c.e.active.Add(-1)
+	})
+	return c.Conn.Close()
+}
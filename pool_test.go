@@ -0,0 +1,237 @@
+// Copyright 2023 Wayback Archiver. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package proxier // import "github.com/wabarc/proxier"
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Test that requests are spread over the proxies of a pool in turn, and that
+// a proxy that cannot be reached is ejected.
+func TestProxyPool(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	defer server.Close()
+	_, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected listen: %v", err)
+	}
+	down := ln.Addr().String()
+	ln.Close()
+	a, b := make(chan string, 10), make(chan string, 10)
+	pool, err := NewProxyPool([]string{
+		"socks5h://" + down,
+		"socks5h://" + socks5Server(t, a),
+		"socks5h://" + socks5Server(t, b),
+	}, PoolEjection(1, time.Minute))
+	if err != nil {
+		t.Fatalf("unexpected create proxy pool: %v", err)
+	}
+	defer pool.Close()
+
+	rt, err := NewUTLSRoundTripper(Proxy(pool))
+	if err != nil {
+		t.Fatalf("unexpected create utls round tripper: %v", err)
+	}
+	// The first request fails over from the proxy that is down.
+	for i, want := range []chan string{a, b, a, b} {
+		resp, err := rt.RoundTrip(newRequest(t, "http://"+testHost+":"+port))
+		if err != nil {
+			t.Fatalf("unexpected request %d: %v", i, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != "hello" {
+			t.Errorf("expected body %q, got %q", "hello", body)
+		}
+		select {
+		case <-want:
+		default:
+			t.Errorf("expected request %d through proxy %s", i, map[chan string]string{a: "a", b: "b"}[want])
+		}
+		// Dial again through the next proxy.
+		rt.(*UTLSRoundTripper).CloseIdleConnections()
+	}
+
+	stats := pool.Stats()
+	if s := stats[0]; s.Failures != 1 || s.EjectedUntil.IsZero() {
+		t.Errorf("expected proxy that is down to be ejected, got %+v", s)
+	}
+	for _, s := range stats[1:] {
+		if s.Dials != 2 || s.Failures != 0 || s.Latency <= 0 || s.ActiveConns != 0 || !s.EjectedUntil.IsZero() {
+			t.Errorf("unexpected stats %+v", s)
+		}
+	}
+}
+
+// Test that health checks measure the latency of proxies, and eject those
+// that are down.
+func TestProxyPoolHealthCheck(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected listen: %v", err)
+	}
+	down := ln.Addr().String()
+	ln.Close()
+	pool, err := NewProxyPool([]string{
+		"socks5h://" + socks5Server(t, make(chan string, 100)),
+		"socks5h://" + down,
+	}, PoolEjection(2, time.Minute), PoolHealthCheck(server.Listener.Addr().String(), 10*time.Millisecond))
+	if err != nil {
+		t.Fatalf("unexpected create proxy pool: %v", err)
+	}
+	defer pool.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		stats := pool.Stats()
+		if stats[0].Latency > 0 && stats[0].Dials >= 2 && !stats[1].EjectedUntil.IsZero() {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("unexpected stats after health checks: %+v", stats)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestPoolStrategies(t *testing.T) {
+	pool, err := NewProxyPool([]string{"http://fast.example:3128", "http://slow.example:3128"})
+	if err != nil {
+		t.Fatalf("unexpected create proxy pool: %v", err)
+	}
+	defer pool.Close()
+	fast, slow := pool.proxies[0], pool.proxies[1]
+
+	pool.strategy = PoolLeastConn
+	fast.active.Add(2)
+	slow.active.Add(1)
+	if i := pool.choose(pool.proxies); i != 1 {
+		t.Errorf("expected least connections proxy 1, got %d", i)
+	}
+
+	pool.strategy = PoolLatencyWeighted
+	fast.latency, slow.latency = time.Millisecond, time.Second
+	var n int
+	for i := 0; i < 100; i++ {
+		if pool.choose(pool.proxies) == 0 {
+			n++
+		}
+	}
+	if n < 90 {
+		t.Errorf("expected the fast proxy to be chosen most of the time, got %d of 100", n)
+	}
+
+	if _, err := NewProxyPool([]string{"ftp://example.com:21"}); err == nil {
+		t.Errorf("expected error for an unsupported proxy scheme")
+	}
+}
+
+// Test that a proxy is not ejected for targets it cannot reach.
+func TestProxyPoolTargetUnreachable(t *testing.T) {
+	log := make(chan string, 10)
+	unreachable := connectProxy(t, "unreachable", false, func(w http.ResponseWriter, r *http.Request) bool {
+		w.WriteHeader(http.StatusGatewayTimeout)
+		return false
+	}, log)
+	pool, err := NewProxyPool([]string{unreachable.String()}, PoolEjection(1, time.Minute))
+	if err != nil {
+		t.Fatalf("unexpected create proxy pool: %v", err)
+	}
+	defer pool.Close()
+
+	rt, err := NewUTLSRoundTripper(Proxy(pool))
+	if err != nil {
+		t.Fatalf("unexpected create utls round tripper: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := rt.RoundTrip(newRequest(t, "https://"+testHost+":443")); !errors.Is(err, ErrTargetUnreachable) {
+			t.Errorf("expected target unreachable, got %v", err)
+		}
+	}
+	if s := pool.Stats()[0]; s.Failures != 0 || !s.EjectedUntil.IsZero() {
+		t.Errorf("expected proxy not to be ejected, got %+v", s)
+	}
+}
+
+// socks5ReplyServer starts a SOCKS5 proxy without authentication that
+// answers every request with the reply code.
+func socks5ReplyServer(t *testing.T, code byte) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				var head [2]byte
+				if _, err := io.ReadFull(conn, head[:]); err != nil {
+					return
+				}
+				if _, err := io.ReadFull(conn, make([]byte, head[1])); err != nil {
+					return
+				}
+				conn.Write([]byte{5, 0})
+				// The request is read in a single packet.
+				if _, err := conn.Read(make([]byte, 512)); err != nil {
+					return
+				}
+				conn.Write([]byte{5, code, 0, 1, 0, 0, 0, 0, 0, 0})
+			}()
+		}
+	}()
+
+	return ln.Addr().String()
+}
+
+// Test that a SOCKS5 proxy that cannot reach the target is not ejected.
+func TestProxyPoolSOCKS5TargetUnreachable(t *testing.T) {
+	addr := socks5ReplyServer(t, 4)
+	for _, test := range []struct {
+		proxy, target string
+	}{
+		{"socks5h://" + addr, "https://" + testHost + ":443"},
+		{"socks5://" + addr, "https://127.0.0.1:443"},
+	} {
+		pool, err := NewProxyPool([]string{test.proxy}, PoolEjection(1, time.Minute))
+		if err != nil {
+			t.Fatalf("unexpected create proxy pool: %v", err)
+		}
+		defer pool.Close()
+
+		rt, err := NewUTLSRoundTripper(Proxy(pool))
+		if err != nil {
+			t.Fatalf("unexpected create utls round tripper: %v", err)
+		}
+		for i := 0; i < 2; i++ {
+			_, err := rt.RoundTrip(newRequest(t, test.target))
+			if !errors.Is(err, ErrTargetUnreachable) || !errors.Is(err, SOCKS5HostUnreachable) {
+				t.Errorf("expected host unreachable through %s, got %v", test.proxy, err)
+			}
+		}
+		if s := pool.Stats()[0]; s.Failures != 0 || !s.EjectedUntil.IsZero() {
+			t.Errorf("expected %s not to be ejected, got %+v", test.proxy, s)
+		}
+	}
+}
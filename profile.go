@@ -0,0 +1,406 @@
+// Copyright 2023 Wayback Archiver. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package proxier // import "github.com/wabarc/proxier"
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/http2"
+
+	utls "github.com/refraction-networking/utls"
+)
+
+// A BrowserProfile describes how a browser release looks on the wire, so that
+// its TLS, HTTP/2 and HTTP fingerprints can be reproduced together.
+type BrowserProfile struct {
+	// ClientHelloID is the ClientHello sent in TLS handshakes.
+	ClientHelloID *utls.ClientHelloID
+
+	// UserAgent is sent with requests that do not set a User-Agent.
+	UserAgent string
+
+	// Header holds the headers the browser sends when navigating to a
+	// page. They are added to requests that do not set them.
+	Header http.Header
+
+	// HeaderOrder lists header names in the order the browser sends them,
+	// spelled as it does over HTTP/1.1. See HeaderOrderKey.
+	HeaderOrder []string
+
+	// HTTP2 describes the HTTP/2 connection preface of the browser.
+	HTTP2 HTTP2Settings
+}
+
+// apply returns a copy of req with the profile's User-Agent and headers added
+// where req does not set them. It reports whether it asked for a compressed
+// response on the caller's behalf, in which case the response must be
+// decompressed.
+func (p *BrowserProfile) apply(req *http.Request) (*http.Request, bool) {
+	req = req.Clone(req.Context())
+
+	if !hasHeader(req.Header, "User-Agent") && p.UserAgent != "" {
+		req.Header.Set("User-Agent", p.UserAgent)
+	}
+
+	compressed := false
+	for k, vv := range p.Header {
+		if hasHeader(req.Header, k) {
+			continue
+		}
+		if k == "Accept-Encoding" {
+			// Decompressing part of a body is not possible.
+			if req.Header.Get("Range") != "" {
+				continue
+			}
+			compressed = true
+		}
+		req.Header[k] = append([]string(nil), vv...)
+	}
+
+	return req, compressed
+}
+
+// hasHeader reports whether h has the header name, spelled in any case.
+func hasHeader(h http.Header, name string) bool {
+	if _, ok := h[name]; ok {
+		return true
+	}
+	for k := range h {
+		if strings.EqualFold(k, name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+var (
+	profilesMu sync.RWMutex
+	profiles   = make(map[string]*BrowserProfile)
+)
+
+// RegisterProfile makes a browser profile available by name to the Profile
+// option. A profile registered under an existing name replaces it.
+func RegisterProfile(name string, p *BrowserProfile) {
+	profilesMu.Lock()
+	profiles[name] = p
+	profilesMu.Unlock()
+}
+
+// LookupProfile returns the browser profile registered under name. The
+// returned profile is shared and must not be modified. The profiles of this
+// package are of the releases whose ClientHello uTLS reproduces, which for
+// "safari" and "android-okhttp" are only Safari 16 and OkHttp on Android 11.
+func LookupProfile(name string) (*BrowserProfile, bool) {
+	profilesMu.RLock()
+	defer profilesMu.RUnlock()
+
+	p, ok := profiles[name]
+	return p, ok
+}
+
+// Profiles returns the names of the registered browser profiles, sorted.
+func Profiles() []string {
+	profilesMu.RLock()
+	defer profilesMu.RUnlock()
+
+	names := make([]string, 0, len(profiles))
+	for name := range profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// defaultProfile supplies the ClientHello used when no profile is selected.
+var defaultProfile = chrome102
+
+var (
+	chromeAccept = "text/html,application/xhtml+xml,application/xml;q=0.9,image/avif,image/webp,image/apng,*/*;q=0.8,application/signed-exchange;v=b3;q=0.9"
+
+	// Chrome 83 and 87 predate User-Agent client hints.
+	chromeHeaderOrder = []string{
+		"Host", "Connection", "Upgrade-Insecure-Requests", "User-Agent", "Accept",
+		"Sec-Fetch-Site", "Sec-Fetch-Mode", "Sec-Fetch-User", "Sec-Fetch-Dest",
+		"Accept-Encoding", "Accept-Language", "Cookie",
+	}
+	chromeClientHintsHeaderOrder = []string{
+		"Host", "Connection", "sec-ch-ua", "sec-ch-ua-mobile", "sec-ch-ua-platform",
+		"Upgrade-Insecure-Requests", "User-Agent", "Accept",
+		"Sec-Fetch-Site", "Sec-Fetch-Mode", "Sec-Fetch-User", "Sec-Fetch-Dest",
+		"Accept-Encoding", "Accept-Language", "Cookie",
+	}
+
+	chromeHTTP2 = HTTP2Settings{
+		Settings: []http2.Setting{
+			{ID: http2.SettingHeaderTableSize, Val: 65536},
+			{ID: http2.SettingMaxConcurrentStreams, Val: 1000},
+			{ID: http2.SettingInitialWindowSize, Val: 6291456},
+			{ID: http2.SettingMaxHeaderListSize, Val: 262144},
+		},
+		ConnectionFlow:    15663105,
+		HeaderPriority:    &http2.PriorityParam{Exclusive: true, Weight: 255},
+		PseudoHeaderOrder: []string{":method", ":authority", ":scheme", ":path"},
+	}
+	// Chrome 106 stopped limiting concurrent streams and turned off
+	// server push instead.
+	chrome106HTTP2 = HTTP2Settings{
+		Settings: []http2.Setting{
+			{ID: http2.SettingHeaderTableSize, Val: 65536},
+			{ID: http2.SettingEnablePush, Val: 0},
+			{ID: http2.SettingInitialWindowSize, Val: 6291456},
+			{ID: http2.SettingMaxHeaderListSize, Val: 262144},
+		},
+		ConnectionFlow:    15663105,
+		HeaderPriority:    &http2.PriorityParam{Exclusive: true, Weight: 255},
+		PseudoHeaderOrder: []string{":method", ":authority", ":scheme", ":path"},
+	}
+
+	firefoxAccept = "text/html,application/xhtml+xml,application/xml;q=0.9,image/avif,image/webp,*/*;q=0.8"
+
+	// Firefox 90 added Sec-Fetch headers.
+	firefoxLegacyHeaderOrder = []string{
+		"Host", "User-Agent", "Accept", "Accept-Language", "Accept-Encoding",
+		"Connection", "Cookie", "Upgrade-Insecure-Requests",
+	}
+	firefoxHeaderOrder = []string{
+		"Host", "User-Agent", "Accept", "Accept-Language", "Accept-Encoding",
+		"Connection", "Cookie", "Upgrade-Insecure-Requests",
+		"Sec-Fetch-Dest", "Sec-Fetch-Mode", "Sec-Fetch-Site", "Sec-Fetch-User",
+	}
+
+	firefoxHTTP2 = HTTP2Settings{
+		Settings: []http2.Setting{
+			{ID: http2.SettingHeaderTableSize, Val: 65536},
+			{ID: http2.SettingInitialWindowSize, Val: 131072},
+			{ID: http2.SettingMaxFrameSize, Val: 16384},
+		},
+		ConnectionFlow: 12517377,
+		// Firefox builds a tree of idle streams to group requests by
+		// priority.
+		Priorities: []HTTP2Priority{
+			{StreamID: 3, Param: http2.PriorityParam{Weight: 200}},
+			{StreamID: 5, Param: http2.PriorityParam{Weight: 100}},
+			{StreamID: 7, Param: http2.PriorityParam{Weight: 0}},
+			{StreamID: 9, Param: http2.PriorityParam{StreamDep: 7, Weight: 0}},
+			{StreamID: 11, Param: http2.PriorityParam{StreamDep: 3, Weight: 0}},
+			{StreamID: 13, Param: http2.PriorityParam{Weight: 240}},
+		},
+		HeaderPriority:    &http2.PriorityParam{StreamDep: 13, Weight: 41},
+		PseudoHeaderOrder: []string{":method", ":path", ":authority", ":scheme"},
+	}
+
+	safariAccept = "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8"
+
+	safariHeaderOrder = []string{
+		"Host", "Accept", "User-Agent", "Accept-Language", "Accept-Encoding",
+		"Connection", "Cookie",
+	}
+
+	safariHTTP2 = HTTP2Settings{
+		Settings: []http2.Setting{
+			{ID: http2.SettingInitialWindowSize, Val: 4194304},
+			{ID: http2.SettingMaxConcurrentStreams, Val: 100},
+		},
+		ConnectionFlow:    10485760,
+		HeaderPriority:    &http2.PriorityParam{Weight: 254},
+		PseudoHeaderOrder: []string{":method", ":scheme", ":path", ":authority"},
+	}
+	iosSafariHTTP2 = HTTP2Settings{
+		Settings: []http2.Setting{
+			{ID: http2.SettingInitialWindowSize, Val: 2097152},
+			{ID: http2.SettingMaxConcurrentStreams, Val: 100},
+		},
+		ConnectionFlow:    10485760,
+		HeaderPriority:    &http2.PriorityParam{Weight: 254},
+		PseudoHeaderOrder: []string{":method", ":scheme", ":path", ":authority"},
+	}
+)
+
+func chromeProfile(id *utls.ClientHelloID, userAgent, secCHUA string) *BrowserProfile {
+	p := &BrowserProfile{
+		ClientHelloID: id,
+		UserAgent:     userAgent,
+		Header: http.Header{
+			"Connection":                {"keep-alive"},
+			"Upgrade-Insecure-Requests": {"1"},
+			"Accept":                    {chromeAccept},
+			"Sec-Fetch-Site":            {"none"},
+			"Sec-Fetch-Mode":            {"navigate"},
+			"Sec-Fetch-User":            {"?1"},
+			"Sec-Fetch-Dest":            {"document"},
+			"Accept-Encoding":           {"gzip, deflate, br"},
+			"Accept-Language":           {"en-US,en;q=0.9"},
+		},
+		HeaderOrder: chromeHeaderOrder,
+		HTTP2:       chromeHTTP2,
+	}
+	if secCHUA != "" {
+		p.Header["Sec-Ch-Ua"] = []string{secCHUA}
+		p.Header["Sec-Ch-Ua-Mobile"] = []string{"?0"}
+		p.Header["Sec-Ch-Ua-Platform"] = []string{`"Windows"`}
+		p.HeaderOrder = chromeClientHintsHeaderOrder
+	}
+
+	return p
+}
+
+func firefoxProfile(id *utls.ClientHelloID, version string) *BrowserProfile {
+	p := &BrowserProfile{
+		ClientHelloID: id,
+		UserAgent:     "Mozilla/5.0 (Windows NT 10.0; Win64; x64; rv:" + version + ") Gecko/20100101 Firefox/" + version,
+		Header: http.Header{
+			"Accept":                    {firefoxAccept},
+			"Accept-Language":           {"en-US,en;q=0.5"},
+			"Accept-Encoding":           {"gzip, deflate, br"},
+			"Connection":                {"keep-alive"},
+			"Upgrade-Insecure-Requests": {"1"},
+			"Sec-Fetch-Dest":            {"document"},
+			"Sec-Fetch-Mode":            {"navigate"},
+			"Sec-Fetch-Site":            {"none"},
+			"Sec-Fetch-User":            {"?1"},
+		},
+		HeaderOrder: firefoxHeaderOrder,
+		HTTP2:       firefoxHTTP2,
+	}
+
+	return p
+}
+
+func safariProfile(id *utls.ClientHelloID, userAgent string, h2 HTTP2Settings) *BrowserProfile {
+	return &BrowserProfile{
+		ClientHelloID: id,
+		UserAgent:     userAgent,
+		Header: http.Header{
+			"Accept":          {safariAccept},
+			"Accept-Language": {"en-US,en;q=0.9"},
+			"Accept-Encoding": {"gzip, deflate, br"},
+			"Connection":      {"keep-alive"},
+		},
+		HeaderOrder: safariHeaderOrder,
+		HTTP2:       h2,
+	}
+}
+
+var (
+	chrome83 = func() *BrowserProfile {
+		p := chromeProfile(&utls.HelloChrome_83,
+			"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/83.0.4103.116 Safari/537.36", "")
+		// AVIF support came in Chrome 85.
+		p.Header.Set("Accept", "text/html,application/xhtml+xml,application/xml;q=0.9,image/webp,image/apng,*/*;q=0.8,application/signed-exchange;v=b3;q=0.9")
+		return p
+	}()
+	chrome87 = chromeProfile(&utls.HelloChrome_87,
+		"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/87.0.4280.88 Safari/537.36", "")
+	chrome96 = chromeProfile(&utls.HelloChrome_96,
+		"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/96.0.4664.110 Safari/537.36",
+		`" Not A;Brand";v="99", "Chromium";v="96", "Google Chrome";v="96"`)
+	chrome100 = chromeProfile(&utls.HelloChrome_100,
+		"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/100.0.4896.127 Safari/537.36",
+		`" Not A;Brand";v="99", "Chromium";v="100", "Google Chrome";v="100"`)
+	chrome102 = chromeProfile(&utls.HelloChrome_102,
+		"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/102.0.5005.61 Safari/537.36",
+		`" Not A;Brand";v="99", "Chromium";v="102", "Google Chrome";v="102"`)
+	chrome106 = func() *BrowserProfile {
+		p := chromeProfile(&utls.HelloChrome_106_Shuffle,
+			"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/106.0.0.0 Safari/537.36",
+			`"Chromium";v="106", "Google Chrome";v="106", "Not;A=Brand";v="99"`)
+		p.HTTP2 = chrome106HTTP2
+		return p
+	}()
+
+	edge85 = chromeProfile(&utls.HelloEdge_85,
+		"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/85.0.4183.102 Safari/537.36 Edg/85.0.564.51", "")
+	edge106 = func() *BrowserProfile {
+		p := chromeProfile(&utls.HelloEdge_106,
+			"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/106.0.0.0 Safari/537.36 Edg/106.0.1370.47",
+			`"Chromium";v="106", "Microsoft Edge";v="106", "Not;A=Brand";v="99"`)
+		p.HTTP2 = chrome106HTTP2
+		return p
+	}()
+
+	firefox63 = func() *BrowserProfile {
+		p := firefoxProfile(&utls.HelloFirefox_63, "63.0")
+		p.Header = http.Header{
+			"Accept":                    {"text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8"},
+			"Accept-Language":           {"en-US,en;q=0.5"},
+			"Accept-Encoding":           {"gzip, deflate, br"},
+			"Connection":                {"keep-alive"},
+			"Upgrade-Insecure-Requests": {"1"},
+		}
+		p.HeaderOrder = firefoxLegacyHeaderOrder
+		return p
+	}()
+	firefox65 = func() *BrowserProfile {
+		p := firefoxProfile(&utls.HelloFirefox_65, "65.0")
+		p.Header = firefox63.Header
+		p.HeaderOrder = firefoxLegacyHeaderOrder
+		return p
+	}()
+	firefox99  = firefoxProfile(&utls.HelloFirefox_99, "99.0")
+	firefox102 = firefoxProfile(&utls.HelloFirefox_102, "102.0")
+	firefox105 = firefoxProfile(&utls.HelloFirefox_105, "105.0")
+
+	safari16 = safariProfile(&utls.HelloSafari_16_0,
+		"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/16.0 Safari/605.1.15",
+		safariHTTP2)
+
+	iosSafari12 = safariProfile(&utls.HelloIOS_12_1,
+		"Mozilla/5.0 (iPhone; CPU iPhone OS 12_1 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/12.0 Mobile/15E148 Safari/604.1",
+		iosSafariHTTP2)
+	iosSafari13 = safariProfile(&utls.HelloIOS_13,
+		"Mozilla/5.0 (iPhone; CPU iPhone OS 13_7 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/13.1.2 Mobile/15E148 Safari/604.1",
+		iosSafariHTTP2)
+	iosSafari14 = safariProfile(&utls.HelloIOS_14,
+		"Mozilla/5.0 (iPhone; CPU iPhone OS 14_8 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/14.1.2 Mobile/15E148 Safari/604.1",
+		iosSafariHTTP2)
+
+	// The OkHttp ClientHello does not offer ALPN, so connections always
+	// use HTTP/1.1.
+	androidOkHttp11 = &BrowserProfile{
+		ClientHelloID: &utls.HelloAndroid_11_OkHttp,
+		UserAgent:     "okhttp/4.9.3",
+		Header: http.Header{
+			"Connection":      {"Keep-Alive"},
+			"Accept-Encoding": {"gzip"},
+		},
+		HeaderOrder: []string{"Host", "Connection", "Accept-Encoding", "Cookie", "User-Agent"},
+	}
+)
+
+func init() {
+	for name, p := range map[string]*BrowserProfile{
+		"chrome-83":         chrome83,
+		"chrome-87":         chrome87,
+		"chrome-96":         chrome96,
+		"chrome-100":        chrome100,
+		"chrome-102":        chrome102,
+		"chrome-106":        chrome106,
+		"chrome":            chrome106,
+		"edge-85":           edge85,
+		"edge-106":          edge106,
+		"edge":              edge106,
+		"firefox-63":        firefox63,
+		"firefox-65":        firefox65,
+		"firefox-99":        firefox99,
+		"firefox-102":       firefox102,
+		"firefox-105":       firefox105,
+		"firefox":           firefox105,
+		"safari-16":         safari16,
+		"safari":            safari16,
+		"ios-safari-12":     iosSafari12,
+		"ios-safari-13":     iosSafari13,
+		"ios-safari-14":     iosSafari14,
+		"ios-safari":        iosSafari14,
+		"android-okhttp-11": androidOkHttp11,
+		"android-okhttp":    androidOkHttp11,
+	} {
+		RegisterProfile(name, p)
+	}
+}
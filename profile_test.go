@@ -0,0 +1,139 @@
+// Copyright 2023 Wayback Archiver. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package proxier // import "github.com/wabarc/proxier"
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	utls "github.com/refraction-networking/utls"
+)
+
+// gzipHandler replies with a gzip-compressed body if the request accepts it,
+// and echoes the request's User-Agent and Accept headers.
+func gzipHandler(body string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-User-Agent", r.UserAgent())
+		w.Header().Set("X-Accept", r.Header.Get("Accept"))
+		if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			io.WriteString(w, body)
+			return
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+		zw := gzip.NewWriter(w)
+		io.WriteString(zw, body)
+		zw.Close()
+	})
+}
+
+// Test that every registered profile can talk to a server, sending its
+// headers and decoding the compressed response it asked for.
+func TestProfiles(t *testing.T) {
+	server := httptest.NewUnstartedServer(gzipHandler("hello"))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+
+	for _, name := range Profiles() {
+		p, _ := LookupProfile(name)
+		rt, err := NewUTLSRoundTripper(Profile(name), Config(&utls.Config{InsecureSkipVerify: true}))
+		if err != nil {
+			t.Fatalf("unexpected create utls round tripper: %v", err)
+		}
+		client := &http.Client{Transport: rt}
+
+		resp, err := client.Get(server.URL)
+		if err != nil {
+			t.Fatalf("unexpected request with profile %s: %v", name, err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("unexpected read body with profile %s: %v", name, err)
+		}
+		if string(body) != "hello" {
+			t.Errorf("expected decoded body with profile %s, got %q", name, body)
+		}
+		if p.HTTP2.Settings != nil && resp.ProtoMajor != 2 {
+			t.Errorf("expected HTTP/2 with profile %s, got %s", name, resp.Proto)
+		}
+		if got := resp.Header.Get("X-User-Agent"); got != p.UserAgent {
+			t.Errorf("expected User-Agent %q with profile %s, got %q", p.UserAgent, name, got)
+		}
+		if got := resp.Header.Get("X-Accept"); got != p.Header.Get("Accept") {
+			t.Errorf("expected Accept %q with profile %s, got %q", p.Header.Get("Accept"), name, got)
+		}
+		client.CloseIdleConnections()
+	}
+}
+
+// Test that headers set on a request take precedence over the profile's, and
+// that a response is left compressed if the caller asked for compression.
+func TestProfileRequestHeaders(t *testing.T) {
+	for _, server := range []*httptest.Server{
+		httptest.NewServer(gzipHandler("hello")),
+		httptest.NewTLSServer(gzipHandler("hello")),
+	} {
+		defer server.Close()
+
+		rt, err := NewUTLSRoundTripper(Profile("firefox"), Config(&utls.Config{InsecureSkipVerify: true}))
+		if err != nil {
+			t.Fatalf("unexpected create utls round tripper: %v", err)
+		}
+		req, err := http.NewRequest("GET", server.URL, nil)
+		if err != nil {
+			t.Fatalf("unexpected create request: %v", err)
+		}
+		req.Header.Set("User-Agent", "test")
+		req.Header.Set("Accept-Encoding", "gzip")
+
+		resp, err := rt.RoundTrip(req)
+		if err != nil {
+			t.Fatalf("unexpected request: %v", err)
+		}
+		resp.Body.Close()
+		if got := resp.Header.Get("X-User-Agent"); got != "test" {
+			t.Errorf("expected User-Agent %q, got %q", "test", got)
+		}
+		if got := resp.Header.Get("X-Accept"); got != firefox105.Header.Get("Accept") {
+			t.Errorf("expected Accept %q, got %q", firefox105.Header.Get("Accept"), got)
+		}
+		if got := resp.Header.Get("Content-Encoding"); got != "gzip" {
+			t.Errorf("expected compressed response, got Content-Encoding %q", got)
+		}
+		if len(req.Header) != 2 {
+			t.Errorf("expected request headers to be left untouched, got %v", req.Header)
+		}
+	}
+}
+
+func TestProfileUnknown(t *testing.T) {
+	if _, err := NewUTLSRoundTripper(Profile("netscape")); err == nil {
+		t.Fatal("expected error for unknown profile")
+	}
+}
+
+// Test that requests without a profile have the default User-Agent.
+func TestDefaultUserAgent(t *testing.T) {
+	server := httptest.NewTLSServer(gzipHandler("hello"))
+	defer server.Close()
+
+	rt, err := NewUTLSRoundTripper(Config(&utls.Config{InsecureSkipVerify: true}))
+	if err != nil {
+		t.Fatalf("unexpected create utls round tripper: %v", err)
+	}
+	resp, err := rt.RoundTrip(newRequest(t, server.URL))
+	if err != nil {
+		t.Fatalf("unexpected request: %v", err)
+	}
+	resp.Body.Close()
+	if got := resp.Header.Get("X-User-Agent"); got != useragent {
+		t.Errorf("expected User-Agent %q, got %q", useragent, got)
+	}
+}
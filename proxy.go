@@ -6,11 +6,15 @@ package proxier // import "github.com/wabarc/proxier"
 
 import (
 	"bufio"
-	"encoding/base64"
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"net/url"
+	"time"
 
 	"golang.org/x/net/proxy"
 
@@ -18,38 +22,152 @@ import (
 )
 
 // https://tools.ietf.org/html/rfc7231#section-4.3.6
-// Conceivably we could also proxy over HTTP/2:
-// https://httpwg.org/specs/rfc7540.html#CONNECT
+// HTTPS proxies that negotiate HTTP/2 are sent CONNECT requests as streams of
+// one connection, see h2proxy.go.
 // https://github.com/caddyserver/forwardproxy/blob/05b2092e07f9d10b3803d8fb9775d2f87dc58590/httpclient/httpclient.go
 
 type httpProxy struct {
 	network, addr string
-	auth          *proxy.Auth
+	auth          *proxyAuth
 	forward       proxy.Dialer
+
+	// Bounds the CONNECT exchange, if positive.
+	timeout time.Duration
+
+	// The URL of the proxy, passed to the functions below.
+	proxyURL *url.URL
+	// Headers added to CONNECT requests. getHeader takes precedence over
+	// header if set.
+	header    http.Header
+	getHeader func(ctx context.Context, proxyURL *url.URL, target string) (http.Header, error)
+	// Called with every CONNECT response, if set.
+	onResponse func(ctx context.Context, proxyURL *url.URL, connectReq *http.Request, connectRes *http.Response) error
+
+	// HTTP/2 connections to an HTTPS proxy, if it negotiates HTTP/2.
+	h2 *h2Conns
 }
 
 func (pr *httpProxy) Dial(network, addr string) (net.Conn, error) {
+	return pr.DialContext(context.Background(), network, addr)
+}
+
+func (pr *httpProxy) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
 	connectReq := &http.Request{
 		Method: "CONNECT",
 		URL:    &url.URL{Opaque: addr},
 		Host:   addr,
-		Header: make(http.Header),
+		Header: pr.header.Clone(),
+	}
+	if pr.getHeader != nil {
+		header, err := pr.getHeader(ctx, pr.proxyURL, addr)
+		if err != nil {
+			return nil, err
+		}
+		connectReq.Header = header.Clone()
 	}
-	// http.Transport has a ProxyConnectHeader field that we are ignoring
-	// here.
-	if pr.auth != nil {
-		connectReq.Header.Set("Proxy-Authorization", "basic "+
-			base64.StdEncoding.EncodeToString([]byte(pr.auth.User+":"+pr.auth.Password)))
+	if connectReq.Header == nil {
+		connectReq.Header = make(http.Header)
+	}
+	pr.auth.preempt(connectReq)
+
+	connectCtx := ctx
+	if pr.timeout > 0 {
+		var cancel context.CancelFunc
+		connectCtx, cancel = context.WithTimeout(ctx, pr.timeout)
+		defer cancel()
 	}
 
-	conn, err := pr.forward.Dial(pr.network, pr.addr)
+	// An HTTP/1.1 connection to the proxy, kept to answer a challenge.
+	var conn net.Conn
+	for attempt := 1; ; attempt++ {
+		var cc *h2Conn
+		if conn == nil {
+			var err error
+			if conn, cc, err = pr.dialProxy(ctx); err != nil {
+				return nil, err
+			}
+		}
+
+		var tunnel net.Conn
+		var resp *http.Response
+		var err error
+		if cc != nil {
+			tunnel, resp, err = pr.connectH2(ctx, connectCtx, cc, connectReq)
+		} else {
+			stop := watchContext(connectCtx, conn)
+			resp, err = pr.connect(conn, connectReq)
+			if cerr := stop(); cerr != nil {
+				err = cerr
+			}
+			tunnel = conn
+		}
+		var connectErr *ConnectError
+		if err == nil && resp.StatusCode != http.StatusOK {
+			connectErr = newConnectError(resp)
+		}
+		if err == nil && pr.onResponse != nil {
+			err = pr.onResponse(ctx, pr.proxyURL, connectReq, resp)
+		}
+		if err == nil && connectErr != nil {
+			err = connectErr
+			// Answer the proxy's challenge, and try again.
+			if resp.StatusCode == http.StatusProxyAuthRequired && attempt < maxAuthAttempts &&
+				pr.auth.answer(resp, connectReq) == nil {
+				if resp.Close && conn != nil {
+					conn.Close()
+					conn = nil
+				}
+				continue
+			}
+		}
+		if err != nil {
+			if tunnel != nil {
+				tunnel.Close()
+			}
+			return nil, err
+		}
+
+		return tunnel, nil
+	}
+}
+
+// dialProxy returns an HTTP/2 connection to the proxy that can take another
+// stream if there is one, or else dials the proxy. A new connection that
+// negotiated HTTP/2 is returned as such.
+func (pr *httpProxy) dialProxy(ctx context.Context) (net.Conn, *h2Conn, error) {
+	if pr.h2 != nil {
+		if cc := pr.h2.get(); cc != nil {
+			return nil, cc, nil
+		}
+	}
+	conn, err := dialContext(ctx, pr.forward, pr.network, pr.addr)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
+	if pr.h2 != nil {
+		cc, err := pr.h2.add(conn)
+		if err != nil {
+			conn.Close()
+			return nil, nil, err
+		}
+		if cc != nil {
+			return nil, cc, nil
+		}
+	}
+
+	return conn, nil, nil
+}
+
+// Bodies of CONNECT responses are read up to this size, to reuse the
+// connection for another CONNECT request.
+const maxConnectBodyLen = 64 << 10
 
-	err = connectReq.Write(conn)
+// connect sends connectReq over conn and reads the proxy's response. The body
+// of a response other than 200 is read, as by readConnectBody, and its Close
+// field is set if conn cannot be used again.
+func (pr *httpProxy) connect(conn net.Conn, connectReq *http.Request) (*http.Response, error) {
+	err := connectReq.Write(conn)
 	if err != nil {
-		conn.Close()
 		return nil, err
 	}
 
@@ -58,25 +176,54 @@ func (pr *httpProxy) Dial(network, addr string) (net.Conn, error) {
 	br := bufio.NewReader(conn)
 	resp, err := http.ReadResponse(br, connectReq)
 	if err != nil {
-		conn.Close()
 		return nil, err
 	}
+	if resp.StatusCode != http.StatusOK {
+		if !readConnectBody(resp) || br.Buffered() != 0 {
+			resp.Close = true
+		}
+		return resp, nil
+	}
 	if br.Buffered() != 0 {
 		return nil, fmt.Errorf("response buffered: %d", br.Buffered())
 	}
-	if resp.StatusCode != 200 {
-		conn.Close()
-		return nil, fmt.Errorf("proxy server returned %q", resp.Status)
+
+	return resp, nil
+}
+
+// readConnectBody reads the body of resp, a response to a CONNECT request,
+// up to maxConnectBodyLen, and replaces it with what was read. It reports
+// whether the whole body was read.
+func readConnectBody(resp *http.Response) bool {
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxConnectBodyLen+1))
+	complete := err == nil && len(body) <= maxConnectBodyLen
+	if len(body) > maxConnectBodyLen {
+		body = body[:maxConnectBodyLen]
 	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
 
-	return conn, nil
+	return complete
+}
+
+// newConnectError returns the error of resp, a response to a CONNECT request
+// whose body was read by readConnectBody.
+func newConnectError(resp *http.Response) *ConnectError {
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+
+	return &ConnectError{
+		StatusCode: resp.StatusCode,
+		Status:     resp.Status,
+		Header:     resp.Header,
+		Body:       body,
+	}
 }
 
 func ProxyHTTP(network, addr string, auth *proxy.Auth, forward proxy.Dialer) (*httpProxy, error) {
 	return &httpProxy{
 		network: network,
 		addr:    addr,
-		auth:    auth,
+		auth:    newProxyAuth(auth, nil),
 		forward: forward,
 	}, nil
 }
@@ -85,17 +232,36 @@ type UTLSDialer struct {
 	config        *utls.Config
 	clientHelloID *utls.ClientHelloID
 	forward       proxy.Dialer
+
+	// Returns a fresh custom ClientHelloSpec for each connection. If
+	// set, it takes precedence over clientHelloID.
+	clientHelloSpec func() *utls.ClientHelloSpec
+
+	// Chooses the ClientHelloID of each connection, if set.
+	selector HelloSelector
+	// Called with the ClientHelloID of each established connection, if set.
+	onHello func(addr string, id utls.ClientHelloID)
+
+	// Bounds the TLS handshake, if positive.
+	handshakeTimeout time.Duration
+
+	// Replaces the ALPN protocols offered, if set.
+	alpn []string
 }
 
 func (dialer *UTLSDialer) Dial(network, addr string) (net.Conn, error) {
-	return dialUTLS(network, addr, dialer.config, dialer.clientHelloID, dialer.forward)
+	return dialer.DialContext(context.Background(), network, addr)
+}
+
+func (dialer *UTLSDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return dialer.dialUTLS(ctx, network, addr)
 }
 
 func ProxyHTTPS(network, addr string, auth *proxy.Auth, forward proxy.Dialer, cfg *utls.Config, clientHelloID *utls.ClientHelloID) (*httpProxy, error) {
 	return &httpProxy{
 		network: network,
 		addr:    addr,
-		auth:    auth,
+		auth:    newProxyAuth(auth, nil),
 		forward: &UTLSDialer{
 			config: cfg,
 			// We use the same uTLS ClientHelloID for the TLS
@@ -104,6 +270,7 @@ func ProxyHTTPS(network, addr string, auth *proxy.Auth, forward proxy.Dialer, cf
 			clientHelloID: clientHelloID,
 			forward:       forward,
 		},
+		h2: newH2Conns(http2Timeouts{}),
 	}, nil
 }
 
@@ -120,21 +287,74 @@ func addrForDial(url *url.URL) (string, error) {
 			port = "80"
 		case "https":
 			port = "443"
+		case "ssh":
+			port = "22"
 		default:
-			return "", fmt.Errorf("unsupported URL scheme %q", url.Scheme)
+			return "", &UnsupportedSchemeError{Scheme: url.Scheme}
 		}
 	}
 	return net.JoinHostPort(host, port), nil
 }
 
-// Analogous to tls.Dial. Connect to the given address and initiate a TLS
-// handshake using the given ClientHelloID, returning the resulting connection.
-func dialUTLS(network, addr string, cfg *utls.Config, clientHelloID *utls.ClientHelloID, forward proxy.Dialer) (*utls.UConn, error) {
-	conn, err := forward.Dial(network, addr)
+// Analogous to tls.Dialer.DialContext. Connect to the given address and
+// initiate a TLS handshake using the dialer's ClientHelloID or
+// ClientHelloSpec, returning the resulting connection. Cancelling ctx aborts
+// both the dial and the handshake.
+func (dialer *UTLSDialer) dialUTLS(ctx context.Context, network, addr string) (*utls.UConn, error) {
+	conn, err := dialContext(ctx, dialer.forward, network, addr)
 	if err != nil {
 		return nil, err
 	}
-	uconn := utls.UClient(conn, cfg, *clientHelloID)
+	id := dialer.clientHelloID
+	if dialer.selector != nil {
+		if selected := dialer.selector.SelectHello(addr); selected != nil {
+			id = selected
+		}
+	}
+	uconn, err := dialer.uclient(conn, addr, id)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if dialer.handshakeTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, dialer.handshakeTimeout)
+		defer cancel()
+	}
+	if err = uconn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, newTLSHandshakeError(addr, err)
+	}
+	if dialer.onHello != nil {
+		dialer.onHello(addr, uconn.ClientHelloID)
+	}
+	return uconn, nil
+}
+
+// uclient returns a uTLS client over conn, set up to send the ClientHello id,
+// or the dialer's ClientHelloSpec, to addr.
+func (dialer *UTLSDialer) uclient(conn net.Conn, addr string, id *utls.ClientHelloID) (*utls.UConn, error) {
+	// uTLS modifies the Config of a connection, setting its curves and
+	// server name, so each connection gets its own copy.
+	cfg := dialer.config
+	if cfg != nil {
+		cfg = cfg.Clone()
+	}
+	if dialer.alpn != nil {
+		if cfg == nil {
+			cfg = &utls.Config{}
+		}
+		cfg.NextProtos = dialer.alpn
+	}
+	var uconn *utls.UConn
+	if dialer.clientHelloSpec != nil {
+		uconn = utls.UClient(conn, cfg, utls.HelloCustom)
+		if err := uconn.ApplyPreset(dialer.clientHelloSpec()); err != nil {
+			return nil, err
+		}
+	} else {
+		uconn = utls.UClient(conn, cfg, *id)
+	}
 	if cfg == nil || cfg.ServerName == "" {
 		serverName, _, err := net.SplitHostPort(addr)
 		if err != nil {
@@ -142,70 +362,427 @@ func dialUTLS(network, addr string, cfg *utls.Config, clientHelloID *utls.Client
 		}
 		uconn.SetSNI(serverName)
 	}
-	if err = uconn.Handshake(); err != nil {
-		return nil, err
+	if dialer.alpn != nil {
+		// The ALPN extension of a ClientHello takes precedence over
+		// the config.
+		if err := uconn.BuildHandshakeState(); err != nil {
+			return nil, err
+		}
+		for _, ext := range uconn.Extensions {
+			if ext, ok := ext.(*utls.ALPNExtension); ok {
+				ext.AlpnProtocols = dialer.alpn
+			}
+		}
+		if err := uconn.ApplyConfig(); err != nil {
+			return nil, err
+		}
+		if err := uconn.MarshalClientHello(); err != nil {
+			return nil, err
+		}
 	}
 	return uconn, nil
 }
 
-func makeProxyDialer(p interface{}, cfg *utls.Config, clientHelloID *utls.ClientHelloID) (proxy.Dialer, *url.URL, error) {
-	var (
-		err         error
-		proxyURL    *url.URL
-		proxyDialer proxy.Dialer = proxy.Direct
-	)
+// dialContext connects to addr using d, through its DialContext method if it
+// implements proxy.ContextDialer. Otherwise the dial runs in the background
+// and is abandoned, and its connection closed, when ctx is done.
+func dialContext(ctx context.Context, d proxy.Dialer, network, addr string) (net.Conn, error) {
+	if d, ok := d.(proxy.ContextDialer); ok {
+		return d.DialContext(ctx, network, addr)
+	}
+
+	type dialResult struct {
+		conn net.Conn
+		err  error
+	}
+	results := make(chan dialResult)
+	go func() {
+		conn, err := d.Dial(network, addr)
+		select {
+		case results <- dialResult{conn, err}:
+		case <-ctx.Done():
+			// Nobody is waiting for conn.
+			if err == nil {
+				conn.Close()
+			}
+		}
+	}()
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case r := <-results:
+		return r.conn, r.err
+	}
+}
+
+// A pipeTunnel is a connection through a stream of a proxy protocol.
+type pipeTunnel struct {
+	net.Conn
+	local, remote net.Addr
+}
+
+// newPipeTunnel returns a connection with the addresses local and remote that
+// reads from r and writes to w, and calls closeWrite once closed.
+func newPipeTunnel(r io.Reader, w io.Writer, closeWrite func(), local, remote net.Addr) *pipeTunnel {
+	// Streams have no deadlines, which net.Pipe provides.
+	c1, c2 := net.Pipe()
+	go func() {
+		io.Copy(w, c2)
+		closeWrite()
+	}()
+	go func() {
+		io.Copy(c2, r)
+		c2.Close()
+	}()
+
+	return &pipeTunnel{Conn: c1, local: local, remote: remote}
+}
+
+func (t *pipeTunnel) LocalAddr() net.Addr { return t.local }
+
+func (t *pipeTunnel) RemoteAddr() net.Addr { return t.remote }
+
+// aLongTimeAgo is a non-zero time, far in the past, used for immediate
+// cancellation of I/O.
+var aLongTimeAgo = time.Unix(1, 0)
+
+// watchContext makes blocking I/O on conn honour ctx: it applies ctx's
+// deadline, and interrupts pending reads and writes when ctx is done. The
+// returned function stops watching and clears the deadline; it returns ctx's
+// error if conn was interrupted, in which case conn is no longer usable.
+func watchContext(ctx context.Context, conn net.Conn) (stop func() error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	done := make(chan struct{})
+	interrupted := make(chan error, 1)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(aLongTimeAgo)
+			interrupted <- ctx.Err()
+		case <-done:
+			interrupted <- nil
+		}
+	}()
+
+	return func() error {
+		close(done)
+		if err := <-interrupted; err != nil {
+			return err
+		}
+		// The deadline may have fired before the watcher, or even
+		// ctx, noticed.
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if deadline, ok := ctx.Deadline(); ok && !time.Now().Before(deadline) {
+			return context.DeadlineExceeded
+		}
+		conn.SetDeadline(time.Time{})
+		return nil
+	}
+}
+
+// A ProxyHop is a proxy in a chain given to the Proxy option, with its own
+// TLS settings. Its credentials are those of its URL.
+type ProxyHop struct {
+	URL *url.URL
+
+	// Auth answers the authentication challenges of an http or https
+	// proxy, in order of preference. It defaults to that of the ProxyAuth
+	// option.
+	Auth []ProxyAuthenticator
 
+	// Config is the uTLS config for an https proxy. It defaults to that
+	// of the Config option.
+	Config *utls.Config
+	// ClientHello is sent to an https proxy. It defaults to that of the
+	// ClientHelloSpec or ClientHello option.
+	ClientHello *utls.ClientHelloID
+}
+
+// proxyHops returns the proxies given to the Proxy option, in the order
+// connections go through them.
+func proxyHops(p interface{}) ([]ProxyHop, error) {
+	var hops []ProxyHop
 	switch v := p.(type) {
 	case string:
-		proxyURL, err = url.Parse(v)
-		if err != nil {
-			return proxyDialer, nil, err
+		return proxyHops([]string{v})
+	case []string:
+		for _, s := range v {
+			proxyURL, err := url.Parse(s)
+			if err != nil {
+				return nil, err
+			}
+			hops = append(hops, ProxyHop{URL: proxyURL})
 		}
 	case *url.URL:
-		proxyURL = v
-	case net.Dialer:
-		uri := v.LocalAddr.String()
-		proxyURL, err = url.Parse(uri)
-		if err != nil {
-			return proxyDialer, nil, err
+		hops = []ProxyHop{{URL: v}}
+	case []*url.URL:
+		for _, proxyURL := range v {
+			hops = append(hops, ProxyHop{URL: proxyURL})
 		}
-	default:
-		return proxyDialer, proxyURL, nil
+	case ProxyHop:
+		hops = []ProxyHop{v}
+	case []ProxyHop:
+		hops = v
 	}
+	for _, hop := range hops {
+		if hop.URL == nil {
+			return nil, fmt.Errorf("missing proxy URL")
+		}
+	}
+
+	return hops, nil
+}
 
-	proxyAddr, err := addrForDial(proxyURL)
+// makeProxyDialer returns a dialer that connects through the proxies given to
+// the Proxy option, each hop tunnelling through the previous one, along with
+// those proxies.
+func makeProxyDialer(u UTLS) (proxy.Dialer, []ProxyHop, error) {
+	hops, err := proxyHops(u.proxy)
 	if err != nil {
-		return nil, proxyURL, err
+		return nil, nil, err
 	}
+	proxyDialer, err := u.chainDialer(hops)
 
-	var auth *proxy.Auth
-	if userpass := proxyURL.User; userpass != nil {
-		auth = &proxy.Auth{
-			User: userpass.Username(),
-		}
-		if password, ok := userpass.Password(); ok {
-			auth.Password = password
+	return proxyDialer, hops, err
+}
+
+// A proxyFailDialer dials through a proxy of a chain, returning errors in a
+// ProxyDialError, unless a proxy before it failed. It reports to the pool of
+// the proxy, if any, the failures of the proxy, but not those of a proxy
+// before it, nor the targets the proxy says it cannot reach.
+type proxyFailDialer struct {
+	proxy.Dialer
+	hop   int
+	proxy *url.URL
+
+	pool *ProxyPool
+	e    *poolProxy
+}
+
+// failDialer returns a proxyFailDialer of d, which dials through hop, the
+// proxy at position n of the chain.
+func (u UTLS) failDialer(d proxy.Dialer, hop ProxyHop, n int) *proxyFailDialer {
+	return &proxyFailDialer{Dialer: d, hop: n, proxy: hop.URL, pool: u.pool, e: u.pool.entry(hop.URL)}
+}
+
+func (d *proxyFailDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+func (d *proxyFailDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	start := time.Now()
+	conn, err := dialContext(ctx, d.Dialer, network, addr)
+	var dialErr *ProxyDialError
+	before := errors.As(err, &dialErr)
+	if d.e != nil && ctx.Err() == nil && !before && !errors.Is(err, ErrTargetUnreachable) {
+		d.pool.record(d.e, err, time.Since(start))
+	}
+	if err != nil {
+		if before {
+			return nil, err
 		}
+		return nil, &ProxyDialError{Hop: d.hop, Proxy: d.proxy, Err: err}
 	}
+	if d.e != nil {
+		d.e.active.Add(1)
+		conn = &poolConn{Conn: conn, e: d.e}
+	}
+	return conn, nil
+}
 
-	switch proxyURL.Scheme {
-	case "socks4", "socks4a", "socks5", "socks5h":
-		proxyDialer, err = proxy.SOCKS5("tcp", proxyAddr, auth, proxyDialer)
-	case "http":
-		proxyDialer, err = ProxyHTTP("tcp", proxyAddr, auth, proxyDialer)
-	case "https":
-		// We use the same uTLS Config for TLS to the HTTPS proxy, as we
-		// use for HTTPS connections through the tunnel. We make a clone
-		// of the Config to avoid concurrent modification as the two
-		// layers set the ServerName value.
-		var cfgClone *utls.Config
-		if cfg != nil {
-			cfgClone = cfg.Clone()
+// chainDialer returns a dialer that connects through hops, in order.
+func (u UTLS) chainDialer(hops []ProxyHop) (proxy.Dialer, error) {
+	proxyDialer, err := u.baseDialer()
+	if err != nil {
+		return nil, err
+	}
+	for i, hop := range hops {
+		proxyDialer, err = u.hopDialer(hop, proxyDialer)
+		if err != nil && len(hops) > 1 {
+			return nil, fmt.Errorf("proxy hop %d: %w", i+1, err)
 		}
-		proxyDialer, err = ProxyHTTPS("tcp", proxyAddr, auth, proxyDialer, cfgClone, clientHelloID)
-	default:
-		return nil, proxyURL, fmt.Errorf("cannot use proxy scheme %q with uTLS", proxyURL.Scheme)
+		if err != nil {
+			return nil, err
+		}
+		proxyDialer = u.failDialer(proxyDialer, hop, i+1)
+	}
+
+	return proxyDialer, nil
+}
+
+// hopDialer returns a dialer that connects through hop, which it reaches
+// through forward.
+func (u UTLS) hopDialer(hop ProxyHop, forward proxy.Dialer) (proxy.Dialer, error) {
+	factory, ok := proxyScheme(hop.URL.Scheme)
+	if !ok {
+		return nil, &UnsupportedSchemeError{Scheme: hop.URL.Scheme}
+	}
+
+	return factory(hop, forward, u)
+}
+
+func init() {
+	RegisterProxyScheme("socks4", socks4Dialer)
+	RegisterProxyScheme("socks4a", socks4aDialer)
+	RegisterProxyScheme("socks5", socks5Dialer)
+	RegisterProxyScheme("socks5h", socks5hDialer)
+	RegisterProxyScheme("http", httpDialer)
+	RegisterProxyScheme("https", httpsDialer)
+}
+
+func socks4Dialer(hop ProxyHop, forward proxy.Dialer, u UTLS) (proxy.Dialer, error) {
+	proxyAddr, err := addrForDial(hop.URL)
+	if err != nil {
+		return nil, err
 	}
+	pd, err := ProxySOCKS4("tcp", proxyAddr, hop.URL.User.Username(), forward)
+	if err != nil {
+		return nil, err
+	}
+	pd.resolver = u.hostResolver()
+
+	return pd, nil
+}
+
+func socks4aDialer(hop ProxyHop, forward proxy.Dialer, _ UTLS) (proxy.Dialer, error) {
+	proxyAddr, err := addrForDial(hop.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	return ProxySOCKS4A("tcp", proxyAddr, hop.URL.User.Username(), forward)
+}
 
-	return proxyDialer, proxyURL, err
+// socks5Dialer resolves host names locally, like curl, and lets the proxy
+// resolve them with socks5h.
+func socks5Dialer(hop ProxyHop, forward proxy.Dialer, u UTLS) (proxy.Dialer, error) {
+	pd, err := socks5hDialer(hop, forward, u)
+	if err != nil {
+		return nil, err
+	}
+
+	return &resolvingDialer{resolver: u.hostResolver(), forward: pd}, nil
+}
+
+func socks5hDialer(hop ProxyHop, forward proxy.Dialer, _ UTLS) (proxy.Dialer, error) {
+	proxyAddr, err := addrForDial(hop.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	pd, err := proxy.SOCKS5("tcp", proxyAddr, urlAuth(hop.URL), forward)
+	if err != nil {
+		return nil, err
+	}
+
+	return &socks5Proxy{forward: pd}, nil
+}
+
+func httpDialer(hop ProxyHop, forward proxy.Dialer, u UTLS) (proxy.Dialer, error) {
+	proxyAddr, err := addrForDial(hop.URL)
+	if err != nil {
+		return nil, err
+	}
+	pd, err := ProxyHTTP("tcp", proxyAddr, urlAuth(hop.URL), forward)
+	if err != nil {
+		return nil, err
+	}
+	u.setupHTTPProxy(pd, hop)
+
+	return pd, nil
+}
+
+func httpsDialer(hop ProxyHop, forward proxy.Dialer, u UTLS) (proxy.Dialer, error) {
+	proxyAddr, err := addrForDial(hop.URL)
+	if err != nil {
+		return nil, err
+	}
+	pd := &httpProxy{
+		network: "tcp",
+		addr:    proxyAddr,
+		forward: u.proxyTLSDialer(hop, forward),
+		h2:      newH2Conns(u.http2),
+	}
+	u.setupHTTPProxy(pd, hop)
+
+	return pd, nil
+}
+
+// setupHTTPProxy applies the options to the http or https proxy hop.
+func (u UTLS) setupHTTPProxy(pd *httpProxy, hop ProxyHop) {
+	pd.auth = u.hopAuth(hop)
+	pd.timeout = u.connectTimeout
+	pd.proxyURL = hop.URL
+	pd.header = u.proxyConnectHeader
+	pd.getHeader = u.getProxyConnectHeader
+	pd.onResponse = u.onProxyConnectResponse
+}
+
+// customConnect reports whether the CONNECT requests to HTTP proxies are
+// customized, so that HTTP requests must be tunnelled too.
+func (u UTLS) customConnect() bool {
+	return u.proxyConnectHeader != nil || u.getProxyConnectHeader != nil || u.onProxyConnectResponse != nil
+}
+
+// hopAuth returns the authentication of the http or https proxy hop.
+func (u UTLS) hopAuth(hop ProxyHop) *proxyAuth {
+	authenticators := hop.Auth
+	if authenticators == nil {
+		authenticators = u.proxyAuthenticators
+	}
+
+	return newProxyAuth(urlAuth(hop.URL), authenticators)
+}
+
+// urlAuth returns the credentials of a proxy URL, if any.
+func urlAuth(proxyURL *url.URL) *proxy.Auth {
+	userpass := proxyURL.User
+	if userpass == nil {
+		return nil
+	}
+	auth := &proxy.Auth{
+		User: userpass.Username(),
+	}
+	if password, ok := userpass.Password(); ok {
+		auth.Password = password
+	}
+
+	return auth
+}
+
+// TLSDialer returns a dialer making TLS connections to the proxy of hop,
+// which it reaches through forward, with the TLS settings of hop and of the
+// options, for a ProxyDialerFactory.
+func (u UTLS) TLSDialer(hop ProxyHop, forward proxy.Dialer) *UTLSDialer {
+	return u.proxyTLSDialer(hop, forward)
+}
+
+// proxyTLSDialer returns a dialer making TLS connections to the https proxy
+// hop, which it reaches through forward.
+func (u UTLS) proxyTLSDialer(hop ProxyHop, forward proxy.Dialer) *UTLSDialer {
+	// We use the same uTLS Config and ClientHello for TLS to the HTTPS
+	// proxy as we use for HTTPS connections through the tunnel, unless
+	// the hop has its own.
+	cfg, clientHelloID, spec := hop.Config, hop.ClientHello, u.clientHelloSpec
+	if cfg == nil {
+		cfg = u.config
+	}
+	if clientHelloID == nil {
+		clientHelloID = u.clientHello
+	} else {
+		spec = nil
+	}
+
+	return &UTLSDialer{
+		config:           cfg,
+		clientHelloID:    clientHelloID,
+		clientHelloSpec:  spec,
+		forward:          forward,
+		handshakeTimeout: u.handshakeTimeout(),
+	}
 }
@@ -6,17 +6,21 @@ package proxier // import "github.com/wabarc/proxier"
 
 import (
 	"bufio"
+	"context"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"fmt"
 	"io"
 	"math/big"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"strings"
 	"testing"
 	"time"
 
@@ -78,6 +82,50 @@ func TestAddrForDial(t *testing.T) {
 	}
 }
 
+// A pipeDialer dials one end of a pipe, and sends the other end to conns
+// just before it returns. It does not implement proxy.ContextDialer.
+type pipeDialer struct {
+	conns chan<- net.Conn
+}
+
+func (d pipeDialer) Dial(_, _ string) (net.Conn, error) {
+	client, server := net.Pipe()
+	d.conns <- server
+	return client, nil
+}
+
+// Test that dialContext either returns the connection of a dialer without
+// DialContext or closes it, when ctx is done at about the same time.
+func TestDialContextWithoutContextDialer(t *testing.T) {
+	for i := 0; i < 1000; i++ {
+		servers := make(chan net.Conn, 1)
+		ctx, cancel := context.WithCancel(context.Background())
+		var server net.Conn
+		go func() {
+			server = <-servers
+			cancel()
+		}()
+		conn, err := dialContext(ctx, pipeDialer{servers}, "tcp", testAddr)
+		<-ctx.Done()
+		go func() {
+			if conn != nil {
+				conn.Write([]byte("x"))
+			}
+		}()
+		server.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, rerr := server.Read(make([]byte, 1))
+		if err != nil && rerr != io.EOF {
+			t.Fatalf("expected abandoned connection closed, got %v", rerr)
+		}
+		if err == nil && rerr != nil {
+			t.Fatalf("unexpected read from returned connection: %v", rerr)
+		}
+		if conn != nil {
+			conn.Close()
+		}
+	}
+}
+
 // Dial the given address with the given proxy, and return the http.Request that
 // the proxy server would have received.
 func requestResultingFromDial(t *testing.T, ln net.Listener, makeProxy func(addr net.Addr) (*httpProxy, error), network, addr string) (*http.Request, error) {
@@ -245,3 +293,218 @@ func TestProxyHTTPSCONNECT(t *testing.T) {
 		t.Errorf("expected %q, got %q", "Host: "+req.Host, "Host: "+testAddr)
 	}
 }
+
+// A proxyCheck reports whether a request to a proxy is authorized, and
+// answers it if not.
+type proxyCheck func(w http.ResponseWriter, r *http.Request) bool
+
+// basicCheck returns a proxyCheck for the Basic credentials of user.
+func basicCheck(user *url.Userinfo) proxyCheck {
+	return func(w http.ResponseWriter, r *http.Request) bool {
+		password, _ := user.Password()
+		auth := http.Request{Header: http.Header{"Authorization": r.Header["Proxy-Authorization"]}}
+		if u, p, ok := auth.BasicAuth(); !ok || u != user.Username() || p != password {
+			w.Header().Set("Proxy-Authenticate", `Basic realm="test"`)
+			w.WriteHeader(http.StatusProxyAuthRequired)
+			return false
+		}
+		return true
+	}
+}
+
+// connectProxy starts an HTTP proxy, over TLS if useTLS is set, that tunnels
+// CONNECT requests and forwards other requests, if check, when set, says
+// they are authorized. It logs each request it forwards as name, then the
+// method and target.
+func connectProxy(t *testing.T, name string, useTLS bool, check proxyCheck, log chan<- string) *url.URL {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if check != nil && !check(w, r) {
+			return
+		}
+		log <- name + " " + r.Method + " " + r.Host
+
+		if r.Method != http.MethodConnect {
+			r.RequestURI = ""
+			r.Header.Del("Proxy-Authorization")
+			resp, err := http.DefaultTransport.RoundTrip(r)
+			if err != nil {
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
+			defer resp.Body.Close()
+			for k, vv := range resp.Header {
+				w.Header()[k] = vv
+			}
+			w.WriteHeader(resp.StatusCode)
+			io.Copy(w, resp.Body)
+			return
+		}
+
+		upstream, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		conn, brw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			upstream.Close()
+			return
+		}
+		go func() {
+			defer conn.Close()
+			defer upstream.Close()
+			if n := brw.Reader.Buffered(); n > 0 {
+				b, _ := brw.Reader.Peek(n)
+				upstream.Write(b)
+			}
+			go io.Copy(upstream, conn)
+			io.Copy(conn, upstream)
+		}()
+	})
+
+	server := httptest.NewUnstartedServer(handler)
+	if useTLS {
+		server.StartTLS()
+	} else {
+		server.Start()
+	}
+	t.Cleanup(server.Close)
+
+	proxyURL, _ := url.Parse(server.URL)
+
+	return proxyURL
+}
+
+// Test that connections go through every proxy of a chain in order, with the
+// credentials and TLS settings of each, for both HTTPS and HTTP requests.
+func TestProxyChain(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	defer server.Close()
+	httpServer := httptest.NewServer(server.Config.Handler)
+	defer httpServer.Close()
+
+	log := make(chan string, 10)
+	first := connectProxy(t, "first", false, basicCheck(url.UserPassword(testUsername, testPassword)), log)
+	first.User = url.UserPassword(testUsername, testPassword)
+	second := connectProxy(t, "second", true, basicCheck(url.User(testUsername)), log)
+	second.User = url.User(testUsername)
+
+	rt, err := NewUTLSRoundTripper(
+		Config(&utls.Config{InsecureSkipVerify: true}),
+		Proxy([]ProxyHop{
+			{URL: first},
+			{URL: second, Config: &utls.Config{InsecureSkipVerify: true}, ClientHello: &utls.HelloFirefox_105},
+		}),
+	)
+	if err != nil {
+		t.Fatalf("unexpected create utls round tripper: %v", err)
+	}
+	client := &http.Client{Transport: rt}
+
+	for _, target := range []string{server.URL, httpServer.URL} {
+		resp, err := client.Get(target)
+		if err != nil {
+			t.Fatalf("unexpected request to %s: %v", target, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != "hello" {
+			t.Errorf("expected body %q from %s, got %q", "hello", target, body)
+		}
+
+		method := "CONNECT"
+		if strings.HasPrefix(target, "http:") {
+			method = "GET"
+		}
+		want := []string{
+			"first CONNECT " + second.Host,
+			"second " + method + " " + strings.TrimPrefix(strings.TrimPrefix(target, "https://"), "http://"),
+		}
+		for _, w := range want {
+			if got := <-log; got != w {
+				t.Errorf("expected proxy log %q, got %q", w, got)
+			}
+		}
+	}
+
+	// A chain with a bad hop is rejected.
+	_, err = NewUTLSRoundTripper(Proxy([]string{first.String(), "ftp://example.com:21"}))
+	if err == nil || !strings.Contains(err.Error(), "proxy hop 2") {
+		t.Errorf("expected error on proxy hop 2, got %v", err)
+	}
+}
+
+// Test that CONNECT requests carry the headers set for each target, and that
+// the hook sees the responses, for both HTTPS and HTTP requests.
+func TestProxyConnectHeader(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	defer server.Close()
+	httpServer := httptest.NewServer(server.Config.Handler)
+	defer httpServer.Close()
+
+	log := make(chan string, 10)
+	proxyURL := connectProxy(t, "proxy", false, func(w http.ResponseWriter, r *http.Request) bool {
+		if r.Header.Get("X-Session") != r.Host {
+			w.WriteHeader(http.StatusBadRequest)
+			return false
+		}
+		w.Header().Set("X-Exit-IP", "192.0.2.1")
+		return true
+	}, log)
+
+	exits := make(chan string, 10)
+	rt, err := NewUTLSRoundTripper(
+		Config(&utls.Config{InsecureSkipVerify: true}),
+		Proxy(proxyURL),
+		GetProxyConnectHeader(func(_ context.Context, u *url.URL, target string) (http.Header, error) {
+			if u.Host != proxyURL.Host {
+				t.Errorf("expected proxy URL %s, got %s", proxyURL, u)
+			}
+			return http.Header{"X-Session": {target}}, nil
+		}),
+		OnProxyConnectResponse(func(_ context.Context, _ *url.URL, req *http.Request, resp *http.Response) error {
+			exits <- req.Host + " " + resp.Header.Get("X-Exit-IP")
+			return nil
+		}),
+	)
+	if err != nil {
+		t.Fatalf("unexpected create utls round tripper: %v", err)
+	}
+	client := &http.Client{Transport: rt}
+
+	for _, target := range []string{server.URL, httpServer.URL} {
+		resp, err := client.Get(target)
+		if err != nil {
+			t.Fatalf("unexpected request to %s: %v", target, err)
+		}
+		resp.Body.Close()
+		host := strings.TrimPrefix(strings.TrimPrefix(target, "https://"), "http://")
+		if got := <-log; got != "proxy CONNECT "+host {
+			t.Errorf("expected proxy log %q, got %q", "proxy CONNECT "+host, got)
+		}
+		if got := <-exits; got != host+" 192.0.2.1" {
+			t.Errorf("expected CONNECT response for %s from 192.0.2.1, got %q", host, got)
+		}
+	}
+
+	// An error of the hook aborts the dial.
+	rt, err = NewUTLSRoundTripper(
+		Proxy(proxyURL),
+		ProxyConnectHeader(http.Header{"X-Session": {"other"}}),
+		OnProxyConnectResponse(func(_ context.Context, _ *url.URL, _ *http.Request, resp *http.Response) error {
+			return fmt.Errorf("status %d", resp.StatusCode)
+		}),
+	)
+	if err != nil {
+		t.Fatalf("unexpected create utls round tripper: %v", err)
+	}
+	_, err = rt.RoundTrip(newRequest(t, server.URL))
+	if err == nil || !strings.Contains(err.Error(), "status 400") {
+		t.Errorf("expected error of the hook, got %v", err)
+	}
+}
@@ -0,0 +1,78 @@
+// Copyright 2023 Wayback Archiver. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package proxier // import "github.com/wabarc/proxier"
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"golang.org/x/net/proxy"
+)
+
+// A HostResolver looks up the IP addresses of host names, for proxies that are
+// sent addresses rather than names. *net.Resolver implements it.
+type HostResolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// lookupIPs returns the addresses of host, only IPv4 ones if ip4 is set. It
+// returns host itself if it is an address.
+func lookupIPs(ctx context.Context, r HostResolver, host string, ip4 bool) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+
+	addrs, err := r.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	var ips []net.IP
+	for _, addr := range addrs {
+		if !ip4 || addr.IP.To4() != nil {
+			ips = append(ips, addr.IP)
+		}
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("no suitable address found for %s", host)
+	}
+
+	return ips, nil
+}
+
+// A resolvingDialer resolves host names locally, and dials the addresses
+// found through forward in turn until one connects.
+type resolvingDialer struct {
+	resolver HostResolver
+	forward  proxy.Dialer
+}
+
+func (d *resolvingDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+func (d *resolvingDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := lookupIPs(ctx, d.resolver, host, false)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, ip := range ips {
+		var conn net.Conn
+		conn, err = dialContext(ctx, d.forward, network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	return nil, err
+}
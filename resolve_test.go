@@ -0,0 +1,155 @@
+// Copyright 2023 Wayback Archiver. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package proxier // import "github.com/wabarc/proxier"
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+)
+
+// hostsResolver resolves the host names it maps, and fails on others.
+type hostsResolver map[string]string
+
+func (r hostsResolver) LookupIPAddr(_ context.Context, host string) ([]net.IPAddr, error) {
+	ip, ok := r[host]
+	if !ok {
+		return nil, fmt.Errorf("unknown host %s", host)
+	}
+
+	return []net.IPAddr{{IP: net.ParseIP(ip)}}, nil
+}
+
+// socks5Server starts a SOCKS5 proxy without authentication that tunnels every
+// request to localhost, whatever its host. It sends the target address of
+// each request to addrs.
+func socks5Server(t *testing.T, addrs chan<- string) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	serve := func(conn net.Conn) {
+		defer conn.Close()
+		br := bufio.NewReader(conn)
+		var head [2]byte
+		if _, err := io.ReadFull(br, head[:]); err != nil {
+			return
+		}
+		if _, err := io.ReadFull(br, make([]byte, head[1])); err != nil {
+			return
+		}
+		conn.Write([]byte{5, 0})
+
+		var req [4]byte
+		if _, err := io.ReadFull(br, req[:]); err != nil {
+			return
+		}
+		var host []byte
+		switch req[3] {
+		case 1:
+			host = make([]byte, net.IPv4len)
+		case 4:
+			host = make([]byte, net.IPv6len)
+		case 3:
+			n, err := br.ReadByte()
+			if err != nil {
+				return
+			}
+			host = make([]byte, n)
+		}
+		var port uint16
+		if _, err := io.ReadFull(br, host); err != nil || binary.Read(br, binary.BigEndian, &port) != nil {
+			return
+		}
+		if req[3] != 3 {
+			host = []byte(net.IP(host).String())
+		}
+		addrs <- net.JoinHostPort(string(host), strconv.Itoa(int(port)))
+
+		upstream, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(int(port))))
+		if err != nil {
+			conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+			return
+		}
+		defer upstream.Close()
+		conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+		go io.Copy(upstream, br)
+		io.Copy(conn, upstream)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serve(conn)
+		}
+	}()
+
+	return ln.Addr().String()
+}
+
+// Test that socks4 and socks5 proxies are sent addresses found by the
+// resolver, and socks4a and socks5h proxies the host names.
+func TestProxyResolver(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	defer server.Close()
+	_, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+
+	socks4Reqs := make(chan [2]string, 1)
+	socks4Addr := socks4Server(t, socks4Granted, socks4Reqs)
+	socks5Addrs := make(chan string, 1)
+	socks5Addr := socks5Server(t, socks5Addrs)
+	resolver := hostsResolver{testHost: "127.0.0.1"}
+
+	for _, test := range []struct {
+		scheme string
+		addr   string
+	}{
+		{"socks4", "127.0.0.1:" + port},
+		{"socks4a", testHost + ":" + port},
+		{"socks5", "127.0.0.1:" + port},
+		{"socks5h", testHost + ":" + port},
+	} {
+		proxyAddr := socks5Addr
+		if test.scheme == "socks4" || test.scheme == "socks4a" {
+			proxyAddr = socks4Addr
+		}
+		rt, err := NewUTLSRoundTripper(
+			Proxy(&url.URL{Scheme: test.scheme, Host: proxyAddr}),
+			Resolver(resolver),
+		)
+		if err != nil {
+			t.Fatalf("unexpected create utls round tripper: %v", err)
+		}
+		resp, err := rt.RoundTrip(newRequest(t, "http://"+testHost+":"+port))
+		if err != nil {
+			t.Fatalf("unexpected request through %s proxy: %v", test.scheme, err)
+		}
+		resp.Body.Close()
+
+		var got string
+		if proxyAddr == socks4Addr {
+			got = (<-socks4Reqs)[1]
+		} else {
+			got = <-socks5Addrs
+		}
+		if got != test.addr {
+			t.Errorf("expected %s proxy to be sent %s, got %s", test.scheme, test.addr, got)
+		}
+	}
+}
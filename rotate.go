@@ -0,0 +1,225 @@
+// Copyright 2023 Wayback Archiver. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package proxier // import "github.com/wabarc/proxier"
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"errors"
+	"math/rand"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	utls "github.com/refraction-networking/utls"
+)
+
+// A HelloSelector chooses the ClientHello of each new TLS connection to a
+// server. It must be safe for concurrent use.
+//
+// Connections to a server are reused, and a server that negotiates a
+// different protocol with a new ClientHello causes its idle connections to
+// be dropped, so rotating per host, see StickyHellos, is usually preferable
+// to rotating per connection.
+type HelloSelector interface {
+	// SelectHello returns the ClientHello to send to addr, a host:port
+	// address, or nil to send the one set by ClientHello.
+	SelectHello(addr string) *utls.ClientHelloID
+}
+
+// A HelloPeeker is a HelloSelector that can tell the ClientHello it would
+// choose for addr without moving on, as UTLSRoundTripper.Fingerprint needs.
+// The selectors of this package implement it.
+type HelloPeeker interface {
+	HelloSelector
+
+	// PeekHello returns a ClientHello that SelectHello may return for
+	// addr, without changing what it returns next, or nil if it cannot
+	// tell.
+	PeekHello(addr string) *utls.ClientHelloID
+}
+
+// HelloSelectorFunc adapts a function to a HelloSelector.
+type HelloSelectorFunc func(addr string) *utls.ClientHelloID
+
+// SelectHello returns f(addr).
+func (f HelloSelectorFunc) SelectHello(addr string) *utls.ClientHelloID {
+	return f(addr)
+}
+
+type roundRobinHellos struct {
+	ids  []*utls.ClientHelloID
+	next atomic.Uint64
+}
+
+// RoundRobinHellos returns a HelloSelector that uses ids in turn. It fails if
+// there is none, or one is nil.
+func RoundRobinHellos(ids ...*utls.ClientHelloID) (HelloSelector, error) {
+	if len(ids) == 0 {
+		return nil, errors.New("proxier: RoundRobinHellos needs at least one ClientHello")
+	}
+	for _, id := range ids {
+		if id == nil {
+			return nil, errors.New("proxier: nil ClientHello")
+		}
+	}
+
+	return &roundRobinHellos{ids: ids}, nil
+}
+
+func (s *roundRobinHellos) SelectHello(string) *utls.ClientHelloID {
+	n := s.next.Add(1) - 1
+	return s.ids[n%uint64(len(s.ids))]
+}
+
+func (s *roundRobinHellos) PeekHello(string) *utls.ClientHelloID {
+	return s.ids[s.next.Load()%uint64(len(s.ids))]
+}
+
+// A WeightedHello is a ClientHello chosen with a probability proportional to
+// its weight.
+type WeightedHello struct {
+	ID     *utls.ClientHelloID
+	Weight int
+}
+
+type weightedHellos struct {
+	choices []WeightedHello
+	total   int
+}
+
+// WeightedRandomHellos returns a HelloSelector that picks one of choices at
+// random, in proportion to their weights. It fails if a weight is negative,
+// a ClientHello is nil, or the weights add up to zero.
+func WeightedRandomHellos(choices ...WeightedHello) (HelloSelector, error) {
+	s := &weightedHellos{choices: choices}
+	for _, c := range choices {
+		if c.Weight < 0 {
+			return nil, errors.New("proxier: negative ClientHello weight")
+		}
+		if c.ID == nil {
+			return nil, errors.New("proxier: nil ClientHello")
+		}
+		s.total += c.Weight
+	}
+	if s.total == 0 {
+		return nil, errors.New("proxier: WeightedRandomHellos needs a positive total weight")
+	}
+
+	return s, nil
+}
+
+func (s *weightedHellos) SelectHello(string) *utls.ClientHelloID {
+	n := rand.Intn(s.total)
+	for _, c := range s.choices {
+		if n < c.Weight {
+			return c.ID
+		}
+		n -= c.Weight
+	}
+
+	// Not reached.
+	return s.choices[len(s.choices)-1].ID
+}
+
+// The next pick is random, so it cannot be told.
+func (s *weightedHellos) PeekHello(string) *utls.ClientHelloID {
+	return nil
+}
+
+// The number of hosts whose ClientHello a stickyHellos remembers.
+const maxStickyHosts = 1024
+
+type stickyHellos struct {
+	s HelloSelector
+
+	mu sync.Mutex
+	// Hosts and their ClientHellos, the most recently used first.
+	lru   *list.List
+	hosts map[string]*list.Element
+}
+
+type stickyHello struct {
+	host string
+	id   *utls.ClientHelloID
+}
+
+// StickyHellos returns a HelloSelector that asks s once for each host, and
+// keeps sending that ClientHello to the host, whatever its port. Only the
+// hosts used most recently are remembered; others are asked about again.
+func StickyHellos(s HelloSelector) HelloSelector {
+	return &stickyHellos{s: s, lru: list.New(), hosts: make(map[string]*list.Element)}
+}
+
+func (s *stickyHellos) SelectHello(addr string) *utls.ClientHelloID {
+	host := hostOf(addr)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if e, ok := s.hosts[host]; ok {
+		s.lru.MoveToFront(e)
+		return e.Value.(*stickyHello).id
+	}
+	id := s.s.SelectHello(addr)
+	s.hosts[host] = s.lru.PushFront(&stickyHello{host: host, id: id})
+	if s.lru.Len() > maxStickyHosts {
+		oldest := s.lru.Back()
+		s.lru.Remove(oldest)
+		delete(s.hosts, oldest.Value.(*stickyHello).host)
+	}
+
+	return id
+}
+
+func (s *stickyHellos) PeekHello(addr string) *utls.ClientHelloID {
+	s.mu.Lock()
+	e, ok := s.hosts[hostOf(addr)]
+	s.mu.Unlock()
+	if ok {
+		return e.Value.(*stickyHello).id
+	}
+	if p, ok := s.s.(HelloPeeker); ok {
+		return p.PeekHello(addr)
+	}
+
+	return nil
+}
+
+type seededHellos struct {
+	seed int64
+}
+
+// SeededRandomHellos returns a HelloSelector that sends a randomized
+// ClientHello, derived from seed and the host, so that each host sees a
+// different ClientHello, and the same one in every run with the same seed.
+func SeededRandomHellos(seed int64) HelloSelector {
+	return seededHellos{seed: seed}
+}
+
+func (s seededHellos) SelectHello(addr string) *utls.ClientHelloID {
+	prngSeed := utls.PRNGSeed(sha256.Sum256([]byte(strconv.FormatInt(s.seed, 10) + "|" + hostOf(addr))))
+
+	return &utls.ClientHelloID{
+		Client:  utls.HelloRandomized.Client,
+		Version: utls.HelloRandomized.Version,
+		Seed:    &prngSeed,
+	}
+}
+
+func (s seededHellos) PeekHello(addr string) *utls.ClientHelloID {
+	return s.SelectHello(addr)
+}
+
+// hostOf returns the host of addr, or addr if it has no port.
+func hostOf(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+
+	return host
+}
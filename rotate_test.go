@@ -0,0 +1,222 @@
+// Copyright 2023 Wayback Archiver. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package proxier // import "github.com/wabarc/proxier"
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+
+	utls "github.com/refraction-networking/utls"
+)
+
+func TestHelloSelectors(t *testing.T) {
+	rr, err := RoundRobinHellos(&utls.HelloChrome_102, &utls.HelloFirefox_105)
+	if err != nil {
+		t.Fatalf("unexpected create selector: %v", err)
+	}
+	for i, want := range []*utls.ClientHelloID{&utls.HelloChrome_102, &utls.HelloFirefox_105, &utls.HelloChrome_102} {
+		if got := rr.SelectHello("example.com:443"); got != want {
+			t.Errorf("expected round robin pick %d to be %s, got %s", i, want.Str(), got.Str())
+		}
+	}
+
+	weighted, err := WeightedRandomHellos(
+		WeightedHello{ID: &utls.HelloChrome_102, Weight: 1},
+		WeightedHello{ID: &utls.HelloFirefox_105, Weight: 0},
+	)
+	if err != nil {
+		t.Fatalf("unexpected create selector: %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		if got := weighted.SelectHello("example.com:443"); got != &utls.HelloChrome_102 {
+			t.Errorf("expected weighted pick to be %s, got %s", utls.HelloChrome_102.Str(), got.Str())
+		}
+	}
+
+	rr, _ = RoundRobinHellos(&utls.HelloChrome_102, &utls.HelloFirefox_105)
+	sticky := StickyHellos(rr)
+	a := sticky.SelectHello("a.example:443")
+	b := sticky.SelectHello("b.example:443")
+	if a == b {
+		t.Errorf("expected hosts to get different picks, got %s", a.Str())
+	}
+	if got := sticky.SelectHello("a.example:8443"); got != a {
+		t.Errorf("expected sticky pick %s, got %s", a.Str(), got.Str())
+	}
+
+	seeded := SeededRandomHellos(42)
+	a, b = seeded.SelectHello("a.example:443"), seeded.SelectHello("b.example:443")
+	if *a.Seed == *b.Seed {
+		t.Error("expected hosts to get different seeds")
+	}
+	if got := SeededRandomHellos(42).SelectHello("a.example:8443"); *got.Seed != *a.Seed {
+		t.Error("expected the same seed in another run")
+	}
+	if got := SeededRandomHellos(43).SelectHello("a.example:443"); *got.Seed == *a.Seed {
+		t.Error("expected another seed to give another ClientHello")
+	}
+}
+
+// Test that selectors are not made from invalid choices.
+func TestHelloSelectorsInvalid(t *testing.T) {
+	if _, err := RoundRobinHellos(); err == nil {
+		t.Error("expected error with no ClientHello")
+	}
+	if _, err := RoundRobinHellos(&utls.HelloChrome_102, nil); err == nil {
+		t.Error("expected error with a nil ClientHello")
+	}
+	for _, choices := range [][]WeightedHello{
+		nil,
+		{{ID: &utls.HelloChrome_102, Weight: 0}},
+		{{ID: &utls.HelloChrome_102, Weight: 2}, {ID: &utls.HelloFirefox_105, Weight: -1}},
+		{{ID: nil, Weight: 1}},
+	} {
+		if _, err := WeightedRandomHellos(choices...); err == nil {
+			t.Errorf("expected error with choices %+v", choices)
+		}
+	}
+}
+
+// Test that a StickyHellos forgets the hosts used least recently.
+func TestStickyHellosBound(t *testing.T) {
+	var asked int
+	sticky := StickyHellos(HelloSelectorFunc(func(string) *utls.ClientHelloID {
+		asked++
+		return &utls.HelloChrome_102
+	}))
+	for i := 0; i <= maxStickyHosts; i++ {
+		sticky.SelectHello(strconv.Itoa(i) + ".example:443")
+		// The first host stays in use.
+		sticky.SelectHello("0.example:443")
+	}
+	if n := len(sticky.(*stickyHellos).hosts); n != maxStickyHosts {
+		t.Errorf("expected %d hosts remembered, got %d", maxStickyHosts, n)
+	}
+	asked = 0
+	sticky.SelectHello("0.example:443")
+	sticky.SelectHello("1.example:443")
+	if asked != 1 {
+		t.Errorf("expected the least recently used host to be forgotten, asked %d times", asked)
+	}
+}
+
+// Test that Fingerprint does not move the selector on.
+func TestFingerprintRotateClientHello(t *testing.T) {
+	rr, _ := RoundRobinHellos(&utls.HelloChrome_102, &utls.HelloFirefox_105)
+	rt, err := NewUTLSRoundTripper(RotateClientHello(rr))
+	if err != nil {
+		t.Fatalf("unexpected create utls round tripper: %v", err)
+	}
+	want, _ := FingerprintClientHelloID(utls.HelloChrome_102, "example.com")
+	for i := 0; i < 2; i++ {
+		fp, err := rt.(*UTLSRoundTripper).Fingerprint("example.com:443")
+		if err != nil {
+			t.Fatalf("unexpected fingerprint: %v", err)
+		}
+		if fp.JA3 != want.JA3 {
+			t.Errorf("expected fingerprint %d of %s, got %s", i, want.JA3, fp.JA3)
+		}
+	}
+	if got := rr.SelectHello("example.com:443"); got != &utls.HelloChrome_102 {
+		t.Errorf("expected selector to pick %s next, got %s", utls.HelloChrome_102.Str(), got.Str())
+	}
+
+	rt, _ = NewUTLSRoundTripper(RotateClientHello(HelloSelectorFunc(func(string) *utls.ClientHelloID {
+		return &utls.HelloChrome_102
+	})))
+	if _, err := rt.(*UTLSRoundTripper).Fingerprint("example.com:443"); err == nil {
+		t.Error("expected error with a selector that cannot peek")
+	}
+
+	weighted, _ := WeightedRandomHellos(
+		WeightedHello{ID: &utls.HelloChrome_102, Weight: 1},
+		WeightedHello{ID: &utls.HelloFirefox_105, Weight: 1},
+	)
+	rt, _ = NewUTLSRoundTripper(RotateClientHello(weighted))
+	if _, err := rt.(*UTLSRoundTripper).Fingerprint("example.com:443"); err == nil {
+		t.Error("expected error with a random selector")
+	}
+}
+
+// Test that each new connection uses the next ClientHello, and that the
+// choices are reported.
+func TestRotateClientHello(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	var (
+		mu  sync.Mutex
+		ids []utls.ClientHelloID
+	)
+	rr, err := RoundRobinHellos(&utls.HelloChrome_102, &utls.HelloEdge_106, &utls.HelloFirefox_105)
+	if err != nil {
+		t.Fatalf("unexpected create selector: %v", err)
+	}
+	rt, err := NewUTLSRoundTripper(
+		RotateClientHello(rr),
+		OnClientHello(func(addr string, id utls.ClientHelloID) {
+			mu.Lock()
+			ids = append(ids, id)
+			mu.Unlock()
+		}),
+		Config(&utls.Config{InsecureSkipVerify: true}),
+	)
+	if err != nil {
+		t.Fatalf("unexpected create utls round tripper: %v", err)
+	}
+	client := &http.Client{Transport: rt}
+
+	for i := 0; i < 4; i++ {
+		resp, err := client.Get(server.URL)
+		if err != nil {
+			t.Fatalf("unexpected request: %v", err)
+		}
+		resp.Body.Close()
+		client.CloseIdleConnections()
+	}
+
+	want := []utls.ClientHelloID{utls.HelloChrome_102, utls.HelloEdge_106, utls.HelloFirefox_105, utls.HelloChrome_102}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(ids) != len(want) {
+		t.Fatalf("expected %d handshakes, got %d", len(want), len(ids))
+	}
+	for i := range want {
+		if ids[i].Str() != want[i].Str() {
+			t.Errorf("expected handshake %d with %s, got %s", i, want[i].Str(), ids[i].Str())
+		}
+	}
+}
+
+// Test that a selector returning nil sends the ClientHello option.
+func TestRotateClientHelloNil(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	var got utls.ClientHelloID
+	rt, err := NewUTLSRoundTripper(
+		ClientHello(&utls.HelloFirefox_105),
+		RotateClientHello(HelloSelectorFunc(func(string) *utls.ClientHelloID { return nil })),
+		OnClientHello(func(addr string, id utls.ClientHelloID) { got = id }),
+		Config(&utls.Config{InsecureSkipVerify: true}),
+	)
+	if err != nil {
+		t.Fatalf("unexpected create utls round tripper: %v", err)
+	}
+	client := &http.Client{Transport: rt}
+	defer client.CloseIdleConnections()
+
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatalf("unexpected request: %v", err)
+	}
+	resp.Body.Close()
+	if got.Str() != utls.HelloFirefox_105.Str() {
+		t.Errorf("expected handshake with %s, got %s", utls.HelloFirefox_105.Str(), got.Str())
+	}
+}
@@ -0,0 +1,48 @@
+// Copyright 2023 Wayback Archiver. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package proxier // import "github.com/wabarc/proxier"
+
+import (
+	"strings"
+	"sync"
+
+	"golang.org/x/net/proxy"
+)
+
+// A ProxyDialerFactory returns a dialer that connects through the proxy of
+// hop, which it reaches through forward, with the options opts of the round
+// tripper. Errors of the dialer are reported in a ProxyDialError.
+type ProxyDialerFactory func(hop ProxyHop, forward proxy.Dialer, opts UTLS) (proxy.Dialer, error)
+
+var (
+	proxySchemesMu sync.RWMutex
+	proxySchemes   = make(map[string]ProxyDialerFactory)
+)
+
+// RegisterProxyScheme makes proxies with the URL scheme usable with the Proxy
+// option and the others that choose proxies, through dialers made by
+// factory. Schemes are not case-sensitive. It panics if the scheme is
+// registered twice, or if factory is nil.
+func RegisterProxyScheme(scheme string, factory ProxyDialerFactory) {
+	if factory == nil {
+		panic("proxier: RegisterProxyScheme factory is nil")
+	}
+	scheme = strings.ToLower(scheme)
+
+	proxySchemesMu.Lock()
+	defer proxySchemesMu.Unlock()
+	if _, dup := proxySchemes[scheme]; dup {
+		panic("proxier: RegisterProxyScheme called twice for scheme " + scheme)
+	}
+	proxySchemes[scheme] = factory
+}
+
+// proxyScheme returns the factory of dialers for scheme, if registered.
+func proxyScheme(scheme string) (ProxyDialerFactory, bool) {
+	proxySchemesMu.RLock()
+	defer proxySchemesMu.RUnlock()
+	factory, ok := proxySchemes[strings.ToLower(scheme)]
+	return factory, ok
+}
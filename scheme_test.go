@@ -0,0 +1,87 @@
+// Copyright 2023 Wayback Archiver. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package proxier // import "github.com/wabarc/proxier"
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	utls "github.com/refraction-networking/utls"
+	"golang.org/x/net/proxy"
+)
+
+// A relayDialer connects to the target through forward, as a proxy relaying
+// connections would, and logs the proxy and target.
+type relayDialer struct {
+	proxyURL *url.URL
+	forward  proxy.Dialer
+	log      chan<- string
+}
+
+func (d *relayDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+func (d *relayDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	d.log <- "relay " + d.proxyURL.Host + " " + addr
+	return dialContext(ctx, d.forward, network, addr)
+}
+
+// Log of the relay proxies of the current test.
+var relayLog chan<- string
+
+// Test that proxies of a registered scheme are used, in chains with the
+// built-in ones.
+func TestRegisterProxyScheme(t *testing.T) {
+	log := make(chan string, 10)
+	// Tests may run more than once, and schemes registered only once.
+	if _, ok := proxyScheme("relay"); !ok {
+		RegisterProxyScheme("Relay", func(hop ProxyHop, forward proxy.Dialer, _ UTLS) (proxy.Dialer, error) {
+			return &relayDialer{proxyURL: hop.URL, forward: forward, log: relayLog}, nil
+		})
+	}
+	relayLog = log
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	defer server.Close()
+	first := connectProxy(t, "first", false, nil, log)
+
+	rt, err := NewUTLSRoundTripper(
+		Config(&utls.Config{InsecureSkipVerify: true}),
+		Proxy([]string{first.String(), "relay://relay.example:1"}),
+	)
+	if err != nil {
+		t.Fatalf("unexpected create utls round tripper: %v", err)
+	}
+	resp, err := rt.RoundTrip(newRequest(t, server.URL))
+	if err != nil {
+		t.Fatalf("unexpected request: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "hello" {
+		t.Errorf("expected body %q, got %q", "hello", body)
+	}
+	target := server.Listener.Addr().String()
+	for _, want := range []string{"relay relay.example:1 " + target, "first CONNECT " + target} {
+		if got := <-log; got != want {
+			t.Errorf("expected proxy log %q, got %q", want, got)
+		}
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("expected panic registering a scheme twice")
+		}
+	}()
+	RegisterProxyScheme("http", httpDialer)
+}
@@ -0,0 +1,332 @@
+// Copyright 2023 Wayback Archiver. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package proxier // import "github.com/wabarc/proxier"
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/net/proxy"
+)
+
+// https://shadowsocks.org/doc/aead.html
+// https://shadowsocks.org/doc/sip002.html
+
+// An ssCipher is a Shadowsocks AEAD cipher.
+type ssCipher struct {
+	keySize int
+	newAEAD func(key []byte) (cipher.AEAD, error)
+}
+
+var ssCiphers = map[string]ssCipher{
+	"aes-128-gcm":            {16, newGCM},
+	"aes-256-gcm":            {32, newGCM},
+	"chacha20-ietf-poly1305": {32, chacha20poly1305.New},
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Maximum length of the payload of a chunk.
+const ssMaxPayload = 0x3fff
+
+type ssProxy struct {
+	network, addr string
+	cipher        ssCipher
+	key           []byte
+	forward       proxy.Dialer
+}
+
+// ProxyShadowsocks returns a dialer that makes connections through the
+// Shadowsocks server at addr, with the AEAD cipher method, one of
+// aes-128-gcm, aes-256-gcm and chacha20-ietf-poly1305, and password.
+func ProxyShadowsocks(network, addr, method, password string, forward proxy.Dialer) (*ssProxy, error) {
+	c, ok := ssCiphers[strings.ToLower(method)]
+	if !ok {
+		return nil, fmt.Errorf("shadowsocks: cipher %q not supported", method)
+	}
+
+	return &ssProxy{
+		network: network,
+		addr:    addr,
+		cipher:  c,
+		key:     ssKey(password, c.keySize),
+		forward: forward,
+	}, nil
+}
+
+func (pr *ssProxy) Dial(network, addr string) (net.Conn, error) {
+	return pr.DialContext(context.Background(), network, addr)
+}
+
+func (pr *ssProxy) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("shadowsocks: network %q not supported", network)
+	}
+	target, err := ssAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := dialContext(ctx, pr.forward, pr.network, pr.addr)
+	if err != nil {
+		return nil, err
+	}
+	// The request is sent at once, in a chunk of its own.
+	sc := newSSConn(conn, pr.cipher, pr.key)
+	stop := watchContext(ctx, conn)
+	_, err = sc.Write(target)
+	if cerr := stop(); cerr != nil {
+		err = cerr
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return sc, nil
+}
+
+// ssAddr returns addr in the address format of SOCKS5.
+func ssAddr(addr string) ([]byte, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("shadowsocks: invalid port %q", portStr)
+	}
+
+	var b []byte
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return nil, fmt.Errorf("shadowsocks: host name %q too long", host)
+		}
+		b = append([]byte{3, byte(len(host))}, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		b = append([]byte{1}, ip4...)
+	} else {
+		b = append([]byte{4}, ip.To16()...)
+	}
+
+	return binary.BigEndian.AppendUint16(b, uint16(port)), nil
+}
+
+// ssKey derives the master key from password, as EVP_BytesToKey of OpenSSL
+// does with MD5.
+func ssKey(password string, size int) []byte {
+	var key, prev []byte
+	for len(key) < size {
+		h := md5.New()
+		h.Write(prev)
+		h.Write([]byte(password))
+		prev = h.Sum(nil)
+		key = append(key, prev...)
+	}
+
+	return key[:size]
+}
+
+// ssSubkey returns the AEAD of a session with salt.
+func ssSubkey(c ssCipher, key, salt []byte) (cipher.AEAD, error) {
+	subkey := make([]byte, c.keySize)
+	if _, err := io.ReadFull(hkdf.New(sha1.New, key, salt, []byte("ss-subkey")), subkey); err != nil {
+		return nil, err
+	}
+
+	return c.newAEAD(subkey)
+}
+
+// An ssConn is a connection to a Shadowsocks server, whose streams are each
+// a salt followed by chunks, made of the sealed length and payload.
+type ssConn struct {
+	net.Conn
+	cipher ssCipher
+	key    []byte
+
+	wmu    sync.Mutex
+	w      cipher.AEAD
+	wnonce []byte
+
+	r      cipher.AEAD
+	rnonce []byte
+	// Payload read but not returned yet.
+	rbuf []byte
+}
+
+func newSSConn(conn net.Conn, c ssCipher, key []byte) *ssConn {
+	return &ssConn{Conn: conn, cipher: c, key: key}
+}
+
+func (c *ssConn) Write(b []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	var buf []byte
+	if c.w == nil {
+		salt := make([]byte, c.cipher.keySize)
+		if _, err := rand.Read(salt); err != nil {
+			return 0, err
+		}
+		w, err := ssSubkey(c.cipher, c.key, salt)
+		if err != nil {
+			return 0, err
+		}
+		c.w, c.wnonce = w, make([]byte, w.NonceSize())
+		buf = salt
+	}
+
+	n := 0
+	for n < len(b) {
+		payload := b[n:]
+		if len(payload) > ssMaxPayload {
+			payload = payload[:ssMaxPayload]
+		}
+		buf = c.seal(buf, binary.BigEndian.AppendUint16(nil, uint16(len(payload))))
+		buf = c.seal(buf, payload)
+		n += len(payload)
+	}
+	if _, err := c.Conn.Write(buf); err != nil {
+		return 0, err
+	}
+
+	return n, nil
+}
+
+// seal appends plaintext sealed with the next nonce to dst.
+func (c *ssConn) seal(dst, plaintext []byte) []byte {
+	dst = c.w.Seal(dst, c.wnonce, plaintext, nil)
+	ssIncrement(c.wnonce)
+	return dst
+}
+
+func (c *ssConn) Read(b []byte) (int, error) {
+	for len(c.rbuf) == 0 {
+		if err := c.readChunk(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(b, c.rbuf)
+	c.rbuf = c.rbuf[n:]
+
+	return n, nil
+}
+
+// readChunk reads the next chunk into rbuf.
+func (c *ssConn) readChunk() error {
+	if c.r == nil {
+		salt := make([]byte, c.cipher.keySize)
+		if _, err := io.ReadFull(c.Conn, salt); err != nil {
+			return err
+		}
+		r, err := ssSubkey(c.cipher, c.key, salt)
+		if err != nil {
+			return err
+		}
+		c.r, c.rnonce = r, make([]byte, r.NonceSize())
+	}
+
+	buf := make([]byte, 2+c.r.Overhead())
+	if _, err := io.ReadFull(c.Conn, buf); err != nil {
+		return err
+	}
+	length, err := c.open(buf)
+	if err != nil {
+		return err
+	}
+	buf = make([]byte, int(binary.BigEndian.Uint16(length)&ssMaxPayload)+c.r.Overhead())
+	if _, err := io.ReadFull(c.Conn, buf); err != nil {
+		return unexpectedEOF(err)
+	}
+	c.rbuf, err = c.open(buf)
+
+	return err
+}
+
+// open opens ciphertext with the next nonce, in place.
+func (c *ssConn) open(ciphertext []byte) ([]byte, error) {
+	plaintext, err := c.r.Open(ciphertext[:0], c.rnonce, ciphertext, nil)
+	if err != nil {
+		return nil, errors.New("shadowsocks: cannot decrypt, wrong password or cipher?")
+	}
+	ssIncrement(c.rnonce)
+	return plaintext, nil
+}
+
+// ssIncrement increments nonce, a little-endian number.
+func ssIncrement(nonce []byte) {
+	for i := range nonce {
+		nonce[i]++
+		if nonce[i] != 0 {
+			return
+		}
+	}
+}
+
+// unexpectedEOF returns io.ErrUnexpectedEOF in place of io.EOF.
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func init() {
+	RegisterProxyScheme("ss", ssDialer)
+}
+
+// ssDialer makes a dialer for an ss URL, in the SIP002 format, such as
+// ss://YWVzLTI1Ni1nY206cGFzcw@host:8388, whose user info is the method and
+// password, separated by a colon and encoded in base64url, or else given as
+// the user name and password of the URL. Plugins are not supported.
+func ssDialer(hop ProxyHop, forward proxy.Dialer, _ UTLS) (proxy.Dialer, error) {
+	if hop.URL.Port() == "" {
+		return nil, errors.New("shadowsocks: missing port")
+	}
+	if hop.URL.Query().Get("plugin") != "" {
+		return nil, errors.New("shadowsocks: plugins not supported")
+	}
+
+	method, password, ok := hop.URL.User.Username(), "", false
+	if password, ok = hop.URL.User.Password(); !ok {
+		encoded := strings.TrimRight(method, "=")
+		userinfo, err := base64.RawURLEncoding.DecodeString(encoded)
+		if err != nil {
+			// Some clients use the standard encoding.
+			userinfo, err = base64.RawStdEncoding.DecodeString(encoded)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("shadowsocks: invalid user info: %w", err)
+		}
+		if method, password, ok = strings.Cut(string(userinfo), ":"); !ok {
+			return nil, errors.New("shadowsocks: missing password")
+		}
+	}
+
+	return ProxyShadowsocks("tcp", hop.URL.Host, method, password, forward)
+}
@@ -0,0 +1,136 @@
+// Copyright 2023 Wayback Archiver. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package proxier // import "github.com/wabarc/proxier"
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+
+	utls "github.com/refraction-networking/utls"
+)
+
+// ssServer starts a Shadowsocks server with the cipher method and password,
+// and returns its address.
+func ssServer(t *testing.T, method, password string) string {
+	c := ssCiphers[method]
+	key := ssKey(password, c.keySize)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	serve := func(conn net.Conn) {
+		sc := newSSConn(conn, c, key)
+		defer sc.Close()
+		var atyp [1]byte
+		if _, err := io.ReadFull(sc, atyp[:]); err != nil {
+			return
+		}
+		var host string
+		switch atyp[0] {
+		case 1, 4:
+			ip := make(net.IP, map[byte]int{1: 4, 4: 16}[atyp[0]])
+			if _, err := io.ReadFull(sc, ip); err != nil {
+				return
+			}
+			host = ip.String()
+		case 3:
+			var n [1]byte
+			if _, err := io.ReadFull(sc, n[:]); err != nil {
+				return
+			}
+			name := make([]byte, n[0])
+			if _, err := io.ReadFull(sc, name); err != nil {
+				return
+			}
+			host = string(name)
+		default:
+			return
+		}
+		var port [2]byte
+		if _, err := io.ReadFull(sc, port[:]); err != nil {
+			return
+		}
+		upstream, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))))
+		if err != nil {
+			return
+		}
+		defer upstream.Close()
+		go io.Copy(upstream, sc)
+		io.Copy(sc, upstream)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serve(conn)
+		}
+	}()
+
+	return ln.Addr().String()
+}
+
+// Test that connections go through Shadowsocks servers, with each cipher,
+// and fail with the wrong password.
+func TestProxyShadowsocks(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(strings.Repeat("hello", 10000)))
+	}))
+	defer server.Close()
+	httpServer := httptest.NewServer(server.Config.Handler)
+	defer httpServer.Close()
+
+	for method := range ssCiphers {
+		addr := ssServer(t, method, testPassword)
+		for _, proxyURL := range []string{
+			"ss://" + base64.RawURLEncoding.EncodeToString([]byte(method+":"+testPassword)) + "@" + addr + "#tag",
+			"ss://" + method + ":" + url.QueryEscape(testPassword) + "@" + addr,
+		} {
+			rt, err := NewUTLSRoundTripper(
+				Config(&utls.Config{InsecureSkipVerify: true}),
+				Proxy(proxyURL),
+			)
+			if err != nil {
+				t.Fatalf("unexpected create utls round tripper with %s: %v", proxyURL, err)
+			}
+			client := &http.Client{Transport: rt}
+			for _, target := range []string{server.URL, httpServer.URL, strings.Replace(httpServer.URL, "127.0.0.1", "localhost", 1)} {
+				resp, err := client.Get(target)
+				if err != nil {
+					t.Fatalf("unexpected request to %s with %s: %v", target, method, err)
+				}
+				body, _ := io.ReadAll(resp.Body)
+				resp.Body.Close()
+				if string(body) != strings.Repeat("hello", 10000) {
+					t.Errorf("unexpected body of %d bytes from %s with %s", len(body), target, method)
+				}
+			}
+			client.CloseIdleConnections()
+		}
+
+		rt, err := NewUTLSRoundTripper(Proxy("ss://" + method + ":wrong@" + addr))
+		if err != nil {
+			t.Fatalf("unexpected create utls round tripper: %v", err)
+		}
+		if _, err := rt.RoundTrip(newRequest(t, httpServer.URL)); err == nil {
+			t.Errorf("expected error with the wrong password with %s", method)
+		}
+	}
+
+	if _, err := NewUTLSRoundTripper(Proxy("ss://rc4-md5:" + testPassword + "@127.0.0.1:8388")); err == nil {
+		t.Errorf("expected error with an unsupported cipher")
+	}
+}
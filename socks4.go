@@ -0,0 +1,181 @@
+// Copyright 2023 Wayback Archiver. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package proxier // import "github.com/wabarc/proxier"
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+
+	"golang.org/x/net/proxy"
+)
+
+// https://www.openssh.com/txt/socks4.protocol
+// https://www.openssh.com/txt/socks4a.protocol
+
+type socks4Proxy struct {
+	network, addr string
+	userID        string
+	forward       proxy.Dialer
+
+	// Resolves host names locally, unless remoteDNS is set.
+	resolver HostResolver
+
+	// Whether host names are sent to the proxy to resolve, as SOCKS4a
+	// allows, rather than resolved locally.
+	remoteDNS bool
+}
+
+// ProxySOCKS4 returns a dialer that makes connections through the SOCKS4
+// proxy at addr, identifying as userID. Host names are resolved locally, to
+// IPv4 addresses.
+func ProxySOCKS4(network, addr, userID string, forward proxy.Dialer) (*socks4Proxy, error) {
+	return &socks4Proxy{
+		network:  network,
+		addr:     addr,
+		userID:   userID,
+		forward:  forward,
+		resolver: net.DefaultResolver,
+	}, nil
+}
+
+// ProxySOCKS4A returns a dialer that makes connections through the SOCKS4a
+// proxy at addr, identifying as userID. Host names are resolved by the
+// proxy.
+func ProxySOCKS4A(network, addr, userID string, forward proxy.Dialer) (*socks4Proxy, error) {
+	pr, err := ProxySOCKS4(network, addr, userID, forward)
+	pr.remoteDNS = true
+	return pr, err
+}
+
+// SOCKS4Error is the reply code of a SOCKS4 proxy that rejected a request.
+// SOCKS4Rejected matches ErrTargetUnreachable, since proxies also send it
+// when they fail to connect to the target.
+type SOCKS4Error byte
+
+// SOCKS4 reply codes.
+const (
+	socks4Granted        = 90
+	SOCKS4Rejected       = SOCKS4Error(91)
+	SOCKS4NoIdentd       = SOCKS4Error(92)
+	SOCKS4IdentdMismatch = SOCKS4Error(93)
+)
+
+func (e SOCKS4Error) Error() string {
+	switch e {
+	case SOCKS4Rejected:
+		return "socks4: request rejected or failed"
+	case SOCKS4NoIdentd:
+		return "socks4: request rejected because the proxy cannot connect to identd on the client"
+	case SOCKS4IdentdMismatch:
+		return "socks4: request rejected because identd reports a different user ID"
+	default:
+		return "socks4: unknown reply code " + strconv.Itoa(int(e))
+	}
+}
+
+func (e SOCKS4Error) Is(target error) bool {
+	return target == ErrTargetUnreachable && e == SOCKS4Rejected
+}
+
+func (pr *socks4Proxy) Dial(network, addr string) (net.Conn, error) {
+	return pr.DialContext(context.Background(), network, addr)
+}
+
+func (pr *socks4Proxy) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4":
+	default:
+		return nil, fmt.Errorf("socks4: network %q not supported", network)
+	}
+	req, err := pr.request(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := dialContext(ctx, pr.forward, pr.network, pr.addr)
+	if err != nil {
+		return nil, err
+	}
+
+	stop := watchContext(ctx, conn)
+	err = pr.connect(conn, req)
+	if cerr := stop(); cerr != nil {
+		err = cerr
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+// request returns the CONNECT request for addr.
+func (pr *socks4Proxy) request(ctx context.Context, addr string) ([]byte, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("socks4: invalid port %q", portStr)
+	}
+
+	var name string
+	ip := net.ParseIP(host)
+	switch {
+	case ip != nil:
+	case pr.remoteDNS:
+		// An invalid IP address, 0.0.0.x with x non-zero, tells the
+		// proxy to resolve the name that follows the user ID.
+		ip = net.IPv4(0, 0, 0, 1)
+		name = host
+	default:
+		ips, err := lookupIPs(ctx, pr.resolver, host, true)
+		if err != nil {
+			return nil, err
+		}
+		ip = ips[0]
+	}
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return nil, fmt.Errorf("socks4: IPv6 address %s not supported", host)
+	}
+
+	req := []byte{4, 1, byte(port >> 8), byte(port)}
+	req = append(req, ip4...)
+	req = append(req, pr.userID...)
+	req = append(req, 0)
+	if name != "" {
+		req = append(req, name...)
+		req = append(req, 0)
+	}
+
+	return req, nil
+}
+
+// connect sends req over conn and reads the proxy's reply.
+func (pr *socks4Proxy) connect(conn net.Conn, req []byte) error {
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	var reply [8]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		return err
+	}
+	if reply[0] != 0 {
+		return errors.New("socks4: malformed reply")
+	}
+	if reply[1] != socks4Granted {
+		return SOCKS4Error(reply[1])
+	}
+
+	return nil
+}
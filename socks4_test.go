@@ -0,0 +1,139 @@
+// Copyright 2023 Wayback Archiver. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package proxier // import "github.com/wabarc/proxier"
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+)
+
+// socks4Server starts a SOCKS4a proxy that replies with code, and tunnels
+// granted requests to localhost, whatever their host. It sends each request it gets to reqs as the user ID, then
+// the target address.
+func socks4Server(t *testing.T, code byte, reqs chan<- [2]string) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	serve := func(conn net.Conn) {
+		defer conn.Close()
+		br := bufio.NewReader(conn)
+		var head [8]byte
+		if _, err := io.ReadFull(br, head[:]); err != nil || head[0] != 4 || head[1] != 1 {
+			return
+		}
+		userID, err := br.ReadString(0)
+		if err != nil {
+			return
+		}
+		host := net.IP(head[4:8]).String()
+		if head[4] == 0 && head[5] == 0 && head[6] == 0 && head[7] != 0 {
+			if host, err = br.ReadString(0); err != nil {
+				return
+			}
+			host = host[:len(host)-1]
+		}
+		port := strconv.Itoa(int(head[2])<<8 | int(head[3]))
+		reqs <- [2]string{userID[:len(userID)-1], net.JoinHostPort(host, port)}
+
+		var upstream net.Conn
+		if code == socks4Granted {
+			if upstream, err = net.Dial("tcp", net.JoinHostPort("127.0.0.1", port)); err != nil {
+				code = byte(SOCKS4Rejected)
+			}
+		}
+		conn.Write([]byte{0, code, 0, 0, 0, 0, 0, 0})
+		if upstream == nil {
+			return
+		}
+		defer upstream.Close()
+		go io.Copy(upstream, br)
+		io.Copy(conn, upstream)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serve(conn)
+		}
+	}()
+
+	return ln.Addr().String()
+}
+
+func TestProxySOCKS4(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	defer server.Close()
+	_, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+
+	reqs := make(chan [2]string, 1)
+	proxyAddr := socks4Server(t, socks4Granted, reqs)
+	for _, test := range []struct {
+		scheme string
+		addr   string
+	}{
+		// Host names are resolved locally with SOCKS4, and by the
+		// proxy with SOCKS4a.
+		{"socks4", "127.0.0.1:" + port},
+		{"socks4a", "localhost:" + port},
+	} {
+		rt, err := NewUTLSRoundTripper(Proxy(&url.URL{Scheme: test.scheme, User: url.User("alice"), Host: proxyAddr}))
+		if err != nil {
+			t.Fatalf("unexpected create utls round tripper: %v", err)
+		}
+		resp, err := rt.RoundTrip(newRequest(t, "http://localhost:"+port))
+		if err != nil {
+			t.Fatalf("unexpected request through %s proxy: %v", test.scheme, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != "hello" {
+			t.Errorf("expected body %q through %s proxy, got %q", "hello", test.scheme, body)
+		}
+		if req := <-reqs; req != [2]string{"alice", test.addr} {
+			t.Errorf("expected request from alice to %s through %s proxy, got %q", test.addr, test.scheme, req)
+		}
+	}
+}
+
+func TestProxySOCKS4Rejected(t *testing.T) {
+	reqs := make(chan [2]string, 1)
+	pr, err := ProxySOCKS4A("tcp", socks4Server(t, byte(SOCKS4IdentdMismatch), reqs), "", nil)
+	if err != nil {
+		t.Fatalf("unexpected create socks4 proxy: %v", err)
+	}
+	pr.forward = &net.Dialer{}
+
+	_, err = pr.Dial("tcp", testAddr)
+	var code SOCKS4Error
+	if !errors.As(err, &code) || code != SOCKS4IdentdMismatch {
+		t.Errorf("expected %v, got %v", SOCKS4IdentdMismatch, err)
+	}
+	if req := <-reqs; req != [2]string{"", testAddr} {
+		t.Errorf("expected request to %s, got %q", testAddr, req)
+	}
+}
+
+func newRequest(t *testing.T, url string) *http.Request {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatalf("unexpected create request: %v", err)
+	}
+
+	return req
+}
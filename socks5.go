@@ -0,0 +1,101 @@
+// Copyright 2023 Wayback Archiver. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package proxier // import "github.com/wabarc/proxier"
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/proxy"
+)
+
+// SOCKS5Error is the reply code of a SOCKS5 proxy that failed a request, as
+// in RFC 1928, section 6. It matches ErrTargetUnreachable if the proxy
+// reports that the target cannot be reached.
+type SOCKS5Error byte
+
+// SOCKS5 reply codes.
+const (
+	SOCKS5GeneralFailure          = SOCKS5Error(1)
+	SOCKS5NotAllowed              = SOCKS5Error(2)
+	SOCKS5NetworkUnreachable      = SOCKS5Error(3)
+	SOCKS5HostUnreachable         = SOCKS5Error(4)
+	SOCKS5ConnectionRefused       = SOCKS5Error(5)
+	SOCKS5TTLExpired              = SOCKS5Error(6)
+	SOCKS5CommandNotSupported     = SOCKS5Error(7)
+	SOCKS5AddressTypeNotSupported = SOCKS5Error(8)
+)
+
+// The reply messages of SOCKS5 proxies, as x/net/proxy words them.
+var socks5Replies = map[SOCKS5Error]string{
+	SOCKS5GeneralFailure:          "general SOCKS server failure",
+	SOCKS5NotAllowed:              "connection not allowed by ruleset",
+	SOCKS5NetworkUnreachable:      "network unreachable",
+	SOCKS5HostUnreachable:         "host unreachable",
+	SOCKS5ConnectionRefused:       "connection refused",
+	SOCKS5TTLExpired:              "TTL expired",
+	SOCKS5CommandNotSupported:     "command not supported",
+	SOCKS5AddressTypeNotSupported: "address type not supported",
+}
+
+func (e SOCKS5Error) Error() string {
+	if msg, ok := socks5Replies[e]; ok {
+		return "socks5: " + msg
+	}
+	return "socks5: unknown reply code " + strconv.Itoa(int(e))
+}
+
+func (e SOCKS5Error) Is(target error) bool {
+	if target != ErrTargetUnreachable {
+		return false
+	}
+	switch e {
+	case SOCKS5NetworkUnreachable, SOCKS5HostUnreachable, SOCKS5ConnectionRefused, SOCKS5TTLExpired:
+		return true
+	}
+	return false
+}
+
+// A socks5Proxy is a SOCKS5 dialer of x/net/proxy whose errors carry the
+// reply code of the proxy as a SOCKS5Error.
+type socks5Proxy struct {
+	forward proxy.Dialer
+}
+
+func (pr *socks5Proxy) Dial(network, addr string) (net.Conn, error) {
+	return pr.DialContext(context.Background(), network, addr)
+}
+
+func (pr *socks5Proxy) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := dialContext(ctx, pr.forward, network, addr)
+	if err != nil {
+		return nil, socks5Error(err)
+	}
+	return conn, nil
+}
+
+// socks5Error returns err with the reply code it reports as a SOCKS5Error.
+// x/net/proxy reports reply codes only in the text of its errors.
+func socks5Error(err error) error {
+	var opErr *net.OpError
+	if !errors.As(err, &opErr) || opErr.Err == nil {
+		return err
+	}
+	msg, ok := strings.CutPrefix(opErr.Err.Error(), "unknown error ")
+	if !ok {
+		return err
+	}
+	for code, reply := range socks5Replies {
+		if msg == reply {
+			e := *opErr
+			e.Err = code
+			return &e
+		}
+	}
+	return err
+}
@@ -0,0 +1,339 @@
+// Copyright 2023 Wayback Archiver. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package proxier // import "github.com/wabarc/proxier"
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/pem"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	utls "github.com/refraction-networking/utls"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"golang.org/x/net/proxy"
+)
+
+// sshServer starts an SSH server that accepts testPassword, and the key
+// authorized, for testUsername, and opens direct-tcpip channels. It counts
+// the connections made to it in conns, and returns its address and a
+// known_hosts file with its Ed25519 host key. It also has an ECDSA host key,
+// which clients prefer unless told otherwise.
+func sshServer(t *testing.T, authorized ssh.PublicKey, conns *atomic.Int32) (string, string) {
+	_, hostKey, _ := ed25519.GenerateKey(rand.Reader)
+	hostSigner, err := ssh.NewSignerFromKey(hostKey)
+	if err != nil {
+		t.Fatalf("unexpected host key: %v", err)
+	}
+	ecdsaKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ecdsaSigner, err := ssh.NewSignerFromKey(ecdsaKey)
+	if err != nil {
+		t.Fatalf("unexpected host key: %v", err)
+	}
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(c ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if c.User() == testUsername && string(password) == testPassword {
+				return nil, nil
+			}
+			return nil, io.EOF
+		},
+		PublicKeyCallback: func(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if c.User() == testUsername && authorized != nil && bytes.Equal(key.Marshal(), authorized.Marshal()) {
+				return nil, nil
+			}
+			return nil, io.EOF
+		},
+	}
+	config.AddHostKey(hostSigner)
+	config.AddHostKey(ecdsaSigner)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	serve := func(conn net.Conn) {
+		defer conn.Close()
+		_, chans, reqs, err := ssh.NewServerConn(conn, config)
+		if err != nil {
+			return
+		}
+		conns.Add(1)
+		go ssh.DiscardRequests(reqs)
+		for newCh := range chans {
+			var msg struct {
+				Host       string
+				Port       uint32
+				OriginHost string
+				OriginPort uint32
+			}
+			if newCh.ChannelType() != "direct-tcpip" || ssh.Unmarshal(newCh.ExtraData(), &msg) != nil {
+				newCh.Reject(ssh.UnknownChannelType, "unsupported")
+				continue
+			}
+			upstream, err := net.Dial("tcp", net.JoinHostPort(msg.Host, strconv.Itoa(int(msg.Port))))
+			if err != nil {
+				newCh.Reject(ssh.ConnectionFailed, err.Error())
+				continue
+			}
+			ch, chReqs, err := newCh.Accept()
+			if err != nil {
+				upstream.Close()
+				continue
+			}
+			go ssh.DiscardRequests(chReqs)
+			go func() {
+				defer ch.Close()
+				defer upstream.Close()
+				go io.Copy(upstream, ch)
+				io.Copy(ch, upstream)
+			}()
+		}
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serve(conn)
+		}
+	}()
+
+	knownHosts := filepath.Join(t.TempDir(), "known_hosts")
+	line := knownhosts.Line([]string{knownhosts.Normalize(ln.Addr().String())}, hostSigner.PublicKey())
+	if err := os.WriteFile(knownHosts, []byte(line+"\n"), 0o600); err != nil {
+		t.Fatalf("unexpected write known_hosts: %v", err)
+	}
+
+	return ln.Addr().String(), knownHosts
+}
+
+// Test that connections go through one connection to an SSH server, which
+// is authenticated with a password, a key file or an agent, and whose host
+// key is verified.
+func TestProxySSH(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	defer server.Close()
+	httpServer := httptest.NewServer(server.Config.Handler)
+	defer httpServer.Close()
+
+	pub, key, _ := ed25519.GenerateKey(rand.Reader)
+	block, err := ssh.MarshalPrivateKey(key, "")
+	if err != nil {
+		t.Fatalf("unexpected marshal key: %v", err)
+	}
+	keyFile := filepath.Join(t.TempDir(), "id_ed25519")
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(block), 0o600); err != nil {
+		t.Fatalf("unexpected write key: %v", err)
+	}
+	sshPub, _ := ssh.NewPublicKey(pub)
+
+	// An agent holding the key.
+	keyring := agent.NewKeyring()
+	if err := keyring.Add(agent.AddedKey{PrivateKey: key}); err != nil {
+		t.Fatalf("unexpected add key to agent: %v", err)
+	}
+	agentSock := filepath.Join(t.TempDir(), "agent.sock")
+	agentLn, err := net.Listen("unix", agentSock)
+	if err != nil {
+		t.Fatalf("unexpected listen: %v", err)
+	}
+	defer agentLn.Close()
+	go func() {
+		for {
+			conn, err := agentLn.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				agent.ServeAgent(keyring, conn)
+			}()
+		}
+	}()
+
+	var conns atomic.Int32
+	addr, knownHosts := sshServer(t, sshPub, &conns)
+	query := "?known_hosts=" + url.QueryEscape(knownHosts)
+	for _, test := range []struct {
+		name, url, agentSock string
+	}{
+		{"password", "ssh://" + testUsername + ":" + testPassword + "@" + addr + query, ""},
+		{"key", "ssh://" + testUsername + "@" + addr + query + "&key=" + url.QueryEscape(keyFile), ""},
+		{"agent", "ssh://" + testUsername + "@" + addr + query + "&key=", agentSock},
+	} {
+		t.Setenv("SSH_AUTH_SOCK", test.agentSock)
+		conns.Store(0)
+		rt, err := NewUTLSRoundTripper(
+			Config(&utls.Config{InsecureSkipVerify: true}),
+			Proxy(test.url),
+		)
+		if err != nil {
+			t.Fatalf("unexpected create utls round tripper with %s: %v", test.name, err)
+		}
+		client := &http.Client{Transport: rt}
+		for i := 0; i < 3; i++ {
+			for _, target := range []string{server.URL, httpServer.URL} {
+				resp, err := client.Get(target)
+				if err != nil {
+					t.Fatalf("unexpected request to %s with %s: %v", target, test.name, err)
+				}
+				body, _ := io.ReadAll(resp.Body)
+				resp.Body.Close()
+				if string(body) != "hello" {
+					t.Errorf("expected body %q from %s with %s, got %q", "hello", target, test.name, body)
+				}
+			}
+			client.CloseIdleConnections()
+		}
+		if n := conns.Load(); n != 1 {
+			t.Errorf("expected 1 ssh connection with %s, got %d", test.name, n)
+		}
+	}
+
+	// An unknown host key is rejected.
+	otherAddr, _ := sshServer(t, nil, &conns)
+	rt, err := NewUTLSRoundTripper(Proxy("ssh://" + testUsername + ":" + testPassword + "@" + otherAddr + query))
+	if err != nil {
+		t.Fatalf("unexpected create utls round tripper: %v", err)
+	}
+	if _, err := rt.RoundTrip(newRequest(t, server.URL)); err == nil {
+		t.Errorf("expected error with unknown host key")
+	}
+}
+
+// Test that dials waiting for the connection to an SSH server made by
+// another give up with their own context.
+func TestProxySSHDialContext(t *testing.T) {
+	// A server that never completes the handshake.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected listen: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	pd, err := ProxySSH("tcp", ln.Addr().String(), &ssh.ClientConfig{
+		User:            testUsername,
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	}, proxy.Direct)
+	if err != nil {
+		t.Fatalf("unexpected create ssh dialer: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go pd.DialContext(ctx, "tcp", "example.com:80")
+	time.Sleep(50 * time.Millisecond)
+
+	waitCtx, waitCancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer waitCancel()
+	start := time.Now()
+	if _, err := pd.DialContext(waitCtx, "tcp", "example.com:80"); err == nil {
+		t.Errorf("expected error with a server that does not answer")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected dial to give up with its context, took %v", elapsed)
+	}
+}
+
+// Test that the connection to an SSH server is kept while the server answers
+// keepalive requests, and closed once it stops.
+func TestProxySSHKeepAlive(t *testing.T) {
+	_, hostKey, _ := ed25519.GenerateKey(rand.Reader)
+	hostSigner, err := ssh.NewSignerFromKey(hostKey)
+	if err != nil {
+		t.Fatalf("unexpected host key: %v", err)
+	}
+	config := &ssh.ServerConfig{NoClientAuth: true}
+	config.AddHostKey(hostSigner)
+
+	for _, answer := range []bool{true, false} {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("unexpected listen: %v", err)
+		}
+		defer ln.Close()
+		var keepAlives atomic.Int32
+		go func() {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			_, chans, reqs, err := ssh.NewServerConn(conn, config)
+			if err != nil {
+				return
+			}
+			go func() {
+				for newCh := range chans {
+					newCh.Reject(ssh.UnknownChannelType, "unsupported")
+				}
+			}()
+			for req := range reqs {
+				if req.Type == "keepalive@openssh.com" {
+					keepAlives.Add(1)
+				}
+				if answer {
+					req.Reply(false, nil)
+				}
+			}
+		}()
+
+		pd, err := ProxySSH("tcp", ln.Addr().String(), &ssh.ClientConfig{
+			User:            testUsername,
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		}, proxy.Direct)
+		if err != nil {
+			t.Fatalf("unexpected create ssh dialer: %v", err)
+		}
+		pd.keepAliveInterval = 20 * time.Millisecond
+		client, err := pd.dialClient(context.Background())
+		if err != nil {
+			t.Fatalf("unexpected ssh connection: %v", err)
+		}
+		time.Sleep(200 * time.Millisecond)
+
+		if n := keepAlives.Load(); n == 0 {
+			t.Errorf("expected keepalive requests, answer %v", answer)
+		}
+		pd.mu.Lock()
+		kept := pd.client == client
+		pd.mu.Unlock()
+		if answer && !kept {
+			t.Error("expected connection kept while keepalives are answered")
+		}
+		if !answer && kept {
+			t.Error("expected connection closed once keepalives go unanswered")
+		}
+		client.Close()
+	}
+}
@@ -0,0 +1,158 @@
+// Copyright 2023 Wayback Archiver. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package proxier // import "github.com/wabarc/proxier"
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// A cachedTransport is an http.Transport or http2.Transport that has been
+// bootstrapped for a single host:port, together with the ALPN protocol it
+// negotiated.
+type cachedTransport struct {
+	// Closed once rt, protocol and err have been set.
+	ready chan struct{}
+
+	rt       http.RoundTripper
+	protocol string
+	err      error
+	// Whether err was caused by the context of the bootstrapping request.
+	cancelled bool
+
+	// Guarded by UTLSRoundTripper.mu.
+	lastUsed time.Time
+}
+
+// roundTripper returns the cached transport for addr, creating it if there is
+// none. Concurrent callers for the same addr share a single bootstrap dial,
+// which is bound to the context of the caller that started it.
+func (u *UTLSRoundTripper) roundTripper(ctx context.Context, addr string) (*cachedTransport, error) {
+	for {
+		ct, err := u.cachedRoundTripper(ctx, addr)
+		// Try again if the bootstrap dial was cancelled by another
+		// caller's context rather than ours.
+		if err != nil && ct != nil && ct.cancelled && ctx.Err() == nil {
+			continue
+		}
+		return ct, err
+	}
+}
+
+func (u *UTLSRoundTripper) cachedRoundTripper(ctx context.Context, addr string) (*cachedTransport, error) {
+	now := time.Now()
+
+	u.mu.Lock()
+	if u.transports == nil {
+		u.transports = make(map[string]*cachedTransport)
+	}
+	u.evictIdleLocked(now)
+	ct, ok := u.transports[addr]
+	if !ok {
+		ct = &cachedTransport{ready: make(chan struct{})}
+		u.transports[addr] = ct
+	}
+	ct.lastUsed = now
+	u.mu.Unlock()
+
+	if !ok {
+		ct.rt, ct.protocol, ct.err = u.makeRoundTripper(ctx, addr)
+		if ct.err != nil {
+			ct.cancelled = ctx.Err() != nil
+			u.evict(addr, ct)
+		}
+		close(ct.ready)
+	}
+
+	select {
+	case <-ct.ready:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	return ct, ct.err
+}
+
+// evict removes ct from the cache if it is still the transport for addr, and
+// closes its idle connections.
+func (u *UTLSRoundTripper) evict(addr string, ct *cachedTransport) {
+	u.mu.Lock()
+	if u.transports[addr] == ct {
+		delete(u.transports, addr)
+	}
+	u.mu.Unlock()
+
+	closeIdleConnections(ct)
+}
+
+// evictIdleLocked drops transports that have not been used for longer than
+// the idle connection timeout. Requests still in flight on a dropped
+// transport are left to finish. u.mu must be held.
+func (u *UTLSRoundTripper) evictIdleLocked(now time.Time) {
+	idleTimeout := u.transport.IdleConnTimeout
+	if idleTimeout <= 0 {
+		return
+	}
+	for addr, ct := range u.transports {
+		if now.Sub(ct.lastUsed) > idleTimeout {
+			delete(u.transports, addr)
+			go closeIdleConnections(ct)
+		}
+	}
+}
+
+// CloseIdleConnections closes any connections which were previously
+// connected from previous requests but are now sitting idle, and drops
+// the cached per-host transports.
+func (u *UTLSRoundTripper) CloseIdleConnections() {
+	u.mu.Lock()
+	transports := u.transports
+	u.transports = nil
+	u.mu.Unlock()
+
+	for _, ct := range transports {
+		closeIdleConnections(ct)
+	}
+	u.httpRT.CloseIdleConnections()
+	if u.h3 != nil {
+		u.h3.closeIdleConnections()
+	}
+	if u.routes != nil {
+		u.routes.closeIdleConnections()
+	}
+}
+
+func closeIdleConnections(ct *cachedTransport) {
+	select {
+	case <-ct.ready:
+	default:
+		// Still bootstrapping; the transport's own idle timeout
+		// takes care of it.
+		return
+	}
+	if c, ok := ct.rt.(interface{ CloseIdleConnections() }); ok {
+		c.CloseIdleConnections()
+	}
+}
+
+// rewindable reports whether req can be sent again after a failed attempt,
+// rewinding its body if needed.
+func rewindable(req *http.Request) (*http.Request, bool) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return req, true
+	}
+	if req.GetBody == nil {
+		return nil, false
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return nil, false
+	}
+	newReq := req.Clone(req.Context())
+	newReq.Body = body
+
+	return newReq, true
+}
@@ -0,0 +1,68 @@
+// Copyright 2023 Wayback Archiver. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package proxier // import "github.com/wabarc/proxier"
+
+import (
+	"context"
+	"errors"
+	"net"
+
+	"golang.org/x/net/proxy"
+)
+
+func init() {
+	for _, scheme := range []string{"socks4", "socks4a", "socks5", "socks5h", "http", "https"} {
+		RegisterProxyScheme(scheme+"+unix", unixSchemeDialer(scheme))
+	}
+}
+
+// unixSchemeDialer returns the factory of dialers for URLs such as
+// socks5+unix:///run/tor/socks, whose proxy of the scheme listens on the Unix
+// socket at the path of the URL. The host of the URL, localhost by default,
+// is the name of an https proxy.
+func unixSchemeDialer(scheme string) ProxyDialerFactory {
+	return func(hop ProxyHop, forward proxy.Dialer, u UTLS) (proxy.Dialer, error) {
+		if hop.URL.Path == "" {
+			return nil, errors.New("missing Unix socket path")
+		}
+		factory, ok := proxyScheme(scheme)
+		if !ok {
+			return nil, &UnsupportedSchemeError{Scheme: scheme}
+		}
+
+		path := hop.URL.Path
+		host := hop.URL.Hostname()
+		if host == "" {
+			host = "localhost"
+		}
+		unixURL := hop.URL
+		proxyURL := *hop.URL
+		proxyURL.Scheme = scheme
+		proxyURL.Host = net.JoinHostPort(host, "0")
+		proxyURL.Path, proxyURL.RawPath = "", ""
+		hop.URL = &proxyURL
+
+		pd, err := factory(hop, &unixDialer{path: path, forward: forward}, u)
+		if pd, ok := pd.(*httpProxy); ok {
+			// Hooks see the URL given.
+			pd.proxyURL = unixURL
+		}
+		return pd, err
+	}
+}
+
+// A unixDialer connects to the Unix socket at path, whatever the address.
+type unixDialer struct {
+	path    string
+	forward proxy.Dialer
+}
+
+func (d *unixDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+func (d *unixDialer) DialContext(ctx context.Context, _, _ string) (net.Conn, error) {
+	return dialContext(ctx, d.forward, "unix", d.path)
+}
@@ -0,0 +1,106 @@
+// Copyright 2023 Wayback Archiver. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package proxier // import "github.com/wabarc/proxier"
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	utls "github.com/refraction-networking/utls"
+)
+
+// unixBridge listens on a Unix socket at path, and relays its connections to
+// addr.
+func unixBridge(t *testing.T, path, addr string) {
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("unexpected listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				upstream, err := net.Dial("tcp", addr)
+				if err != nil {
+					return
+				}
+				defer upstream.Close()
+				go io.Copy(upstream, conn)
+				io.Copy(conn, upstream)
+			}()
+		}
+	}()
+}
+
+// Test that proxies are reached over Unix sockets.
+func TestProxyUnix(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	defer server.Close()
+	httpServer := httptest.NewServer(server.Config.Handler)
+	defer httpServer.Close()
+
+	// Socket paths are short.
+	dir, err := os.MkdirTemp("", "proxier")
+	if err != nil {
+		t.Fatalf("unexpected create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	socks5Addrs := make(chan string, 10)
+	log := make(chan string, 10)
+	proxies := map[string]string{
+		"socks5h": socks5Server(t, socks5Addrs),
+		"http":    connectProxy(t, "http", false, nil, log).Host,
+		"https":   connectProxy(t, "https", true, nil, log).Host,
+	}
+	for scheme, addr := range proxies {
+		path := filepath.Join(dir, scheme+".sock")
+		unixBridge(t, path, addr)
+
+		rt, err := NewUTLSRoundTripper(
+			Config(&utls.Config{InsecureSkipVerify: true}),
+			Proxy(scheme+"+unix://"+path),
+		)
+		if err != nil {
+			t.Fatalf("unexpected create utls round tripper with %s: %v", scheme, err)
+		}
+		client := &http.Client{Transport: rt}
+		for _, target := range []string{server.URL, httpServer.URL} {
+			resp, err := client.Get(target)
+			if err != nil {
+				t.Fatalf("unexpected request to %s through %s: %v", target, scheme, err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if string(body) != "hello" {
+				t.Errorf("expected body %q from %s through %s, got %q", "hello", target, scheme, body)
+			}
+			select {
+			case <-socks5Addrs:
+			case <-log:
+			default:
+				t.Errorf("expected request to %s through %s proxy", target, scheme)
+			}
+		}
+		client.CloseIdleConnections()
+	}
+
+	if _, err := NewUTLSRoundTripper(Proxy("socks5+unix://")); err == nil {
+		t.Errorf("expected error with no socket path")
+	}
+}
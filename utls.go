@@ -5,53 +5,130 @@
 package proxier
 
 import (
+	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
-	"net/url"
+	"sync"
 
+	utls "github.com/refraction-networking/utls"
 	"golang.org/x/net/http2"
 	"golang.org/x/net/proxy"
-
-	utls "github.com/refraction-networking/utls"
 )
 
-var defaultClientHelloID = &utls.HelloChrome_102
-
 // A http.RoundTripper that uses uTLS (with a specified Client Hello ID) to make
 // TLS connections.
 //
-// Can only be reused among servers which negotiate the same ALPN.
+// Transports are cached per host:port, so connections are kept alive and
+// reused (or multiplexed, for HTTP/2) across requests to the same server.
 type UTLSRoundTripper struct {
-	clientHelloID *utls.ClientHelloID
-	config        *utls.Config
+	// Makes uTLS connections through proxyDialer.
+	tlsDialer *UTLSDialer
 
 	proxyDialer proxy.Dialer
 
+	// Template for the internal transports, carrying the configured
+	// timeouts.
+	transport *http.Transport
+
 	// Transport for HTTP requests, which don't use uTLS.
 	httpRT *http.Transport
+	// Authentication of the HTTP or HTTPS proxy httpRT sends requests to,
+	// if any.
+	httpProxyAuth *proxyAuth
+
+	// HTTP/2 health check settings.
+	h2 http2Timeouts
+
+	// HTTP/2 fingerprint. The zero value is that of http2.Transport.
+	h2Settings *HTTP2Settings
+
+	// Browser profile whose headers are used, if any.
+	profile *BrowserProfile
+
+	// Transport for HTTPS requests over HTTP/3, if enabled.
+	h3 *http3RoundTripper
+
+	// Chooses the proxy of each request, if set. Requests through a
+	// proxy are sent by its own round tripper.
+	routes *proxyRoutes
+
+	// Guards transports.
+	mu sync.Mutex
+	// Transports for HTTPS requests, keyed by host:port.
+	transports map[string]*cachedTransport
 }
 
 // RoundTrip executes a single HTTP transaction, using the UTLS protocol for secure connections.
 // It takes an `http.Request` and returns an `http.Response` and an error.
 // This method is used in an HTTP client to send a request and receive a response.
 func (u *UTLSRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if u.routes != nil {
+		return u.routes.roundTrip(req)
+	}
+	return u.roundTrip(req)
+}
+
+// roundTrip sends req directly or through the proxies of u.
+func (u *UTLSRoundTripper) roundTrip(req *http.Request) (*http.Response, error) {
+	var roundTrip func(*http.Request) (*http.Response, error)
 	switch req.URL.Scheme {
 	case "http":
 		// If http, we don't invoke uTLS; just pass it to an ordinary http.Transport.
-		return u.httpRT.RoundTrip(req)
+		roundTrip = u.httpRoundTrip
 	case "https":
-		return u.httpsRoundTrip(req)
+		roundTrip = u.httpsRoundTrip
 	default:
-		return nil, fmt.Errorf("unsupported URL scheme: %s", req.URL.Scheme)
+		return nil, &UnsupportedSchemeError{Scheme: req.URL.Scheme}
+	}
+
+	var (
+		compressed bool
+		order      []string
+	)
+	if u.profile != nil {
+		req, compressed = u.profile.apply(req)
+		order = u.profile.HeaderOrder
+	}
+	req = orderHeaders(req, order)
+
+	resp, err := roundTrip(req)
+	if err == nil && compressed {
+		decompress(resp)
+	}
+
+	return resp, err
+}
+
+// httpRoundTrip sends an HTTP request, answering the authentication
+// challenges of the proxy it is sent to, if any.
+func (u *UTLSRoundTripper) httpRoundTrip(req *http.Request) (*http.Response, error) {
+	if u.httpProxyAuth == nil {
+		return u.httpRT.RoundTrip(req)
+	}
+
+	req = req.Clone(req.Context())
+	u.httpProxyAuth.preempt(req)
+	for attempt := 1; ; attempt++ {
+		resp, err := u.httpRT.RoundTrip(req)
+		if err != nil || resp.StatusCode != http.StatusProxyAuthRequired || attempt == maxAuthAttempts {
+			return resp, err
+		}
+		retry, ok := rewindable(req)
+		if !ok || u.httpProxyAuth.answer(resp, retry) != nil {
+			return resp, nil
+		}
+		io.Copy(io.Discard, io.LimitReader(resp.Body, maxConnectBodyLen))
+		resp.Body.Close()
+		req = retry
 	}
 }
 
 func (u *UTLSRoundTripper) httpsRoundTrip(req *http.Request) (*http.Response, error) {
-	var err error
-	// Make an http.Transport or http2.Transport as appropriate.
-	rt, err := u.makeRoundTripper(req.URL)
+	addr, err := addrForDial(req.URL)
 	if err != nil {
 		return nil, err
 	}
@@ -60,50 +137,79 @@ func (u *UTLSRoundTripper) httpsRoundTrip(req *http.Request) (*http.Response, er
 		req.Header.Set("User-Agent", useragent)
 	}
 
-	// Forward the request to the internal http.Transport or http2.Transport.
-	return rt.RoundTrip(req)
-}
+	if resp, ok, err := u.http3RoundTrip(req, addr); ok {
+		return resp, err
+	}
 
-func (u *UTLSRoundTripper) makeRoundTripper(url *url.URL) (http.RoundTripper, error) {
-	addr, err := addrForDial(url)
-	if err != nil {
-		return nil, err
+	for retried := false; ; retried = true {
+		// Get the cached http.Transport or http2.Transport for addr,
+		// making one as appropriate.
+		ct, err := u.roundTripper(req.Context(), addr)
+		if err != nil {
+			return nil, err
+		}
+
+		// Forward the request to the internal http.Transport or http2.Transport.
+		resp, err := ct.rt.RoundTrip(req)
+		if err == nil && u.h3 != nil {
+			// Look for an HTTP/3 endpoint to use next time.
+			u.h3.observe(addr, resp)
+		}
+		var alpnErr *ALPNMismatchError
+		if err == nil || !errors.As(err, &alpnErr) {
+			return resp, err
+		}
+
+		// The server changed its ALPN protocol; throw away the stale
+		// transport and bootstrap a new one, once.
+		u.evict(addr, ct)
+		if retried {
+			return nil, err
+		}
+		var ok bool
+		if req, ok = rewindable(req); !ok {
+			return nil, err
+		}
 	}
+}
 
+func (u *UTLSRoundTripper) makeRoundTripper(ctx context.Context, addr string) (http.RoundTripper, string, error) {
 	// Connect to the given address, through a proxy if requested, and
 	// initiate a TLS handshake using the given ClientHelloID. Return the
 	// resulting connection.
-	dial := func(network, addr string) (*utls.UConn, error) {
-		return dialUTLS(network, addr, u.config, u.clientHelloID, u.proxyDialer)
-	}
+	dial := u.tlsDialer.dialUTLS
 
-	bootstrapConn, err := dial("tcp", addr)
+	bootstrapConn, err := dial(ctx, "tcp", addr)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 
 	// Peek at what protocol we negotiated.
 	protocol := bootstrapConn.ConnectionState().NegotiatedProtocol
 
 	// Protects bootstrapConn.
+	var mu sync.Mutex
 	// This is the callback for future dials done by the internal
 	// http.Transport or http2.Transport.
-	dialTLS := func(network, addr string) (net.Conn, error) {
+	dialTLS := func(ctx context.Context, network, addr string) (net.Conn, error) {
 		// On the first dial, reuse bootstrapConn.
-		if bootstrapConn != nil {
-			uconn := bootstrapConn
-			bootstrapConn = nil
+		mu.Lock()
+		uconn := bootstrapConn
+		bootstrapConn = nil
+		mu.Unlock()
+		if uconn != nil {
 			return uconn, nil
 		}
 
 		// Later dials make a new connection.
-		uconn, err := dial(network, addr)
+		uconn, err := dial(ctx, network, addr)
 		if err != nil {
 			return nil, err
 		}
 		if uconn.ConnectionState().NegotiatedProtocol != protocol {
-			return nil, fmt.Errorf("unexpected switch from ALPN %q to %q",
-				protocol, uconn.ConnectionState().NegotiatedProtocol)
+			uconn.Close()
+			return nil, &ALPNMismatchError{Addr: addr, Want: protocol,
+				Got: uconn.ConnectionState().NegotiatedProtocol}
 		}
 
 		return uconn, nil
@@ -112,30 +218,61 @@ func (u *UTLSRoundTripper) makeRoundTripper(url *url.URL) (http.RoundTripper, er
 	// Construct an http.Transport or http2.Transport depending on ALPN.
 	switch protocol {
 	case http2.NextProtoTLS:
-		// Unfortunately http2.Transport does not expose the same
-		// configuration options as http.Transport with regard to
-		// timeouts, etc., so we are at the mercy of the defaults.
+		// http2.Transport does not expose the same configuration
+		// options as http.Transport with regard to timeouts, etc.
 		// https://github.com/golang/go/issues/16581
-		return &http2.Transport{
-			DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
-				// Ignore the *tls.Config parameter; use our
-				// static cfg instead.
-				return dialTLS(network, addr)
-			},
-		}, nil
+		// It does read them from the http.Transport it was configured
+		// from, so configure it from a throwaway clone of ours, then
+		// let it dial connections by itself again.
+		t1 := u.transport.Clone()
+		t2, err := http2.ConfigureTransports(t1)
+		if err != nil {
+			bootstrapConn.Close()
+			return nil, "", err
+		}
+		t2.ConnPool = nil
+		u.h2Settings.configure(t1, t2)
+		t2.ReadIdleTimeout = u.h2.readIdleTimeout
+		t2.PingTimeout = u.h2.pingTimeout
+		t2.WriteByteTimeout = u.h2.writeByteTimeout
+		// Frames are rewritten only for a fingerprint, or the header
+		// order of the profile.
+		if u.h2Settings.isZero() && (u.profile == nil || len(u.profile.HeaderOrder) == 0) {
+			t2.DialTLSContext = func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+				return dialTLS(ctx, network, addr)
+			}
+			return http2PlainTransport{t2}, protocol, nil
+		}
+		t2.DialTLSContext = func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			// Ignore the *tls.Config parameter; use our
+			// static cfg instead.
+			conn, err := dialTLS(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			return newHTTP2FingerprintConn(conn, u.h2Settings), nil
+		}
+		return t2, protocol, nil
 	default:
 		// With http.Transport, copy important default fields from
-		// http.DefaultTransport, such as TLSHandshakeTimeout and
-		// IdleConnTimeout, before overriding DialTLS.
-		tr := httpRoundTripper.Clone()
-		tr.DialTLS = dialTLS
-		return tr, nil
+		// http.DefaultTransport, such as IdleConnTimeout, as well as
+		// the configured timeouts, before overriding DialTLS.
+		tr := u.transport.Clone()
+		tr.DialTLSContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := dialTLS(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			return newHTTP1OrderConn(conn), nil
+		}
+		return tr, protocol, nil
 	}
 }
 
 // Dialer returns the underlying *net.Dialer used by the UTLSRoundTripper's proxyDialer.
 // This method is useful for accessing additional properties of the dialer,
-// such as its proxy settings.
+// such as its proxy settings. The returned dialer also implements
+// proxy.ContextDialer.
 //
 //	func main() {
 //		dialer := UTLSRoundTripper.Dialer()
@@ -160,29 +297,110 @@ func (u *UTLSRoundTripper) Dialer() proxy.Dialer {
 // and an error.
 func NewUTLSRoundTripper(opts ...UTLSOption) (http.RoundTripper, error) {
 	u := UTLSOptions(opts...)
+	if u.profileName != "" && u.profile == nil {
+		return nil, fmt.Errorf("unknown browser profile %q", u.profileName)
+	}
+	if u.http3Mode != HTTP3Disabled && (u.clientHelloSpec != nil || u.helloSelector != nil ||
+		u.profileName != "" || *u.clientHello != utls.HelloGolang) {
+		return nil, errors.New("HTTP3 cannot be used with ClientHello, ClientHelloSpec, RotateClientHello or Profile")
+	}
 
+	proxyFunc := u.proxyFunc
+	u.proxyFunc = nil
+	rt, err := newUTLSRoundTripper(u)
+	if err != nil {
+		return nil, err
+	}
+	if proxyFunc != nil {
+		rt.routes = &proxyRoutes{opts: u, proxyFunc: proxyFunc, direct: rt}
+	}
+
+	return rt, nil
+}
+
+// newUTLSRoundTripper returns a round tripper with the options u.
+func newUTLSRoundTripper(u UTLS) (*UTLSRoundTripper, error) {
 	var (
 		err error
 
-		proxyURL *url.URL
+		hops []ProxyHop
 
 		rt = &UTLSRoundTripper{
-			clientHelloID: u.clientHello,
-			config:        u.config,
+			transport: u.transport(),
+			h2:        u.http2,
+			profile:   u.profile,
 		}
 	)
 
-	rt.proxyDialer, proxyURL, err = makeProxyDialer(u.proxy, u.config, u.clientHello)
+	switch {
+	case u.http2Settings != nil:
+		rt.h2Settings = u.http2Settings
+	case u.profile != nil:
+		rt.h2Settings = &u.profile.HTTP2
+	default:
+		rt.h2Settings = &HTTP2Settings{}
+	}
+
+	rt.proxyDialer, hops, err = makeProxyDialer(u)
 	if err != nil {
 		return nil, fmt.Errorf("make proxy dialer failed: %w", err)
 	}
+	rt.tlsDialer = &UTLSDialer{
+		config:           u.config,
+		clientHelloID:    u.clientHello,
+		clientHelloSpec:  u.clientHelloSpec,
+		selector:         u.helloSelector,
+		onHello:          u.onHello,
+		forward:          rt.proxyDialer,
+		handshakeTimeout: u.handshakeTimeout(),
+	}
 
 	// This special-case RoundTripper is used for HTTP requests, which don't
-	// use uTLS but should use the specified proxy.
-	httpRT := httpRoundTripper.Clone()
-	httpRT.Proxy = http.ProxyURL(proxyURL)
+	// use uTLS but should use the specified proxies. An HTTP or HTTPS proxy
+	// at the end of the chain is sent the requests themselves, through the
+	// proxies before it, unless the CONNECT requests are customized.
+	httpRT := rt.transport.Clone()
+	forward := rt.proxyDialer
+	if n := len(hops); n > 0 && !u.customConnect() {
+		if last := hops[n-1]; last.URL.Scheme == "http" || last.URL.Scheme == "https" {
+			if forward, err = u.chainDialer(hops[:n-1]); err != nil {
+				return nil, fmt.Errorf("make proxy dialer failed: %w", err)
+			}
+			// The credentials are sent by httpRoundTrip, since
+			// http.Transport would override its header.
+			proxyURL := *last.URL
+			proxyURL.User = nil
+			httpRT.Proxy = http.ProxyURL(&proxyURL)
+			rt.httpProxyAuth = u.hopAuth(last)
+			// http.Transport speaks HTTP/1.1 to the proxy.
+			tlsDialer := u.proxyTLSDialer(last, forward)
+			tlsDialer.alpn = []string{"http/1.1"}
+			proxyTLSDialer := u.failDialer(tlsDialer, last, n)
+			forward = u.failDialer(forward, last, n)
+			httpRT.DialTLSContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+				conn, err := proxyTLSDialer.DialContext(ctx, network, addr)
+				if err != nil {
+					return nil, err
+				}
+				return newHTTP1OrderConn(conn), nil
+			}
+		}
+	}
+	httpRT.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dialContext(ctx, forward, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return newHTTP1OrderConn(conn), nil
+	}
 
 	rt.httpRT = httpRT
 
+	// QUIC cannot be tunnelled through the supported proxies, nor sent
+	// through a dialer.
+	if u.http3Mode != HTTP3Disabled && len(hops) == 0 && u.dialer == nil {
+		rt.h3 = newHTTP3RoundTripper(u.http3Mode, u.config, u.quicConfig)
+	}
+
 	return rt, nil
 }
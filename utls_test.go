@@ -6,11 +6,17 @@ package proxier // import "github.com/wabarc/proxier"
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"io"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	utls "github.com/refraction-networking/utls"
 )
@@ -80,7 +86,7 @@ func clientHelloResultingFromRoundTrip(t *testing.T, host string, rt *UTLSRoundT
 	// The RoundTrip fails because the goroutine "server" hangs up. So
 	// ignore an EOF error.
 	_, err = rt.RoundTrip(req)
-	if err != nil && err != io.EOF {
+	if err != nil && !errors.Is(err, io.EOF) {
 		return nil, err
 	}
 
@@ -253,3 +259,303 @@ func TestUTLSHTTPWithProxy(t *testing.T) {
 		}
 	}
 }
+
+// Test that repeated requests to the same server reuse a single connection,
+// for both HTTP/1.1 and HTTP/2.
+func TestUTLSConnectionReuse(t *testing.T) {
+	for _, enableHTTP2 := range []bool{false, true} {
+		var conns int32
+		server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(r.Proto))
+		}))
+		server.EnableHTTP2 = enableHTTP2
+		server.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+			if state == http.StateNew {
+				atomic.AddInt32(&conns, 1)
+			}
+		}
+		server.StartTLS()
+		defer server.Close()
+
+		rt, err := NewUTLSRoundTripper(Config(&utls.Config{InsecureSkipVerify: true}))
+		if err != nil {
+			t.Fatalf("unexpected create utls round tripper: %v", err)
+		}
+		client := &http.Client{Transport: rt}
+
+		for i := 0; i < 5; i++ {
+			resp, err := client.Get(server.URL)
+			if err != nil {
+				t.Fatalf("unexpected request: %v", err)
+			}
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			if enableHTTP2 && resp.ProtoMajor != 2 {
+				t.Errorf("expected HTTP/2 response, got %s", resp.Proto)
+			}
+		}
+		if n := atomic.LoadInt32(&conns); n != 1 {
+			t.Errorf("expected 1 connection with HTTP/2 %t, got %d", enableHTTP2, n)
+		}
+		client.CloseIdleConnections()
+	}
+}
+
+// Test that a request's context aborts a dial which is stuck in the TLS
+// handshake or in the proxy CONNECT exchange.
+func TestUTLSDialContextCancel(t *testing.T) {
+	// Make a server that accepts connections but never speaks.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected create server: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	for _, opts := range [][]UTLSOption{
+		{Config(&utls.Config{InsecureSkipVerify: true})},
+		{Config(&utls.Config{InsecureSkipVerify: true}), Proxy(&url.URL{Scheme: "http", Host: ln.Addr().String()})},
+	} {
+		rt, err := NewUTLSRoundTripper(opts...)
+		if err != nil {
+			t.Fatalf("unexpected create utls round tripper: %v", err)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://"+ln.Addr().String(), nil)
+		if err != nil {
+			t.Fatalf("unexpected request: %v", err)
+		}
+
+		start := time.Now()
+		_, err = rt.RoundTrip(req)
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("expected context deadline exceeded, got %v", err)
+		}
+		if elapsed := time.Since(start); elapsed > 5*time.Second {
+			t.Errorf("round trip took %v after the context expired", elapsed)
+		}
+	}
+}
+
+func TestUTLSTimeouts(t *testing.T) {
+	// A server that is slow to send response headers.
+	for _, enableHTTP2 := range []bool{false, true} {
+		server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case <-time.After(5 * time.Second):
+			case <-r.Context().Done():
+			}
+		}))
+		server.EnableHTTP2 = enableHTTP2
+		server.StartTLS()
+		defer server.Close()
+
+		rt, err := NewUTLSRoundTripper(
+			Config(&utls.Config{InsecureSkipVerify: true}),
+			ResponseHeaderTimeout(100*time.Millisecond),
+		)
+		if err != nil {
+			t.Fatalf("unexpected create utls round tripper: %v", err)
+		}
+		req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+		if err != nil {
+			t.Fatalf("unexpected request: %v", err)
+		}
+		start := time.Now()
+		if _, err = rt.RoundTrip(req); err == nil {
+			t.Errorf("expected response header timeout with HTTP/2 %t", enableHTTP2)
+		}
+		if elapsed := time.Since(start); elapsed > 4*time.Second {
+			t.Errorf("response header timeout with HTTP/2 %t took %v", enableHTTP2, elapsed)
+		}
+	}
+
+	// A proxy that accepts connections but never answers CONNECT.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected create proxy server: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	rt, err := NewUTLSRoundTripper(
+		Proxy(&url.URL{Scheme: "http", Host: ln.Addr().String()}),
+		ProxyConnectTimeout(100*time.Millisecond),
+	)
+	if err != nil {
+		t.Fatalf("unexpected create utls round tripper: %v", err)
+	}
+	req, err := http.NewRequest(http.MethodGet, "https://example.com", nil)
+	if err != nil {
+		t.Fatalf("unexpected request: %v", err)
+	}
+	if _, err = rt.RoundTrip(req); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected proxy CONNECT timeout, got %v", err)
+	}
+
+	// A negative dial timeout means no timeout.
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	rt, err = NewUTLSRoundTripper(DialTimeout(-1))
+	if err != nil {
+		t.Fatalf("unexpected create utls round tripper: %v", err)
+	}
+	resp, err := rt.RoundTrip(newRequest(t, server.URL))
+	if err != nil {
+		t.Fatalf("unexpected round trip without dial timeout: %v", err)
+	}
+	resp.Body.Close()
+}
+
+// Test that a custom ClientHelloSpec is used for connections to the server
+// and to an HTTPS proxy.
+func TestUTLSClientHelloSpec(t *testing.T) {
+	// The cipher suites and ALPN of clientHelloSpec.
+	ciphers := []byte("\x13\x01\x13\x02\x13\x03\xc0\x2b\xc0\x2f\xc0\x2c\xc0\x30\xcc\xa9\xcc\xa8\xc0\x13\xc0\x14\x00\x9c\x00\x9d\x00\x2f\x00\x35")
+	alpn := []byte("\x00\x10\x00\x0b\x00\x09\x08http/1.1")
+
+	rt, err := NewUTLSRoundTripper(
+		ClientHelloSpec(clientHelloSpec),
+		Config(&utls.Config{InsecureSkipVerify: true}),
+	)
+	if err != nil {
+		t.Fatalf("unexpected create utls round tripper: %v", err)
+	}
+	buf, err := clientHelloResultingFromRoundTrip(t, "localhost", rt.(*UTLSRoundTripper))
+	if err != nil {
+		t.Fatalf("unexpected client hello: %v", err)
+	}
+	if !bytes.Contains(buf, ciphers) || !bytes.Contains(buf, alpn) {
+		t.Errorf("expected custom spec in client hello: %+q", buf)
+	}
+
+	// Capture the ClientHello sent to an HTTPS proxy, which uses the spec
+	// unless the hop has a ClientHello of its own.
+	for _, hello := range []*utls.ClientHelloID{nil, &utls.HelloFirefox_Auto} {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("unexpected create proxy server: %v", err)
+		}
+		defer ln.Close()
+		ch := make(chan []byte, 1)
+		go func() {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			buf := make([]byte, 1024)
+			n, _ := conn.Read(buf)
+			ch <- buf[:n]
+		}()
+
+		rt, err = NewUTLSRoundTripper(
+			ClientHelloSpec(clientHelloSpec),
+			Config(&utls.Config{InsecureSkipVerify: true}),
+			Proxy(ProxyHop{URL: &url.URL{Scheme: "https", Host: ln.Addr().String()}, ClientHello: hello}),
+		)
+		if err != nil {
+			t.Fatalf("unexpected create utls round tripper: %v", err)
+		}
+		req, err := http.NewRequest(http.MethodGet, "https://example.com", nil)
+		if err != nil {
+			t.Fatalf("unexpected request: %v", err)
+		}
+		rt.RoundTrip(req)
+		buf := <-ch
+		if custom := bytes.Contains(buf, ciphers) && bytes.Contains(buf, alpn); custom != (hello == nil) {
+			t.Errorf("expected custom spec %t in client hello to proxy with hop ClientHello %v: %+q", hello == nil, hello, buf)
+		}
+	}
+}
+
+// Test that connections, direct or to the first proxy, are made by the
+// Dialer, whether it is a function, a proxy.Dialer or a net.Dialer.
+func TestUTLSDialer(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	defer server.Close()
+	httpServer := httptest.NewServer(server.Config.Handler)
+	defer httpServer.Close()
+	log := make(chan string, 10)
+	proxyURL := connectProxy(t, "proxy", false, nil, log)
+
+	var dials []string
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dials = append(dials, addr)
+		return (&net.Dialer{}).DialContext(ctx, network, addr)
+	}
+	for _, test := range []struct {
+		name   string
+		dialer interface{}
+	}{
+		{"func", dial},
+		{"proxy.Dialer", dialFunc(dial)},
+		{"net.Dialer", net.Dialer{LocalAddr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}}},
+	} {
+		for _, proxy := range []interface{}{nil, proxyURL} {
+			dials = nil
+			rt, err := NewUTLSRoundTripper(
+				Config(&utls.Config{InsecureSkipVerify: true}),
+				Dialer(test.dialer),
+				Proxy(proxy),
+			)
+			if err != nil {
+				t.Fatalf("unexpected create utls round tripper: %v", err)
+			}
+			client := &http.Client{Transport: rt}
+			for _, target := range []string{server.URL, httpServer.URL} {
+				resp, err := client.Get(target)
+				if err != nil {
+					t.Fatalf("unexpected request to %s with %s dialer: %v", target, test.name, err)
+				}
+				resp.Body.Close()
+			}
+			client.CloseIdleConnections()
+
+			want := []string{server.Listener.Addr().String(), httpServer.Listener.Addr().String()}
+			if proxy != nil {
+				want = []string{proxyURL.Host, proxyURL.Host}
+				<-log
+				<-log
+			}
+			if test.name != "net.Dialer" && strings.Join(dials, " ") != strings.Join(want, " ") {
+				t.Errorf("expected dials to %v with %s dialer, got %v", want, test.name, dials)
+			}
+		}
+	}
+
+	// A net.Dialer given to Proxy needs no local address.
+	rt, err := NewUTLSRoundTripper(Proxy(net.Dialer{}), Config(&utls.Config{InsecureSkipVerify: true}))
+	if err != nil {
+		t.Fatalf("unexpected create utls round tripper: %v", err)
+	}
+	resp, err := rt.RoundTrip(newRequest(t, server.URL))
+	if err != nil {
+		t.Fatalf("unexpected request: %v", err)
+	}
+	resp.Body.Close()
+
+	if _, err := NewUTLSRoundTripper(Dialer("direct")); err == nil {
+		t.Errorf("expected error with a dialer of unsupported type")
+	}
+}